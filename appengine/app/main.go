@@ -5,14 +5,19 @@ import (
 	"encoding/pem"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
 
+	"github.com/aktsk/nolmandy/config"
+	"github.com/aktsk/nolmandy/logging"
 	"github.com/aktsk/nolmandy/server"
 )
 
 func init() {
+	setLogger()
+
 	var cert *x509.Certificate
 
 	certFile, err := os.Open("cert.pem")
@@ -41,7 +46,65 @@ func init() {
 		}
 	}
 
-	http.HandleFunc("/", server.Parse(cert))
+	s := &server.Server{Cert: cert}
+
+	// A configuration file is loaded from NOLMANDY_CONFIG or nolmandy.yaml
+	configFileName := os.Getenv("NOLMANDY_CONFIG")
+	if configFileName == "" {
+		if _, err := os.Stat("nolmandy.yaml"); err == nil {
+			configFileName = "nolmandy.yaml"
+		}
+	}
+
+	if configFileName != "" {
+		cfg, err := config.Load(configFileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		v, err := cfg.Verifier()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if cert != nil {
+			v.Roots = append([]*x509.Certificate{cert}, v.Roots...)
+		}
+		s.Verifier = v
+
+		s.MaxBodySize = cfg.Server.MaxBodySize
+		s.MaxBatchSize = cfg.Server.MaxBatchSize
+		s.Entitlements = cfg.Server.Entitlements
+	}
+
+	http.Handle("/", s)
+}
+
+// setLogger makes a JSON logger the default logger, configured with
+// LOG_LEVEL, LOG_REDACTED_KEYS and LOG_REDACTION_SALT
+func setLogger() {
+	opts := logging.Options{
+		Format:        "json",
+		RedactionSalt: []byte(os.Getenv("LOG_REDACTION_SALT")),
+	}
+
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		var err error
+		opts.Level, err = logging.ParseLevel(level)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if keys := os.Getenv("LOG_REDACTED_KEYS"); keys != "" {
+		opts.RedactedKeys = logging.ParseKeys(keys)
+	}
+
+	logger, err := logging.New(os.Stderr, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
 }
 
 // It seems GAE/Go can not handle environment variables that has
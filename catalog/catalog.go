@@ -0,0 +1,156 @@
+// Package catalog describes in-app purchase products, so that receipts can
+// be interpreted by product type. Catalogs are loaded from Xcode StoreKit
+// configuration files or App Store Connect CSV exports.
+package catalog
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Type is the type of a product
+type Type string
+
+// Product types of the App Store
+const (
+	Consumable    Type = "consumable"
+	NonConsumable Type = "non_consumable"
+	AutoRenewable Type = "auto_renewable"
+	NonRenewing   Type = "non_renewing"
+)
+
+// Product is an in-app purchase product
+type Product struct {
+	ID   string
+	Type Type
+
+	// Entitlements are the names of entitlements which the product grants.
+	// The product ID is used when Entitlements is empty.
+	Entitlements []string
+
+	// SubscriptionGroup is the identifier of the subscription group of an
+	// auto-renewable subscription, and GroupLevel is its level in the group.
+	// Level 1 is the highest level of service.
+	SubscriptionGroup string
+	GroupLevel        int
+
+	// Duration is the period of a subscription
+	Duration time.Duration
+
+	// GracePeriod is how long an auto-renewable subscription stays active
+	// after expiration while its billing is retried. It is used when the
+	// pending renewal information of the App Store is not available.
+	GracePeriod time.Duration
+}
+
+// EntitlementNames returns the names of entitlements which the product grants
+func (p *Product) EntitlementNames() []string {
+	if len(p.Entitlements) == 0 {
+		return []string{p.ID}
+	}
+	return p.Entitlements
+}
+
+// Catalog is a set of products by product ID
+type Catalog struct {
+	Products map[string]*Product
+}
+
+// New returns a catalog of products
+func New(products ...*Product) *Catalog {
+	c := &Catalog{Products: make(map[string]*Product, len(products))}
+	c.Add(products...)
+	return c
+}
+
+// Load loads a catalog from an Xcode StoreKit configuration file (.storekit)
+// or an App Store Connect CSV export (.csv)
+func Load(name string) (*Catalog, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".storekit":
+		return LoadStoreKit(name)
+	case ".csv":
+		return LoadCSV(name)
+	default:
+		return nil, fmt.Errorf("unknown catalog format: %s", name)
+	}
+}
+
+// Add adds products, replacing products of the same IDs
+func (c *Catalog) Add(products ...*Product) {
+	if c.Products == nil {
+		c.Products = map[string]*Product{}
+	}
+	for _, p := range products {
+		c.Products[p.ID] = p
+	}
+}
+
+// Product returns a product by ID, or nil when it is not in the catalog
+func (c *Catalog) Product(id string) *Product {
+	if c == nil {
+		return nil
+	}
+	return c.Products[id]
+}
+
+// ParseType parses a product type. Names of StoreKit configuration files and
+// App Store Connect, such as "NonConsumable" and "Auto-Renewable
+// Subscription", are also accepted.
+func ParseType(s string) (Type, error) {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", "_", "", " ", "").Replace(s))
+
+	switch normalized {
+	case "consumable":
+		return Consumable, nil
+	case "nonconsumable":
+		return NonConsumable, nil
+	case "autorenewable", "autorenewablesubscription", "recurringsubscription":
+		return AutoRenewable, nil
+	case "nonrenewing", "nonrenewingsubscription":
+		return NonRenewing, nil
+	default:
+		return "", fmt.Errorf("unknown product type: %s", s)
+	}
+}
+
+// days are the lengths of ISO 8601 duration units in days. Months and years
+// are approximated.
+var days = map[string]int{"D": 1, "W": 7, "M": 30, "Y": 365}
+
+// ParseDuration parses the duration of a subscription, in ISO 8601 such as
+// "P1M", in words of App Store Connect such as "1 Month", or in Go such as
+// "720h". A month is 30 days and a year is 365 days.
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	if strings.HasPrefix(s, "P") {
+		var n int
+		var unit string
+		if _, err := fmt.Sscanf(s, "P%d%s", &n, &unit); err == nil && days[unit] > 0 {
+			return time.Duration(n*days[unit]) * 24 * time.Hour, nil
+		}
+		return 0, fmt.Errorf("invalid duration: %s", s)
+	}
+
+	var n int
+	var unit string
+	if _, err := fmt.Sscanf(s, "%d %s", &n, &unit); err == nil {
+		unit = strings.TrimSuffix(strings.ToLower(unit), "s")
+		words := map[string]string{"day": "D", "week": "W", "month": "M", "year": "Y"}
+		if u, ok := words[unit]; ok {
+			return time.Duration(n*days[u]) * 24 * time.Hour, nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration: %s", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,87 @@
+package catalog
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	for _, name := range []string{"testdata/Products.storekit", "testdata/products.csv"} {
+		c, err := Load(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]Product{
+			"com.example.coins":       {Type: Consumable},
+			"com.example.no_ads":      {Type: NonConsumable},
+			"com.example.season_pass": {Type: NonRenewing},
+			"com.example.yearly":      {Type: AutoRenewable, SubscriptionGroup: "21432517", GroupLevel: 1, Duration: 365 * 24 * time.Hour},
+			"com.example.monthly":     {Type: AutoRenewable, SubscriptionGroup: "21432517", GroupLevel: 2, Duration: 30 * 24 * time.Hour},
+		}
+
+		if len(c.Products) != len(expected) {
+			t.Fatalf("Wrong products of %s: %v", name, c.Products)
+		}
+
+		for id, e := range expected {
+			p := c.Product(id)
+			if p == nil || p.Type != e.Type || p.SubscriptionGroup != e.SubscriptionGroup || p.GroupLevel != e.GroupLevel || p.Duration != e.Duration {
+				t.Fatalf("Wrong %s of %s: %+v", id, name, p)
+			}
+		}
+	}
+
+	if _, err := Load("products.json"); err == nil {
+		t.Fatal("Unknown format should be an error")
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	invalid := []string{
+		"Type\nConsumable\n",
+		"Product ID,Type\ncom.example.coins,Gift\n",
+		"Product ID,Type,Group Level\ncom.example.monthly,Auto-Renewable Subscription,first\n",
+		"Product ID,Type,Duration\ncom.example.monthly,Auto-Renewable Subscription,P1Q\n",
+	}
+
+	for _, csv := range invalid {
+		if _, err := ParseCSV(strings.NewReader(csv)); err == nil {
+			t.Fatalf("CSV should be invalid:\n%s", csv)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":         0,
+		"P1W":      7 * 24 * time.Hour,
+		"P3M":      90 * 24 * time.Hour,
+		"1 Month":  30 * 24 * time.Hour,
+		"2 weeks":  14 * 24 * time.Hour,
+		"720h":     720 * time.Hour,
+		"3 Days":   3 * 24 * time.Hour,
+		"1 Year":   365 * 24 * time.Hour,
+		" P1Y ":    365 * 24 * time.Hour,
+		"24h0m0s":  24 * time.Hour,
+		"P14D":     14 * 24 * time.Hour,
+		"6 months": 180 * 24 * time.Hour,
+	}
+
+	for s, expected := range tests {
+		d, err := ParseDuration(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != expected {
+			t.Fatalf("Wrong duration of %q: %s", s, d)
+		}
+	}
+
+	for _, s := range []string{"P1", "PM", "1 Fortnight", "month"} {
+		if _, err := ParseDuration(s); err == nil {
+			t.Fatalf("Duration should be invalid: %q", s)
+		}
+	}
+}
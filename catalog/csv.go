@@ -0,0 +1,109 @@
+package catalog
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// csvColumns are the accepted headers of CSV columns, which are compared
+// case-insensitively
+var csvColumns = map[string][]string{
+	"id":       {"product id", "product_id", "productid"},
+	"type":     {"type", "product type", "product_type"},
+	"group":    {"subscription group id", "subscription group", "subscription_group"},
+	"level":    {"group level", "group_level", "subscription level", "level"},
+	"duration": {"duration", "subscription duration", "subscription_duration"},
+}
+
+// LoadCSV loads a catalog from a CSV file exported from App Store Connect
+func LoadCSV(name string) (*Catalog, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := ParseCSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return c, nil
+}
+
+// ParseCSV parses a CSV file of products. The first row is the header, which
+// has Product ID and Type columns, and optionally Subscription Group ID, Group
+// Level and Duration columns.
+func ParseCSV(r io.Reader) (*Catalog, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	index := map[string]int{}
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		for column, names := range csvColumns {
+			for _, name := range names {
+				if h == name {
+					index[column] = i
+				}
+			}
+		}
+	}
+
+	for _, column := range []string{"id", "type"} {
+		if _, ok := index[column]; !ok {
+			return nil, fmt.Errorf("%s column is not found", csvColumns[column][0])
+		}
+	}
+
+	c := New()
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		field := func(column string) string {
+			if i, ok := index[column]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		p := &Product{ID: field("id"), SubscriptionGroup: field("group")}
+		if p.ID == "" {
+			continue
+		}
+
+		if p.Type, err = ParseType(field("type")); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if level := field("level"); level != "" {
+			if p.GroupLevel, err = strconv.Atoi(level); err != nil {
+				return nil, fmt.Errorf("line %d: invalid group level: %s", line, level)
+			}
+		}
+
+		if p.Duration, err = ParseDuration(field("duration")); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		c.Add(p)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,83 @@
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// storeKit is the part of an Xcode StoreKit configuration file which
+// describes products
+type storeKit struct {
+	Products                 []storeKitProduct `json:"products"`
+	NonRenewingSubscriptions []storeKitProduct `json:"nonRenewingSubscriptions"`
+	SubscriptionGroups       []struct {
+		ID            string            `json:"id"`
+		Subscriptions []storeKitProduct `json:"subscriptions"`
+	} `json:"subscriptionGroups"`
+}
+
+type storeKitProduct struct {
+	ProductID                   string `json:"productID"`
+	Type                        string `json:"type"`
+	GroupNumber                 int    `json:"groupNumber"`
+	SubscriptionGroupID         string `json:"subscriptionGroupID"`
+	RecurringSubscriptionPeriod string `json:"recurringSubscriptionPeriod"`
+}
+
+// LoadStoreKit loads a catalog from an Xcode StoreKit configuration file
+func LoadStoreKit(name string) (*Catalog, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := ParseStoreKit(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return c, nil
+}
+
+// ParseStoreKit parses an Xcode StoreKit configuration file
+func ParseStoreKit(data []byte) (*Catalog, error) {
+	var sk storeKit
+	if err := json.Unmarshal(data, &sk); err != nil {
+		return nil, err
+	}
+
+	c := New()
+
+	products := append(sk.Products, sk.NonRenewingSubscriptions...)
+	for _, group := range sk.SubscriptionGroups {
+		for _, p := range group.Subscriptions {
+			if p.SubscriptionGroupID == "" {
+				p.SubscriptionGroupID = group.ID
+			}
+			products = append(products, p)
+		}
+	}
+
+	for _, p := range products {
+		t, err := ParseType(p.Type)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.ProductID, err)
+		}
+
+		duration, err := ParseDuration(p.RecurringSubscriptionPeriod)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.ProductID, err)
+		}
+
+		c.Add(&Product{
+			ID:                p.ProductID,
+			Type:              t,
+			SubscriptionGroup: p.SubscriptionGroupID,
+			GroupLevel:        p.GroupNumber,
+			Duration:          duration,
+		})
+	}
+
+	return c, nil
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aktsk/nolmandy/receipt"
+	"github.com/aktsk/nolmandy/server"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	// ProductionURL is the verifyReceipt endpoint of the App Store
+	ProductionURL = "https://buy.itunes.apple.com/verifyReceipt"
+	// SandboxURL is the verifyReceipt endpoint of the sandbox environment
+	SandboxURL = "https://sandbox.itunes.apple.com/verifyReceipt"
+)
+
+// Client posts requests to a verifyReceipt compatible endpoint, such as the
+// App Store, the sandbox environment or a nolmandy server.
+type Client struct {
+	// URL is the endpoint requests are posted to
+	URL string
+
+	// SandboxURL is the endpoint requests are posted to again when URL
+	// answers that the receipt is from the sandbox environment (21007).
+	// Empty SandboxURL disables the fallback.
+	SandboxURL string
+
+	HTTPClient *http.Client
+
+	// MaxRetries is how many times a request is retried when the endpoint
+	// is unreachable or answers with a retryable status.
+	MaxRetries int
+
+	// Backoff is the wait before the first retry, which doubles on each retry
+	Backoff time.Duration
+}
+
+// New returns a client for the App Store which falls back to the sandbox environment
+func New() *Client {
+	return &Client{
+		URL:        ProductionURL,
+		SandboxURL: SandboxURL,
+		HTTPClient: http.DefaultClient,
+		MaxRetries: 3,
+		Backoff:    500 * time.Millisecond,
+	}
+}
+
+// Verify posts a request and returns the decoded response. When the endpoint
+// is still unavailable after retries, the last retryable result is returned.
+func (c *Client) Verify(ctx context.Context, request server.Request) (*receipt.Result, error) {
+	result, err := c.verifyWithRetry(ctx, c.URL, request)
+	if err != nil {
+		return nil, err
+	}
+
+	// 21007: This receipt is from the test environment, but it was sent to
+	// the production environment for verification.
+	if result.Status == 21007 && c.SandboxURL != "" {
+		return c.verifyWithRetry(ctx, c.SandboxURL, request)
+	}
+
+	return result, nil
+}
+
+func (c *Client) verifyWithRetry(ctx context.Context, url string, request server.Request) (*receipt.Result, error) {
+	backoff := c.Backoff
+	for retry := 0; ; retry++ {
+		result, err := c.verify(ctx, url, request)
+		if retry >= c.MaxRetries || ctx.Err() != nil || !shouldRetry(result, err) {
+			return result, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) verify(ctx context.Context, url string, request server.Request) (*receipt.Result, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPError{URL: url, StatusCode: resp.StatusCode}
+	}
+
+	var result receipt.Result
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// shouldRetry reports whether a request should be retried. Network errors,
+// server errors and retryable results are retried.
+func shouldRetry(result *receipt.Result, err error) bool {
+	if err != nil {
+		var httpErr *HTTPError
+		return !errors.As(err, &httpErr) || httpErr.StatusCode >= 500
+	}
+	return IsRetryable(result)
+}
+
+// IsRetryable reports whether a result asks for the request to be retried.
+// Status codes 21100-21199 are internal data access errors.
+func IsRetryable(result *receipt.Result) bool {
+	return result.IsRetryable || (result.Status >= 21100 && result.Status <= 21199)
+}
+
+// HTTPError is returned when an endpoint responds with a status other than 200
+type HTTPError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s responded with HTTP status %d", e.URL, e.StatusCode)
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aktsk/nolmandy/receipt"
+	"github.com/aktsk/nolmandy/server"
+)
+
+func TestSandboxFallback(t *testing.T) {
+	production := respond(t, receipt.Result{Status: 21007})
+	defer production.Close()
+
+	sandbox := respond(t, receipt.Result{Status: 0, Environment: "Sandbox"})
+	defer sandbox.Close()
+
+	c := &Client{URL: production.URL, SandboxURL: sandbox.URL}
+
+	result, err := c.Verify(context.Background(), server.Request{ReceiptData: "MIIT6QYJK..."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Status != 0 {
+		t.Fatalf("Status should be 0, not %d", result.Status)
+	}
+
+	if result.Environment != "Sandbox" {
+		t.Fatalf("Wrong environment: %s", result.Environment)
+	}
+}
+
+func TestNoSandboxFallback(t *testing.T) {
+	production := respond(t, receipt.Result{Status: 21007})
+	defer production.Close()
+
+	c := &Client{URL: production.URL}
+
+	result, err := c.Verify(context.Background(), server.Request{ReceiptData: "MIIT6QYJK..."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Status != 21007 {
+		t.Fatalf("Status should be 21007, not %d", result.Status)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request server.Request
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+
+		result := receipt.Result{Status: 0}
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			result = receipt.Result{Status: 21005, IsRetryable: true}
+		case 2:
+			result = receipt.Result{Status: 21100}
+		}
+		json.NewEncoder(w).Encode(result)
+	}))
+	defer s.Close()
+
+	c := &Client{URL: s.URL, MaxRetries: 3, Backoff: time.Millisecond}
+
+	result, err := c.Verify(context.Background(), server.Request{ReceiptData: "MIIT6QYJK..."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Status != 0 {
+		t.Fatalf("Status should be 0, not %d", result.Status)
+	}
+
+	if requests != 3 {
+		t.Fatalf("Request should be sent 3 times, not %d", requests)
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	s := respond(t, receipt.Result{Status: 21199})
+	defer s.Close()
+
+	c := &Client{URL: s.URL, MaxRetries: 2, Backoff: time.Millisecond}
+
+	result, err := c.Verify(context.Background(), server.Request{ReceiptData: "MIIT6QYJK..."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Status != 21199 {
+		t.Fatalf("Status should be 21199, not %d", result.Status)
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	defer s.Close()
+
+	c := &Client{URL: s.URL, MaxRetries: 2, Backoff: time.Millisecond}
+
+	if _, err := c.Verify(context.Background(), server.Request{}); err == nil {
+		t.Fatal("Verify should fail when the endpoint responds with 404")
+	}
+}
+
+func respond(t *testing.T, result receipt.Result) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("Wrong method: %s", r.Method)
+		}
+		json.NewEncoder(w).Encode(result)
+	}))
+}
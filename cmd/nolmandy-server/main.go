@@ -1,16 +1,31 @@
 package main
 
 import (
-	"crypto/x509"
-	"encoding/pem"
+	"context"
+	"crypto/tls"
+	"expvar"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/aktsk/nolmandy/client"
+	"github.com/aktsk/nolmandy/config"
+	"github.com/aktsk/nolmandy/ledger"
+	"github.com/aktsk/nolmandy/logging"
+	"github.com/aktsk/nolmandy/proxy"
+	"github.com/aktsk/nolmandy/receipt"
 	"github.com/aktsk/nolmandy/server"
+	"github.com/aktsk/nolmandy/shadow"
+	"github.com/aktsk/nolmandy/store"
+	"github.com/aktsk/nolmandy/tracing"
 	"github.com/aktsk/nolmandy/version"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 const name = "nolmandy-server"
@@ -19,14 +34,69 @@ var GitCommit string
 
 func main() {
 	var (
-		port         int
-		certFileName string
-		versionFlag  bool
+		port              int
+		certFileName      string
+		versionFlag       bool
+		mode              string
+		upstream          string
+		sandboxUpstream   string
+		validateLocally   bool
+		shadowLogFileName string
+		readTimeout       time.Duration
+		writeTimeout      time.Duration
+		idleTimeout       time.Duration
+		maxBodySize       int64
+		tlsCertFileName   string
+		tlsKeyFileName    string
+		clientCAFileName  string
+		logOptions        logging.Options
+		traceOptions      tracing.Options
+		configFileName    string
+		checkConfig       bool
+		reloadInterval    time.Duration
+		adminPort         int
+		cacheSize         int
+		cacheTTL          time.Duration
+		batchWorkers      int
+		maxBatchSize      int64
+		withEntitlements  bool
+		transactionStore  string
+		reusePolicy       string
+		ledgerFileName    string
 	)
 
 	flag.IntVar(&port, "port", 8000, "Port to listen")
 	flag.StringVar(&certFileName, "certFile", "", "Certificate file")
 	flag.BoolVar(&versionFlag, "version", false, "print version string")
+	flag.StringVar(&mode, "mode", "verify", "Server mode (verify, proxy or shadow)")
+	flag.StringVar(&upstream, "upstream", client.ProductionURL, "Upstream verifyReceipt URL in proxy and shadow mode")
+	flag.StringVar(&sandboxUpstream, "sandboxUpstream", client.SandboxURL, "Upstream verifyReceipt URL for sandbox receipts in proxy and shadow mode (empty to disable)")
+	flag.StringVar(&shadowLogFileName, "shadowLog", "", "File to record mismatches in shadow mode (default: log)")
+	flag.BoolVar(&validateLocally, "validateLocally", false, "Validate receipts locally before proxying, and fall back to local results when upstream is unavailable")
+
+	flag.DurationVar(&readTimeout, "readTimeout", 10*time.Second, "Timeout for reading requests")
+	flag.DurationVar(&writeTimeout, "writeTimeout", 40*time.Second, "Timeout for writing responses")
+	flag.DurationVar(&idleTimeout, "idleTimeout", 2*time.Minute, "Timeout for idle keep-alive connections")
+	flag.Int64Var(&maxBodySize, "maxBodySize", server.DefaultMaxBodySize, "Maximum request body size in bytes (-1 for no limit)")
+	flag.StringVar(&tlsCertFileName, "tlsCert", "", "TLS certificate file")
+	flag.StringVar(&tlsKeyFileName, "tlsKey", "", "TLS private key file")
+	flag.StringVar(&clientCAFileName, "clientCA", "", "CA certificate file to require and verify TLS client certificates")
+	logOptions.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&traceOptions.Exporter, "traceExporter", "none", "OpenTelemetry trace exporter (none, otlp or stdout)")
+	flag.Float64Var(&traceOptions.SampleRatio, "traceSampleRatio", 1, "Ratio of traces to sample")
+	flag.StringVar(&configFileName, "config", "", "Configuration file. Flags override the server settings in it.")
+	flag.BoolVar(&checkConfig, "check-config", false, "Check the configuration file and exit")
+	flag.DurationVar(&reloadInterval, "reloadInterval", 10*time.Second, "Interval to check changes of the configuration file, certificates and CRLs (0 to disable)")
+	flag.IntVar(&cacheSize, "cacheSize", 0, "Number of verified receipts to cache (0 to disable)")
+	flag.DurationVar(&cacheTTL, "cacheTTL", 5*time.Minute, "Time to keep verified receipts in the cache")
+	flag.IntVar(&batchWorkers, "batchWorkers", 0, "Number of receipts verified concurrently in a batch of /verifyReceipts (default: the number of CPUs)")
+	flag.BoolVar(&withEntitlements, "entitlements", false, "Add the entitlements section computed with the catalog to verifyReceipt responses")
+	flag.Int64Var(&maxBatchSize, "maxBatchSize", server.DefaultMaxBatchSize, "Maximum decompressed size of a batch of /verifyReceipts in bytes (64 MiB by default), each request of which is limited by -maxBodySize (-1 for no limit)")
+	flag.IntVar(&adminPort, "adminPort", 0, "Port to listen for /admin endpoints separately, which is required by /admin/transactions (default: the same as -port)")
+
+	flag.StringVar(&transactionStore, "transactionStore", "", "Store to record transactions for user IDs to detect reuse (memory or a file path, default: disabled)")
+	flag.StringVar(&reusePolicy, "reusePolicy", server.ReuseWarn, "Policy for transactions reused by other users (warn or reject)")
+	flag.StringVar(&ledgerFileName, "ledger", "", "Ledger to record consumable purchases for user IDs (memory or a file path, default: disabled)")
 
 	flag.Parse()
 
@@ -35,27 +105,284 @@ func main() {
 		os.Exit(0)
 	}
 
-	var cert *x509.Certificate
-
-	if certFileName != "" {
-		certFile, err := os.Open(certFileName)
+	var cfg *config.Config
+	if configFileName != "" {
+		var err error
+		cfg, err = config.Load(configFileName)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		defer certFile.Close()
+		if err := setConfigFlags(cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if checkConfig {
+		if cfg == nil {
+			log.Fatal("-check-config requires -config")
+		}
+
+		if err := check(cfg); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("%s is OK: %d apps\n", configFileName, len(cfg.Apps))
+		os.Exit(0)
+	}
+
+	logger, err := logging.New(os.Stderr, logOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	traceOptions.ServiceName = name
+	shutdownTracing, err := tracing.Setup(context.Background(), traceOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// Certificates, secrets and the configuration are reloaded on SIGHUP
+	// and on file changes
+	var trustedRoots []string
+	if certFileName != "" {
+		trustedRoots = append(trustedRoots, certFileName)
+	}
+
+	reloader, err := config.NewReloader(configFileName, trustedRoots...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cacheSize > 0 {
+		cache := receipt.NewCache(cacheSize, cacheTTL)
+		reloader.SetCache(cache)
+		registerCacheMetrics(cache)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go reloader.ReloadOnSignal(ctx, hup)
+
+	if reloadInterval > 0 {
+		go reloader.Watch(ctx, reloadInterval)
+	}
 
-		certPEM, err := ioutil.ReadAll(certFile)
+	if reusePolicy != server.ReuseWarn && reusePolicy != server.ReuseReject {
+		log.Fatalf("Unknown reuse policy: %s", reusePolicy)
+	}
+
+	var transactions store.TransactionStore
+	switch transactionStore {
+	case "":
+	case "memory":
+		transactions = store.NewMemory()
+	default:
+		transactions, err = store.OpenFile(transactionStore)
 		if err != nil {
 			log.Fatal(err)
 		}
+	}
+	if transactions != nil {
+		defer transactions.Close()
+	}
 
-		certDER, _ := pem.Decode(certPEM)
-		cert, err = x509.ParseCertificate(certDER.Bytes)
+	var consumables ledger.Ledger
+	switch ledgerFileName {
+	case "":
+	case "memory":
+		consumables = ledger.NewMemory()
+	default:
+		consumables, err = ledger.OpenFile(ledgerFileName)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
+	if consumables != nil {
+		defer consumables.Close()
+	}
+
+	c := client.New()
+	c.URL = upstream
+	c.SandboxURL = sandboxUpstream
+
+	var handler http.Handler
+	switch mode {
+	case "verify":
+		// Server verifies receipts by itself
+	case "proxy":
+		handler = &proxy.Proxy{
+			Client:          c,
+			ValidateLocally: validateLocally,
+			Verifier:        reloader,
+			MaxBodySize:     maxBodySize,
+		}
+	case "shadow":
+		s := &shadow.Shadow{
+			Client:      c,
+			Verifier:    reloader,
+			Timeout:     30 * time.Second,
+			MaxInFlight: 100,
+			MaxBodySize: maxBodySize,
+		}
+		if shadowLogFileName != "" {
+			sink, err := shadow.NewFileSink(shadowLogFileName)
+			if err != nil {
+				log.Fatal(err)
+			}
+			sink.Redactor = logging.NewRedactor(logOptions)
+			s.Sink = sink
+		}
+		// Agreement rates are exposed on /debug/vars and /metrics
+		expvar.Publish("shadow", expvar.Func(func() interface{} { return s.Stats() }))
+		registerShadowMetrics(s)
+		handler = s
+	default:
+		log.Fatalf("Unknown mode: %s", mode)
+	}
+
+	// The admin token is not a flag so as not to expose it in the command line
+	adminToken := os.Getenv("NOLMANDY_ADMIN_TOKEN")
+
+	s := &server.Server{
+		Addr:         fmt.Sprintf(":%d", port),
+		Verifier:     reloader,
+		Handler:      handler,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  idleTimeout,
+		MaxBodySize:  maxBodySize,
+		TLSCertFile:  tlsCertFileName,
+		TLSKeyFile:   tlsKeyFileName,
+		ClientCAFile: clientCAFileName,
+		GitCommit:    GitCommit,
+		Store:        transactions,
+		ReusePolicy:  reusePolicy,
+		Ledger:       consumables,
+		AdminToken:   adminToken,
+		BatchWorkers: batchWorkers,
+		MaxBatchSize: maxBatchSize,
+		Entitlements: withEntitlements,
+	}
+	if adminPort != 0 {
+		s.AdminAddr = fmt.Sprintf(":%d", adminPort)
+	}
+	s.HandleAdmin("GET /debug/vars", expvar.Handler())
+
+	s.HandleAdmin("POST /admin/reload", reloader)
+	if consumables != nil {
+		s.HandleAdmin("/ledger/", server.LedgerHandler(consumables))
+	}
+	if transactions != nil && s.AdminAddr != "" {
+		// Transactions are only served on the admin listener
+		s.HandleAdmin("GET /admin/transactions", server.TransactionsHandler(transactions))
+	}
+
+	if err := s.ListenAndServe(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// setConfigFlags sets flags by the server settings of a configuration,
+// unless they are set in the command line
+func setConfigFlags(cfg *config.Config) error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for name, value := range cfg.Server.Flags() {
+		if set[name] {
+			continue
+		}
+
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// check loads the certificates, CRLs and keys in a configuration
+func check(cfg *config.Config) error {
+	if _, err := cfg.Verifier(); err != nil {
+		return err
+	}
+
+	if cfg.Server.TLSCert != "" || cfg.Server.TLSKey != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.Server.TLSCert, cfg.Server.TLSKey); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Server.ClientCA != "" {
+		if _, err := config.LoadCertificates(cfg.Server.ClientCA); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func registerCacheMetrics(c *receipt.Cache) {
+	lookups := map[string]func(receipt.CacheStats) int64{
+		"hit":  func(stats receipt.CacheStats) int64 { return stats.Hits },
+		"miss": func(stats receipt.CacheStats) int64 { return stats.Misses },
+	}
+
+	for result, count := range lookups {
+		prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "nolmandy",
+			Subsystem:   "receipt_cache",
+			Name:        "lookups_total",
+			Help:        "Number of verified receipt cache lookups by result.",
+			ConstLabels: prometheus.Labels{"result": result},
+		}, func() float64 { return float64(count(c.Stats())) }))
+	}
+
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "nolmandy",
+		Subsystem: "receipt_cache",
+		Name:      "evictions_total",
+		Help:      "Number of receipts evicted from the verified receipt cache.",
+	}, func() float64 { return float64(c.Stats().Evictions) }))
+
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "nolmandy",
+		Subsystem: "receipt_cache",
+		Name:      "entries",
+		Help:      "Number of receipts in the verified receipt cache.",
+	}, func() float64 { return float64(c.Stats().Entries) }))
+}
+
+func registerShadowMetrics(s *shadow.Shadow) {
+	comparisons := map[string]func(shadow.Stats) int64{
+		"matched":    func(stats shadow.Stats) int64 { return stats.Matched },
+		"mismatched": func(stats shadow.Stats) int64 { return stats.Mismatched },
+		"failed":     func(stats shadow.Stats) int64 { return stats.Failed },
+		"skipped":    func(stats shadow.Stats) int64 { return stats.Skipped },
+	}
+
+	for result, count := range comparisons {
+		prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "nolmandy",
+			Subsystem:   "shadow",
+			Name:        "comparisons_total",
+			Help:        "Number of shadow comparisons by result.",
+			ConstLabels: prometheus.Labels{"result": result},
+		}, func() float64 { return float64(count(s.Stats())) }))
+	}
 
-	server.Serve(port, cert)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "nolmandy",
+		Subsystem: "shadow",
+		Name:      "agreement_rate",
+		Help:      "Rate of shadow comparisons whose local and upstream results matched.",
+	}, func() float64 { return s.Stats().AgreementRate }))
 }
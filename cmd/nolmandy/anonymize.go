@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/aktsk/nolmandy/config"
+	"github.com/aktsk/nolmandy/logging"
+	"github.com/aktsk/nolmandy/receipt"
+)
+
+// anonymize runs the anonymize subcommand, which pseudonymizes a receipt read
+// from stdin and prints it re-signed with a test certificate.
+func anonymize(args []string) {
+	var (
+		certFileName     string
+		salt             string
+		dateShift        time.Duration
+		signCertFileName string
+		signKeyFileName  string
+		chainFileName    string
+		logOptions       logging.Options
+	)
+
+	flags := flag.NewFlagSet(name+" anonymize", flag.ExitOnError)
+	flags.StringVar(&certFileName, "certFile", "", "Certificate file to validate the input receipt")
+	flags.StringVar(&salt, "salt", "", "Salt for pseudonymizing identifiers")
+	flags.DurationVar(&dateShift, "shiftDates", 0, "Duration to shift dates by (e.g. -720h)")
+	flags.StringVar(&signCertFileName, "signCertFile", "", "Certificate file to sign the output receipt")
+	flags.StringVar(&signKeyFileName, "signKeyFile", "", "Private key file to sign the output receipt")
+	flags.StringVar(&chainFileName, "chainFile", "", "Certificate chain file embedded in the output receipt")
+
+	logOptions.RegisterFlags(flags)
+
+	flags.Parse(args)
+
+	setLogger(logOptions)
+
+	if salt == "" || signCertFileName == "" || signKeyFileName == "" {
+		fmt.Fprintln(os.Stderr, "-salt, -signCertFile and -signKeyFile are required")
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		handleError(err)
+	}
+
+	rcpt, err := parseReceipt(certFileName, string(stdin))
+	if err != nil {
+		handleError(err)
+	}
+
+	anonymizer := receipt.Anonymizer{Salt: []byte(salt), DateShift: dateShift}
+	anonymizer.Anonymize(rcpt)
+
+	signCert, err := loadCertificate(signCertFileName)
+	if err != nil {
+		handleError(err)
+	}
+
+	signKey, err := loadPrivateKey(signKeyFileName)
+	if err != nil {
+		handleError(err)
+	}
+
+	var chain []*x509.Certificate
+	if chainFileName != "" {
+		chain, err = config.LoadCertificates(chainFileName)
+		if err != nil {
+			handleError(err)
+		}
+	}
+
+	data, err := rcpt.Sign(signCert, signKey, chain)
+	if err != nil {
+		handleError(err)
+	}
+
+	fmt.Println(data)
+}
+
+// loadPrivateKey loads a PKCS #1 or PKCS #8 private key in a PEM file
+func loadPrivateKey(fileName string) (crypto.PrivateKey, error) {
+	keyPEM, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, _ := pem.Decode(keyPEM)
+	if keyDER == nil {
+		return nil, errors.New("no private key found in " + fileName)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(keyDER.Bytes); err == nil {
+		return key, nil
+	}
+
+	return x509.ParsePKCS8PrivateKey(keyDER.Bytes)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aktsk/nolmandy/catalog"
+	"github.com/aktsk/nolmandy/config"
+	"github.com/aktsk/nolmandy/receipt"
+)
+
+// batchInput is a line of a batch. Lines are base 64 encoded receipt data,
+// or JSON objects with IDs.
+type batchInput struct {
+	ID          json.RawMessage `json:"id"`
+	ReceiptData string          `json:"receipt-data"`
+	Password    string          `json:"password"`
+}
+
+// batchOutput is a line of the output of a batch. ID is the ID of the input,
+// or "file:line" when the input has no ID.
+type batchOutput struct {
+	ID     json.RawMessage `json:"id"`
+	Result receipt.Result  `json:"result"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// batchVerifier returns a verifier with the certificates in certFileName, or
+// with Apple Inc Root Certificate when certFileName is empty
+func batchVerifier(certFileName string, c *catalog.Catalog) (*receipt.Verifier, error) {
+	v := &receipt.Verifier{Catalog: c}
+	if certFileName != "" {
+		certs, err := config.LoadCertificates(certFileName)
+		if err != nil {
+			return nil, err
+		}
+		v.Roots = certs
+	}
+	return v, nil
+}
+
+// runBatch validates receipts in lines of files, or of stdin when there are
+// no files, with concurrency workers. Results are written to stdout in JSON
+// lines in the order of completion, and the numbers of statuses to stderr.
+// It returns false when any receipt is not valid, and an error when the
+// batch can not be read or the results can not be written.
+func runBatch(v *receipt.Verifier, concurrency int, files []string, stdin io.Reader, stdout, stderr io.Writer) (bool, error) {
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var writeErr error
+	encoder := json.NewEncoder(stdout)
+	statuses := map[int]int{}
+	write := func(output batchOutput) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		statuses[output.Result.Status]++
+		if err := encoder.Encode(output); err != nil && writeErr == nil {
+			writeErr = err
+		}
+	}
+
+	// IDs are kept until the receipts are validated
+	var ids sync.Map
+
+	// readErr is read after results, which are closed after requests
+	var readErr error
+	requests := make(chan receipt.BatchRequest)
+	go func() {
+		defer close(requests)
+
+		index := 0
+		readErr = readBatchInputs(files, stdin, func(source string, input batchInput, err error) {
+			id := input.ID
+			if len(id) == 0 || string(id) == "null" {
+				id, _ = json.Marshal(source)
+			}
+
+			if err != nil {
+				write(batchOutput{ID: id, Result: receipt.Result{Status: 21000}, Error: err.Error()})
+				return
+			}
+
+			ids.Store(index, id)
+			requests <- receipt.BatchRequest{Index: index, Data: input.ReceiptData, Password: input.Password}
+			index++
+		})
+	}()
+
+	for result := range v.ValidateMany(ctx, requests, concurrency) {
+		id, _ := ids.LoadAndDelete(result.Index)
+		output := batchOutput{ID: id.(json.RawMessage), Result: result.Result}
+		if result.Err != nil {
+			output.Error = result.Err.Error()
+		}
+		write(output)
+	}
+
+	if readErr != nil {
+		return false, readErr
+	}
+	if writeErr != nil {
+		return false, writeErr
+	}
+
+	return printSummary(stderr, statuses), nil
+}
+
+// readBatchInputs reads lines of files, or of stdin when there are no
+// files, and calls fn with each of them and its source, "file:line". Lines
+// which can not be decoded are given to fn with errors.
+func readBatchInputs(files []string, stdin io.Reader, fn func(source string, input batchInput, err error)) error {
+	if len(files) == 0 {
+		return readBatchLines("-", stdin, fn)
+	}
+
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+
+		err = readBatchLines(name, f, fn)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readBatchLines(name string, r io.Reader, fn func(source string, input batchInput, err error)) error {
+	reader := bufio.NewReader(r)
+
+	for line := 1; ; line++ {
+		b, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+
+		if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 {
+			var input batchInput
+			var decodeErr error
+			if trimmed[0] == '{' {
+				decodeErr = json.Unmarshal(trimmed, &input)
+			} else {
+				input.ReceiptData = string(trimmed)
+			}
+			fn(fmt.Sprintf("%s:%d", name, line), input, decodeErr)
+		}
+
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// printSummary prints the numbers of statuses to w, and returns false when
+// any status is not 0
+func printSummary(w io.Writer, statuses map[int]int) bool {
+	var codes []int
+	total := 0
+	for status, n := range statuses {
+		codes = append(codes, status)
+		total += n
+	}
+	sort.Ints(codes)
+
+	counts := make([]string, len(codes))
+	for i, status := range codes {
+		counts[i] = fmt.Sprintf("status %d: %d", status, statuses[status])
+	}
+
+	fmt.Fprintf(w, "total: %d", total)
+	if len(counts) > 0 {
+		fmt.Fprintf(w, ", %s", strings.Join(counts, ", "))
+	}
+	fmt.Fprintln(w)
+
+	return statuses[0] == total
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aktsk/nolmandy/internal/testutil"
+	"github.com/aktsk/nolmandy/receipt"
+)
+
+func TestRunBatch(t *testing.T) {
+	cert, data := testutil.SignedReceipt(t, testutil.Receipt())
+	v := &receipt.Verifier{Roots: []*x509.Certificate{cert}}
+
+	name := filepath.Join(t.TempDir(), "receipts.txt")
+	lines := []string{
+		data,
+		fmt.Sprintf(`{"id": 1, "receipt-data": %q}`, data),
+		"",
+		`{"id": "invalid", "receipt-data": "invalid"}`,
+		`{"id": "malformed"`,
+	}
+	if err := os.WriteFile(name, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	valid, err := runBatch(v, 2, []string{name}, nil, &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if valid {
+		t.Fatal("Batch with invalid receipts should not be valid")
+	}
+
+	statuses := batchStatuses(t, &stdout)
+	expected := map[string]int{
+		`"` + name + `:1"`: 0,
+		`1`:                0,
+		`"invalid"`:        21002,
+		`"` + name + `:5"`: 21000,
+	}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Fatalf("Wrong statuses: %v", statuses)
+	}
+
+	if summary := stderr.String(); summary != "total: 4, status 0: 2, status 21000: 1, status 21002: 1\n" {
+		t.Fatalf("Wrong summary: %s", summary)
+	}
+
+	// Lines are read from stdin without files
+	stdout.Reset()
+	stderr.Reset()
+	valid, err = runBatch(v, 1, nil, strings.NewReader(data+"\n"), &stdout, &stderr)
+	if err != nil || !valid {
+		t.Fatalf("Batch should be valid: %v", err)
+	}
+
+	if statuses := batchStatuses(t, &stdout); !reflect.DeepEqual(statuses, map[string]int{`"-:1"`: 0}) {
+		t.Fatalf("Wrong statuses: %v", statuses)
+	}
+
+	if _, err := runBatch(v, 1, []string{filepath.Join(t.TempDir(), "missing.txt")}, nil, &stdout, &stderr); err == nil {
+		t.Fatal("Missing file should be an error")
+	}
+}
+
+// TestRunBatchConcurrently validates receipts with several workers, so that
+// races of parallel validation are detected by go test -race
+func TestRunBatchConcurrently(t *testing.T) {
+	cert, data := testutil.SignedReceipt(t, testutil.Receipt())
+	v := &receipt.Verifier{Roots: []*x509.Certificate{cert}}
+
+	var lines []string
+	for i := 0; i < 64; i++ {
+		lines = append(lines, fmt.Sprintf(`{"id": %d, "receipt-data": %q}`, i, data))
+	}
+
+	var stdout, stderr bytes.Buffer
+	valid, err := runBatch(v, 8, nil, strings.NewReader(strings.Join(lines, "\n")), &stdout, &stderr)
+	if err != nil || !valid {
+		t.Fatalf("Batch should be valid: %v", err)
+	}
+
+	if statuses := batchStatuses(t, &stdout); len(statuses) != len(lines) {
+		t.Fatalf("Wrong number of results: %d", len(statuses))
+	}
+
+	if summary := stderr.String(); summary != "total: 64, status 0: 64\n" {
+		t.Fatalf("Wrong summary: %s", summary)
+	}
+}
+
+// TestBatchExitStatus runs main in batch mode in a subprocess
+func TestBatchExitStatus(t *testing.T) {
+	if args := os.Getenv("NOLMANDY_TEST_BATCH_ARGS"); args != "" {
+		os.Args = append([]string{"nolmandy", "-batch"}, strings.Split(args, "\n")...)
+		main()
+		return
+	}
+
+	cert, data := testutil.SignedReceipt(t, testutil.Receipt())
+
+	dir := t.TempDir()
+	certFileName := filepath.Join(dir, "cert.pem")
+	if err := os.WriteFile(certFileName, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		lines  string
+		status int
+	}{
+		{data + "\n" + data, 0},
+		{data + "\ninvalid", 1},
+	}
+
+	for i, test := range tests {
+		name := filepath.Join(dir, fmt.Sprintf("receipts%d.txt", i))
+		if err := os.WriteFile(name, []byte(test.lines), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		cmd := exec.Command(os.Args[0], "-test.run=^TestBatchExitStatus$")
+		cmd.Env = append(os.Environ(), "NOLMANDY_TEST_BATCH_ARGS=-certFile\n"+certFileName+"\n"+name)
+
+		status := 0
+		var exitErr *exec.ExitError
+		if err := cmd.Run(); errors.As(err, &exitErr) {
+			status = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		if status != test.status {
+			t.Fatalf("Wrong exit status: %d", status)
+		}
+	}
+}
+
+// batchStatuses returns the statuses of batch outputs by their IDs
+func batchStatuses(t *testing.T, r *bytes.Buffer) map[string]int {
+	statuses := map[string]int{}
+
+	decoder := json.NewDecoder(r)
+	for decoder.More() {
+		var output batchOutput
+		if err := decoder.Decode(&output); err != nil {
+			t.Fatal(err)
+		}
+		if output.Result.Status == 21000 && output.Error == "" {
+			t.Fatalf("Error should be given for status 21000: %+v", output)
+		}
+		statuses[string(output.ID)] = output.Result.Status
+	}
+
+	return statuses
+}
@@ -3,12 +3,16 @@ package main
 import (
 	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"os"
+	"runtime"
 
+	"github.com/aktsk/nolmandy/catalog"
+	"github.com/aktsk/nolmandy/config"
+	"github.com/aktsk/nolmandy/logging"
 	"github.com/aktsk/nolmandy/receipt"
 	"github.com/aktsk/nolmandy/version"
 )
@@ -18,62 +22,85 @@ const name = "nolmandy"
 var GitCommit string
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "anonymize":
+			anonymize(os.Args[2:])
+			return
+		case "timeline":
+			showTimeline(os.Args[2:])
+			return
+		}
+	}
+
 	var (
-		certFileName string
-		versionFlag  bool
+		certFileName    string
+		catalogFileName string
+		versionFlag     bool
+		batch           bool
+		concurrency     int
+		logOptions      logging.Options
 	)
 
 	flag.StringVar(&certFileName, "certFile", "", "Cetificate file")
+	flag.StringVar(&catalogFileName, "catalog", "", "Product catalog file (.storekit or .csv) to shape the result with")
 	flag.BoolVar(&versionFlag, "version", false, "print version string")
+	flag.BoolVar(&batch, "batch", false, "Validate receipts in lines of files or stdin, which are base 64 encoded receipt data or JSON objects with \"id\" and \"receipt-data\", and print results in JSON lines")
+	flag.IntVar(&concurrency, "concurrency", runtime.GOMAXPROCS(0), "Number of receipts validated concurrently in batch mode")
+	logOptions.RegisterFlags(flag.CommandLine)
 
 	flag.Parse()
 
+	setLogger(logOptions)
+
 	if versionFlag {
 		fmt.Printf("%s version: %s (rev: %s)", name, version.Get(), GitCommit)
 		os.Exit(0)
 	}
 
-	stdin, err := ioutil.ReadAll(os.Stdin)
-	if err != nil {
-		os.Stderr.WriteString(err.Error())
-		os.Exit(1)
-	}
-	receiptData := string(stdin)
-
-	var rcpt *receipt.Receipt
-	if certFileName != "" {
-		certFile, err := os.Open(certFileName)
-		if err != nil {
-			handleError(err)
-		}
-
-		defer certFile.Close()
-
-		certPEM, err := ioutil.ReadAll(certFile)
+	var c *catalog.Catalog
+	if catalogFileName != "" {
+		var err error
+		c, err = catalog.Load(catalogFileName)
 		if err != nil {
 			handleError(err)
 		}
+	}
 
-		certDER, _ := pem.Decode(certPEM)
-		cert, err := x509.ParseCertificate(certDER.Bytes)
+	if batch {
+		v, err := batchVerifier(certFileName, c)
 		if err != nil {
 			handleError(err)
 		}
 
-		rcpt, err = receipt.Parse(cert, receiptData)
+		valid, err := runBatch(v, concurrency, flag.Args(), os.Stdin, os.Stdout, os.Stderr)
 		if err != nil {
 			handleError(err)
 		}
-	} else {
-		var err error
-		rcpt, err = receipt.ParseWithAppleRootCert(receiptData)
-		if err != nil {
-			handleError(err)
+		if !valid {
+			os.Exit(1)
 		}
+		return
+	}
+
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		os.Stderr.WriteString(err.Error())
+		os.Exit(1)
+	}
+	receiptData := string(stdin)
+
+	rcpt, err := parseReceipt(certFileName, receiptData)
+	if err != nil {
+		handleError(err)
 	}
 
 	res, err := rcpt.Validate()
 
+	if c != nil {
+		res.Shape(c)
+	}
+
 	json, err := json.Marshal(res)
 	if err != nil {
 		handleError(err)
@@ -82,7 +109,39 @@ func main() {
 	fmt.Println(string(json))
 }
 
+// parseReceipt parses receipt data with the certificate in certFileName, or
+// with Apple Inc Root Certificate when certFileName is empty.
+func parseReceipt(certFileName string, receiptData string) (*receipt.Receipt, error) {
+	if certFileName == "" {
+		return receipt.ParseWithAppleRootCert(receiptData)
+	}
+
+	cert, err := loadCertificate(certFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return receipt.Parse(cert, receiptData)
+}
+
+func loadCertificate(fileName string) (*x509.Certificate, error) {
+	certs, err := config.LoadCertificates(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+// setLogger makes a logger by options the default logger
+func setLogger(opts logging.Options) {
+	logger, err := logging.New(os.Stderr, opts)
+	if err != nil {
+		handleError(err)
+	}
+	slog.SetDefault(logger)
+}
+
 func handleError(err error) {
-	os.Stderr.Write([]byte(err.Error()))
+	slog.Error(err.Error())
 	os.Exit(1)
 }
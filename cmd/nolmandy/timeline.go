@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/aktsk/nolmandy/catalog"
+	"github.com/aktsk/nolmandy/logging"
+	"github.com/aktsk/nolmandy/receipt"
+	"github.com/aktsk/nolmandy/timeline"
+)
+
+// showTimeline runs the timeline subcommand, which prints the subscription
+// timeline of receipt data or a verifyReceipt response read from stdin.
+func showTimeline(args []string) {
+	var (
+		certFileName    string
+		catalogFileName string
+		format          string
+		logOptions      logging.Options
+	)
+
+	flags := flag.NewFlagSet(name+" timeline", flag.ExitOnError)
+	flags.StringVar(&certFileName, "certFile", "", "Certificate file to validate the receipt")
+	flags.StringVar(&catalogFileName, "catalog", "", "Product catalog file (.storekit or .csv) to tell upgrades from downgrades")
+	flags.StringVar(&format, "format", "text", "Output format (text or json)")
+
+	logOptions.RegisterFlags(flags)
+
+	flags.Parse(args)
+
+	setLogger(logOptions)
+
+	if format != "text" && format != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown format: %s\n", format)
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var c *catalog.Catalog
+	if catalogFileName != "" {
+		var err error
+		c, err = catalog.Load(catalogFileName)
+		if err != nil {
+			handleError(err)
+		}
+	}
+
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		handleError(err)
+	}
+
+	var tl *timeline.Timeline
+
+	// verifyReceipt responses have the latest receipt info, which receipts
+	// may not have
+	if input := bytes.TrimSpace(stdin); bytes.HasPrefix(input, []byte("{")) {
+		var result receipt.Result
+		if err := json.Unmarshal(input, &result); err != nil {
+			handleError(err)
+		}
+		tl = timeline.FromResult(result, c)
+	} else {
+		rcpt, err := parseReceipt(certFileName, string(stdin))
+		if err != nil {
+			handleError(err)
+		}
+		tl = timeline.FromReceipt(rcpt, c)
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(tl); err != nil {
+			handleError(err)
+		}
+		return
+	}
+
+	if err := tl.WriteText(os.Stdout); err != nil {
+		handleError(err)
+	}
+}
@@ -0,0 +1,631 @@
+// Package config loads nolmandy server configuration files. A configuration
+// file is YAML, which has server settings and per-app settings by bundle ID.
+//
+//	server:
+//	  port: 8000
+//	  read_timeout: 10s
+//	trusted_roots:
+//	  - AppleIncRootCertificate.pem
+//	crls:
+//	  - revoked.crl
+//	reject_unknown_apps: true
+//	allowed_bundle_ids: ["com.example.*"]
+//	rules:
+//	  - name: old_receipt
+//	    expr: Now - Receipt.CreationDate > duration("720h")
+//	    severity: warn
+//	catalog:
+//	  files: [Products.storekit]
+//	  products:
+//	    - id: com.example.premium
+//	      type: auto_renewable
+//	      entitlements: [premium]
+//	apps:
+//	  - bundle_id: com.example.app
+//	    shared_secret: ${EXAMPLE_APP_SHARED_SECRET}
+//	    environments: [Production]
+//	    application_versions: ["1.0", ">=1.2, <2.0"]
+package config
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aktsk/nolmandy/catalog"
+	"github.com/aktsk/nolmandy/receipt"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of nolmandy server
+type Config struct {
+	Server Server `yaml:"server"`
+
+	// TrustedRoots are PEM files of root certificates trusted for all apps.
+	// Apple Inc Root Certificate is used when TrustedRoots is empty.
+	TrustedRoots []string `yaml:"trusted_roots"`
+
+	// CRLs are DER or PEM files of certificate revocation lists
+	CRLs []string `yaml:"crls"`
+
+	// AllowedBundleIDs are patterns of bundle IDs allowed in addition to
+	// Apps. Receipts of other apps are rejected when AllowedBundleIDs is not
+	// empty or RejectUnknownApps is true.
+	AllowedBundleIDs  []string `yaml:"allowed_bundle_ids"`
+	RejectUnknownApps bool     `yaml:"reject_unknown_apps"`
+
+	// Rules are evaluated for receipts of all apps
+	Rules []Rule `yaml:"rules"`
+
+	Catalog Catalog `yaml:"catalog"`
+
+	Apps []App `yaml:"apps"`
+}
+
+// Rule is a validation rule. See receipt.Rule for expressions.
+type Rule struct {
+	Name string `yaml:"name"`
+	Expr string `yaml:"expr"`
+
+	// Severity is reject or warn. The default is reject.
+	Severity string `yaml:"severity"`
+
+	Message string `yaml:"message"`
+}
+
+// Server is the settings of nolmandy server. They are the same as the
+// flags of nolmandy-server, and zero values mean the defaults of the flags.
+type Server struct {
+	Port             int           `yaml:"port"`
+	Mode             string        `yaml:"mode"`
+	Upstream         string        `yaml:"upstream"`
+	SandboxUpstream  *string       `yaml:"sandbox_upstream"`
+	ValidateLocally  *bool         `yaml:"validate_locally"`
+	ShadowLog        string        `yaml:"shadow_log"`
+	ReadTimeout      time.Duration `yaml:"read_timeout"`
+	WriteTimeout     time.Duration `yaml:"write_timeout"`
+	IdleTimeout      time.Duration `yaml:"idle_timeout"`
+	MaxBodySize      int64         `yaml:"max_body_size"`
+	TLSCert          string        `yaml:"tls_cert"`
+	TLSKey           string        `yaml:"tls_key"`
+	ClientCA         string        `yaml:"client_ca"`
+	LogLevel         string        `yaml:"log_level"`
+	LogFormat        string        `yaml:"log_format"`
+	TraceExporter    string        `yaml:"trace_exporter"`
+	TraceSampleRatio float64       `yaml:"trace_sample_ratio"`
+	TransactionStore string        `yaml:"transaction_store"`
+	ReusePolicy      string        `yaml:"reuse_policy"`
+	Ledger           string        `yaml:"ledger"`
+	AdminPort        int           `yaml:"admin_port"`
+	CacheSize        int           `yaml:"cache_size"`
+	CacheTTL         time.Duration `yaml:"cache_ttl"`
+	BatchWorkers     int           `yaml:"batch_workers"`
+	MaxBatchSize     int64         `yaml:"max_batch_size"`
+	Entitlements     bool          `yaml:"entitlements"`
+}
+
+// Catalog is the product catalog
+type Catalog struct {
+	// Files are Xcode StoreKit configuration files (.storekit) or App Store
+	// Connect CSV exports (.csv)
+	Files []string `yaml:"files"`
+
+	// Products are added to the products of Files. Products without type
+	// extend the products of Files of the same IDs, with entitlements for
+	// example.
+	Products []Product `yaml:"products"`
+}
+
+// Product is a product of the catalog. See catalog.Product.
+type Product struct {
+	ID                string        `yaml:"id"`
+	Type              string        `yaml:"type"`
+	Entitlements      []string      `yaml:"entitlements"`
+	SubscriptionGroup string        `yaml:"subscription_group"`
+	GroupLevel        int           `yaml:"group_level"`
+	Duration          string        `yaml:"duration"`
+	GracePeriod       time.Duration `yaml:"grace_period"`
+}
+
+// App is the settings of an app
+type App struct {
+	BundleID string `yaml:"bundle_id"`
+
+	// SharedSecret is the app-specific shared secret. "${NAME}" is replaced
+	// with the environment variable NAME.
+	SharedSecret string `yaml:"shared_secret"`
+
+	// Environments are the allowed environments, Production and Sandbox
+	Environments []string `yaml:"environments"`
+
+	// ApplicationVersions and OriginalApplicationVersions are the allowed
+	// versions or ranges such as ">=1.2, <2.0"
+	ApplicationVersions         []string `yaml:"application_versions"`
+	OriginalApplicationVersions []string `yaml:"original_application_versions"`
+
+	// TrustedRoots are PEM files of root certificates trusted for the app,
+	// instead of Config.TrustedRoots
+	TrustedRoots []string `yaml:"trusted_roots"`
+
+	// Rules are evaluated for receipts of the app after Config.Rules
+	Rules []Rule `yaml:"rules"`
+}
+
+// Load loads a configuration file. Relative paths in the file are resolved
+// from the directory of the file.
+func Load(name string) (*Config, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	c.resolvePaths(filepath.Dir(name))
+
+	return c, nil
+}
+
+// Parse parses a configuration and validates it
+func Parse(data []byte) (*Config, error) {
+	var c Config
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&c); err != nil {
+		return nil, err
+	}
+
+	for i := range c.Apps {
+		secret, err := expandEnv(c.Apps[i].SharedSecret)
+		if err != nil {
+			return nil, fmt.Errorf("shared_secret of %s: %w", c.Apps[i].BundleID, err)
+		}
+		c.Apps[i].SharedSecret = secret
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// Validate checks that the configuration is consistent
+func (c *Config) Validate() error {
+	switch c.Server.Mode {
+	case "", "verify", "proxy", "shadow":
+	default:
+		return fmt.Errorf("unknown mode: %s", c.Server.Mode)
+	}
+
+	switch c.Server.ReusePolicy {
+	case "", "warn", "reject":
+	default:
+		return fmt.Errorf("unknown reuse_policy: %s", c.Server.ReusePolicy)
+	}
+
+	for _, pattern := range c.AllowedBundleIDs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("allowed_bundle_ids: invalid pattern: %s", pattern)
+		}
+	}
+
+	if _, err := compileRules(c.Rules); err != nil {
+		return fmt.Errorf("rules: %w", err)
+	}
+
+	if _, err := c.Catalog.products(); err != nil {
+		return fmt.Errorf("catalog: %w", err)
+	}
+
+	bundleIDs := map[string]bool{}
+	for i, app := range c.Apps {
+		if app.BundleID == "" {
+			return fmt.Errorf("apps[%d]: bundle_id is required", i)
+		}
+
+		if bundleIDs[app.BundleID] {
+			return fmt.Errorf("apps[%d]: duplicated bundle_id: %s", i, app.BundleID)
+		}
+		bundleIDs[app.BundleID] = true
+
+		for _, env := range app.Environments {
+			if env != "Production" && env != "Sandbox" {
+				return fmt.Errorf("apps[%d]: unknown environment: %s", i, env)
+			}
+		}
+
+		for _, versions := range [][]string{app.ApplicationVersions, app.OriginalApplicationVersions} {
+			for _, v := range versions {
+				if _, err := receipt.ParseVersionRange(v); err != nil {
+					return fmt.Errorf("apps[%d]: %w", i, err)
+				}
+			}
+		}
+
+		if _, err := compileRules(app.Rules); err != nil {
+			return fmt.Errorf("apps[%d]: rules: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Verifier loads the trusted root certificates, and returns a verifier with
+// the settings of the apps
+func (c *Config) Verifier() (*receipt.Verifier, error) {
+	roots, err := loadCertificateFiles(c.TrustedRoots)
+	if err != nil {
+		return nil, err
+	}
+
+	crls, err := loadCRLFiles(c.CRLs)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := compileRules(c.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	cat, err := c.Catalog.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	v := &receipt.Verifier{
+		Roots:             roots,
+		Apps:              map[string]*receipt.App{},
+		AllowedBundleIDs:  c.AllowedBundleIDs,
+		RejectUnknownApps: c.RejectUnknownApps,
+		CRLs:              crls,
+		Rules:             rules,
+		Catalog:           cat,
+	}
+
+	for _, app := range c.Apps {
+		appRoots, err := loadCertificateFiles(app.TrustedRoots)
+		if err != nil {
+			return nil, err
+		}
+
+		appRules, err := compileRules(app.Rules)
+		if err != nil {
+			return nil, err
+		}
+
+		v.Apps[app.BundleID] = &receipt.App{
+			SharedSecret:                app.SharedSecret,
+			Environments:                app.Environments,
+			ApplicationVersions:         app.ApplicationVersions,
+			OriginalApplicationVersions: app.OriginalApplicationVersions,
+			Roots:                       appRoots,
+			Rules:                       appRules,
+		}
+	}
+
+	return v, nil
+}
+
+// Load loads the files of the catalog and adds the products. It returns nil
+// when the catalog is empty.
+func (c *Catalog) Load() (*catalog.Catalog, error) {
+	if len(c.Files) == 0 && len(c.Products) == 0 {
+		return nil, nil
+	}
+
+	cat := catalog.New()
+	for _, name := range c.Files {
+		loaded, err := catalog.Load(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range loaded.Products {
+			cat.Add(p)
+		}
+	}
+
+	products, err := c.products()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range products {
+		if p.Type == "" {
+			base := cat.Product(p.ID)
+			if base == nil {
+				return nil, fmt.Errorf("catalog: type of %s is required", p.ID)
+			}
+			p = extend(*base, p)
+		}
+		cat.Add(p)
+	}
+
+	return cat, nil
+}
+
+func (c *Catalog) products() ([]*catalog.Product, error) {
+	var products []*catalog.Product
+
+	for i, p := range c.Products {
+		if p.ID == "" {
+			return nil, fmt.Errorf("products[%d]: id is required", i)
+		}
+
+		var t catalog.Type
+		if p.Type != "" {
+			var err error
+			if t, err = catalog.ParseType(p.Type); err != nil {
+				return nil, fmt.Errorf("products[%d]: %w", i, err)
+			}
+		}
+
+		duration, err := catalog.ParseDuration(p.Duration)
+		if err != nil {
+			return nil, fmt.Errorf("products[%d]: %w", i, err)
+		}
+
+		products = append(products, &catalog.Product{
+			ID:                p.ID,
+			Type:              t,
+			Entitlements:      p.Entitlements,
+			SubscriptionGroup: p.SubscriptionGroup,
+			GroupLevel:        p.GroupLevel,
+			Duration:          duration,
+			GracePeriod:       p.GracePeriod,
+		})
+	}
+
+	return products, nil
+}
+
+// extend overrides a product with the settings of p
+func extend(base catalog.Product, p *catalog.Product) *catalog.Product {
+	if len(p.Entitlements) > 0 {
+		base.Entitlements = p.Entitlements
+	}
+	if p.SubscriptionGroup != "" {
+		base.SubscriptionGroup = p.SubscriptionGroup
+	}
+	if p.GroupLevel != 0 {
+		base.GroupLevel = p.GroupLevel
+	}
+	if p.Duration != 0 {
+		base.Duration = p.Duration
+	}
+	if p.GracePeriod != 0 {
+		base.GracePeriod = p.GracePeriod
+	}
+	return &base
+}
+
+func compileRules(rules []Rule) ([]*receipt.Rule, error) {
+	var compiled []*receipt.Rule
+	names := map[string]bool{}
+
+	for i, r := range rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("[%d]: name is required", i)
+		}
+
+		if names[r.Name] {
+			return nil, fmt.Errorf("[%d]: duplicated name: %s", i, r.Name)
+		}
+		names[r.Name] = true
+
+		severity := r.Severity
+		if severity == "" {
+			severity = receipt.SeverityReject
+		}
+
+		rule, err := receipt.NewRule(r.Name, r.Expr, severity, r.Message)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, rule)
+	}
+
+	return compiled, nil
+}
+
+// Flags returns the values of nolmandy-server flags which are set in the
+// configuration, by flag name
+func (s *Server) Flags() map[string]string {
+	flags := map[string]string{}
+
+	set := func(name, value string, ok bool) {
+		if ok {
+			flags[name] = value
+		}
+	}
+
+	set("port", strconv.Itoa(s.Port), s.Port != 0)
+	set("mode", s.Mode, s.Mode != "")
+	set("upstream", s.Upstream, s.Upstream != "")
+	if s.SandboxUpstream != nil {
+		flags["sandboxUpstream"] = *s.SandboxUpstream
+	}
+	if s.ValidateLocally != nil {
+		flags["validateLocally"] = strconv.FormatBool(*s.ValidateLocally)
+	}
+	set("shadowLog", s.ShadowLog, s.ShadowLog != "")
+	set("readTimeout", s.ReadTimeout.String(), s.ReadTimeout != 0)
+	set("writeTimeout", s.WriteTimeout.String(), s.WriteTimeout != 0)
+	set("idleTimeout", s.IdleTimeout.String(), s.IdleTimeout != 0)
+	set("maxBodySize", strconv.FormatInt(s.MaxBodySize, 10), s.MaxBodySize != 0)
+	set("tlsCert", s.TLSCert, s.TLSCert != "")
+	set("tlsKey", s.TLSKey, s.TLSKey != "")
+	set("clientCA", s.ClientCA, s.ClientCA != "")
+	set("logLevel", s.LogLevel, s.LogLevel != "")
+	set("logFormat", s.LogFormat, s.LogFormat != "")
+	set("traceExporter", s.TraceExporter, s.TraceExporter != "")
+	set("traceSampleRatio", strconv.FormatFloat(s.TraceSampleRatio, 'g', -1, 64), s.TraceSampleRatio != 0)
+	set("transactionStore", s.TransactionStore, s.TransactionStore != "")
+	set("reusePolicy", s.ReusePolicy, s.ReusePolicy != "")
+	set("ledger", s.Ledger, s.Ledger != "")
+	set("adminPort", strconv.Itoa(s.AdminPort), s.AdminPort != 0)
+	set("cacheSize", strconv.Itoa(s.CacheSize), s.CacheSize != 0)
+	set("cacheTTL", s.CacheTTL.String(), s.CacheTTL != 0)
+	set("batchWorkers", strconv.Itoa(s.BatchWorkers), s.BatchWorkers != 0)
+	set("maxBatchSize", strconv.FormatInt(s.MaxBatchSize, 10), s.MaxBatchSize != 0)
+	set("entitlements", "true", s.Entitlements)
+
+	return flags
+}
+
+func (c *Config) resolvePaths(dir string) {
+	resolve := func(path *string) {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+
+	resolve(&c.Server.ShadowLog)
+	resolve(&c.Server.TLSCert)
+	resolve(&c.Server.TLSKey)
+	resolve(&c.Server.ClientCA)
+	if c.Server.TransactionStore != "memory" {
+		resolve(&c.Server.TransactionStore)
+	}
+	if c.Server.Ledger != "memory" {
+		resolve(&c.Server.Ledger)
+	}
+
+	for i := range c.TrustedRoots {
+		resolve(&c.TrustedRoots[i])
+	}
+
+	for i := range c.CRLs {
+		resolve(&c.CRLs[i])
+	}
+
+	for i := range c.Catalog.Files {
+		resolve(&c.Catalog.Files[i])
+	}
+
+	for i := range c.Apps {
+		for j := range c.Apps[i].TrustedRoots {
+			resolve(&c.Apps[i].TrustedRoots[j])
+		}
+	}
+}
+
+// expandEnv replaces "${NAME}" with the environment variable NAME, which must
+// be set not to disable a check silently with an empty value
+func expandEnv(s string) (string, error) {
+	if strings.HasPrefix(s, "${") && strings.HasSuffix(s, "}") {
+		name := s[2 : len(s)-1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	}
+	return s, nil
+}
+
+// LoadCertificates loads all certificates in a PEM file
+func LoadCertificates(name string) ([]*x509.Certificate, error) {
+	certPEM, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var certDER *pem.Block
+		certDER, certPEM = pem.Decode(certPEM)
+		if certDER == nil {
+			break
+		}
+
+		cert, err := x509.ParseCertificate(certDER.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found in " + name)
+	}
+
+	return certs, nil
+}
+
+func loadCertificateFiles(names []string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, name := range names {
+		c, err := LoadCertificates(name)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c...)
+	}
+	return certs, nil
+}
+
+// LoadCRL loads a certificate revocation list in DER or PEM
+func LoadCRL(name string) (*x509.RevocationList, error) {
+	der, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(der); block != nil {
+		der = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return crl, nil
+}
+
+func loadCRLFiles(names []string) ([]*x509.RevocationList, error) {
+	var crls []*x509.RevocationList
+	for _, name := range names {
+		crl, err := LoadCRL(name)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	return crls, nil
+}
+
+// files returns the files which the configuration refers to for verification
+func (c *Config) files() []string {
+	files := append([]string{}, c.TrustedRoots...)
+	files = append(files, c.CRLs...)
+	files = append(files, c.Catalog.Files...)
+	for _, app := range c.Apps {
+		files = append(files, app.TrustedRoots...)
+	}
+	return files
+}
+
+// app returns the settings of an app, or nil
+func (c *Config) app(bundleID string) *App {
+	for i := range c.Apps {
+		if c.Apps[i].BundleID == bundleID {
+			return &c.Apps[i]
+		}
+	}
+	return nil
+}
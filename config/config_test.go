@@ -0,0 +1,124 @@
+package config
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	t.Setenv("NOLMANDY_TEST_SHARED_SECRET", "secret")
+
+	c, err := Load("testdata/nolmandy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Server.Port != 8080 || c.Server.ReadTimeout != 5*time.Second {
+		t.Fatalf("Wrong server settings: %+v", c.Server)
+	}
+
+	if c.TrustedRoots[0] != filepath.Join("testdata", "cert.pem") {
+		t.Fatalf("Wrong trusted_roots: %v", c.TrustedRoots)
+	}
+
+	if c.Apps[0].SharedSecret != "secret" {
+		t.Fatalf("Wrong shared_secret: %s", c.Apps[0].SharedSecret)
+	}
+
+	v, err := c.Verifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(v.Roots) != 1 || len(v.Apps) != 2 {
+		t.Fatalf("Wrong verifier: %+v", v)
+	}
+
+	if !v.RejectUnknownApps || len(v.AllowedBundleIDs) != 1 {
+		t.Fatalf("Wrong allowed bundle IDs: %v", v.AllowedBundleIDs)
+	}
+
+	if len(v.Catalog.Products) != 6 {
+		t.Fatalf("Wrong catalog: %v", v.Catalog.Products)
+	}
+
+	if p := v.Catalog.Product("com.example.monthly"); p.Type != "auto_renewable" || p.GroupLevel != 2 || p.Entitlements[0] != "premium" || p.GracePeriod != 72*time.Hour {
+		t.Fatalf("Wrong com.example.monthly: %+v", p)
+	}
+
+	if len(v.Rules) != 1 || v.Rules[0].Severity != "warn" {
+		t.Fatalf("Wrong rules: %+v", v.Rules)
+	}
+
+	if app := v.Apps["com.example.app"]; len(app.Rules) != 1 || app.Rules[0].Severity != "reject" {
+		t.Fatalf("Wrong rules of com.example.app: %+v", app.Rules)
+	}
+
+	if app := v.Apps["com.example.app"]; len(app.OriginalApplicationVersions) != 1 {
+		t.Fatalf("Wrong original application versions: %v", app.OriginalApplicationVersions)
+	}
+
+	if app := v.Apps["com.example.other"]; len(app.Roots) != 1 {
+		t.Fatalf("Wrong roots of com.example.other: %v", app.Roots)
+	}
+
+	flags := c.Server.Flags()
+	expected := map[string]string{
+		"port":             "8080",
+		"mode":             "verify",
+		"readTimeout":      "5s",
+		"validateLocally":  "false",
+		"sandboxUpstream":  "",
+		"reusePolicy":      "reject",
+		"transactionStore": filepath.Join("testdata", "transactions.jsonl"),
+	}
+
+	if len(flags) != len(expected) {
+		t.Fatalf("Wrong flags: %v", flags)
+	}
+
+	for name, value := range expected {
+		if v, ok := flags[name]; !ok || v != value {
+			t.Fatalf("Wrong %s flag: %q", name, v)
+		}
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	tests := []string{
+		"server:\n  mode: unknown\n",
+		"server:\n  reuse_policy: ignore\n",
+		"server:\n  unknown_field: 1\n",
+		"apps:\n  - shared_secret: secret\n",
+		"apps:\n  - bundle_id: com.example.app\n  - bundle_id: com.example.app\n",
+		"apps:\n  - bundle_id: com.example.app\n    environments: [Staging]\n",
+		"apps:\n  - bundle_id: com.example.app\n    application_versions: [\">=1.0, <\"]\n",
+		"allowed_bundle_ids: [\"com.example.[\"]\n",
+		"rules:\n  - name: invalid\n    expr: Receipt.Unknown\n",
+		"catalog:\n  products:\n    - id: com.example.coins\n      type: gift\n",
+		"catalog:\n  products:\n    - type: consumable\n",
+		"catalog:\n  products:\n    - id: com.example.monthly\n      duration: monthly\n",
+		"rules:\n  - expr: \"true\"\n",
+		"rules:\n  - name: warning\n    expr: \"true\"\n    severity: info\n",
+		"apps:\n  - bundle_id: com.example.app\n    rules:\n      - name: invalid\n        expr: len(InApp)\n",
+		"apps:\n  - bundle_id: com.example.app\n    shared_secret: ${NOLMANDY_TEST_UNSET_SHARED_SECRET}\n",
+	}
+
+	for _, test := range tests {
+		if _, err := Parse([]byte(test)); err == nil {
+			t.Fatalf("Config should be invalid:\n%s", test)
+		}
+	}
+}
+
+func TestMissingTrustedRoot(t *testing.T) {
+	c, err := Parse([]byte("trusted_roots: [missing.pem]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Verifier(); err == nil {
+		t.Fatal("Missing trusted root should be an error")
+	}
+}
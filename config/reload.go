@@ -0,0 +1,346 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aktsk/nolmandy/catalog"
+	"github.com/aktsk/nolmandy/receipt"
+)
+
+// Reloader verifies receipts with a verifier loaded from a configuration
+// file. It reloads the file, certificates and CRLs, and replaces the verifier
+// atomically, so that in-flight requests finish with the previous one.
+type Reloader struct {
+	name         string
+	trustedRoots []string
+
+	mu      sync.Mutex
+	current atomic.Pointer[snapshot]
+	cache   *receipt.Cache
+}
+
+// snapshot is a loaded configuration
+type snapshot struct {
+	config   *Config
+	verifier *receipt.Verifier
+	files    map[string]fileState
+	loadedAt time.Time
+}
+
+// fileState is used to detect file changes
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// Report is the result of a reload
+type Report struct {
+	// Changes describe what changed. They are empty when nothing changed.
+	Changes []string `json:"changes"`
+
+	// Error tells why the reload was rejected. The previous configuration
+	// is kept when Error is not empty.
+	Error string `json:"error,omitempty"`
+
+	// LoadedAt is when the current configuration was loaded
+	LoadedAt time.Time `json:"loaded_at"`
+}
+
+// NewReloader loads a configuration file. trustedRoots are PEM files of root
+// certificates trusted in addition to the trusted roots of the file. name
+// may be empty to use only trustedRoots.
+func NewReloader(name string, trustedRoots ...string) (*Reloader, error) {
+	r := &Reloader{name: name, trustedRoots: trustedRoots}
+
+	s, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.current.Store(s)
+
+	return r, nil
+}
+
+// Verify verifies receipt data with the current verifier
+func (r *Reloader) Verify(ctx context.Context, data string, password string) (receipt.Result, error) {
+	return r.current.Load().verifier.Verify(ctx, data, password)
+}
+
+// Certificates returns the trusted root certificates of the current verifier
+func (r *Reloader) Certificates() ([]*x509.Certificate, error) {
+	return r.current.Load().verifier.Certificates()
+}
+
+// Catalog returns the product catalog of the current verifier
+func (r *Reloader) Catalog() *catalog.Catalog {
+	return r.current.Load().verifier.Catalog
+}
+
+// SetCache sets the cache of verified receipts, which is shared by the
+// current verifier and the verifiers reloaded later
+func (r *Reloader) SetCache(cache *receipt.Cache) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cache = cache
+
+	s := *r.current.Load()
+	v := *s.verifier
+	v.Cache = cache
+	s.verifier = &v
+	r.current.Store(&s)
+}
+
+// Config returns the current configuration
+func (r *Reloader) Config() *Config {
+	return r.current.Load().config
+}
+
+// Reload loads the configuration file, certificates and CRLs again. When
+// they are invalid, the current configuration is kept and an error is
+// returned with the report.
+func (r *Reloader) Reload() (Report, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := r.current.Load()
+
+	s, err := r.load()
+	if err != nil {
+		return Report{Changes: []string{}, Error: err.Error(), LoadedAt: old.loadedAt}, err
+	}
+
+	r.current.Store(s)
+
+	return Report{Changes: changes(old, s), LoadedAt: s.loadedAt}, nil
+}
+
+// Watch reloads when the configuration file, certificates or CRLs change.
+// It checks them every interval until ctx is done. Files which are rejected
+// are not reloaded again until they change.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var rejected map[string]fileState
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		files := statFiles(r.current.Load().files)
+		if reflect.DeepEqual(files, r.current.Load().files) || reflect.DeepEqual(files, rejected) {
+			continue
+		}
+
+		rejected = nil
+		if err := r.logReload(ctx, "file change"); err != nil {
+			rejected = files
+		}
+	}
+}
+
+// ReloadOnSignal reloads whenever a value is received from signals, until
+// ctx is done
+func (r *Reloader) ReloadOnSignal(ctx context.Context, signals <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			r.logReload(ctx, sig.String())
+		}
+	}
+}
+
+func (r *Reloader) logReload(ctx context.Context, trigger string) error {
+	report, err := r.Reload()
+	if err != nil {
+		slog.ErrorContext(ctx, "reload is rejected", "trigger", trigger, "error", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "reloaded", "trigger", trigger, "changes", report.Changes)
+	return nil
+}
+
+// ServeHTTP reloads, and responds with the report. It responds with 422
+// when the reload is rejected.
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	report, err := r.Reload()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+func (r *Reloader) load() (*snapshot, error) {
+	c := &Config{}
+	files := map[string]fileState{}
+
+	if r.name != "" {
+		// Files are stated before they are loaded, so that changes while
+		// loading are detected by the next check
+		files[r.name] = stat(r.name)
+
+		var err error
+		c, err = Load(r.name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.TrustedRoots = append(append([]string{}, r.trustedRoots...), c.TrustedRoots...)
+
+	for _, name := range c.files() {
+		files[name] = stat(name)
+	}
+
+	v, err := c.Verifier()
+	if err != nil {
+		return nil, err
+	}
+	v.Cache = r.cache
+
+	return &snapshot{
+		config:   c,
+		verifier: v,
+		files:    files,
+		loadedAt: time.Now(),
+	}, nil
+}
+
+// statFiles returns the current states of files
+func statFiles(files map[string]fileState) map[string]fileState {
+	states := make(map[string]fileState, len(files))
+	for name := range files {
+		states[name] = stat(name)
+	}
+	return states
+}
+
+func stat(name string) fileState {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{modTime: info.ModTime(), size: info.Size()}
+}
+
+// changes describes the differences between two snapshots
+func changes(old, s *snapshot) []string {
+	changes := []string{}
+
+	if !reflect.DeepEqual(old.config.Server, s.config.Server) {
+		changes = append(changes, "server settings changed, which take effect on restart")
+	}
+
+	if !sameCertificates(old.verifier.Roots, s.verifier.Roots) {
+		changes = append(changes, "trusted roots changed")
+	}
+
+	if !sameCRLs(old.verifier.CRLs, s.verifier.CRLs) {
+		changes = append(changes, "CRLs changed")
+	}
+
+	if !reflect.DeepEqual(old.verifier.AllowedBundleIDs, s.verifier.AllowedBundleIDs) || old.verifier.RejectUnknownApps != s.verifier.RejectUnknownApps {
+		changes = append(changes, "allowed bundle IDs changed")
+	}
+
+	if !reflect.DeepEqual(old.verifier.Catalog, s.verifier.Catalog) {
+		changes = append(changes, "catalog changed")
+	}
+
+	if !reflect.DeepEqual(old.config.Rules, s.config.Rules) {
+		changes = append(changes, "rules changed")
+	}
+
+	var bundleIDs []string
+	for bundleID := range old.verifier.Apps {
+		bundleIDs = append(bundleIDs, bundleID)
+	}
+	for bundleID := range s.verifier.Apps {
+		if old.verifier.Apps[bundleID] == nil {
+			bundleIDs = append(bundleIDs, bundleID)
+		}
+	}
+	sort.Strings(bundleIDs)
+
+	for _, bundleID := range bundleIDs {
+		oldApp, app := old.verifier.Apps[bundleID], s.verifier.Apps[bundleID]
+
+		switch {
+		case oldApp == nil:
+			changes = append(changes, fmt.Sprintf("app %s added", bundleID))
+		case app == nil:
+			changes = append(changes, fmt.Sprintf("app %s removed", bundleID))
+		default:
+			if oldApp.SharedSecret != app.SharedSecret {
+				changes = append(changes, fmt.Sprintf("shared secret of %s changed", bundleID))
+			}
+			if !reflect.DeepEqual(oldApp.Environments, app.Environments) {
+				changes = append(changes, fmt.Sprintf("environments of %s changed", bundleID))
+			}
+			if !reflect.DeepEqual(oldApp.ApplicationVersions, app.ApplicationVersions) {
+				changes = append(changes, fmt.Sprintf("application versions of %s changed", bundleID))
+			}
+			if !reflect.DeepEqual(oldApp.OriginalApplicationVersions, app.OriginalApplicationVersions) {
+				changes = append(changes, fmt.Sprintf("original application versions of %s changed", bundleID))
+			}
+			if !reflect.DeepEqual(old.config.app(bundleID).Rules, s.config.app(bundleID).Rules) {
+				changes = append(changes, fmt.Sprintf("rules of %s changed", bundleID))
+			}
+			if !sameCertificates(oldApp.Roots, app.Roots) {
+				changes = append(changes, fmt.Sprintf("trusted roots of %s changed", bundleID))
+			}
+		}
+	}
+
+	return changes
+}
+
+func sameCertificates(a, b []*x509.Certificate) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sameCRLs(a, b []*x509.RevocationList) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !bytes.Equal(a[i].Raw, b[i].Raw) {
+			return false
+		}
+	}
+
+	return true
+}
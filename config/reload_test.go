@@ -0,0 +1,144 @@
+package config
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aktsk/nolmandy/internal/testutil"
+	"github.com/aktsk/nolmandy/receipt"
+)
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+
+	cert, data := testutil.SignedReceipt(t, testutil.Receipt())
+	otherCert, _ := testutil.Certificate(t)
+
+	writeFile(t, filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	writeFile(t, filepath.Join(dir, "other.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: otherCert.Raw}))
+
+	name := filepath.Join(dir, "nolmandy.yaml")
+	writeFile(t, name, []byte("trusted_roots: [cert.pem]\n"))
+
+	r, err := NewReloader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cached receipts are verified again with reloaded certificates
+	cache := receipt.NewCache(10, time.Hour)
+	r.SetCache(cache)
+
+	for i := 0; i < 2; i++ {
+		if result, _ := r.Verify(context.Background(), data, ""); result.Status != 0 {
+			t.Fatalf("Status should be 0, not %d", result.Status)
+		}
+	}
+
+	writeFile(t, name, []byte("trusted_roots: [other.pem]\napps:\n  - bundle_id: com.example.app\n"))
+
+	report, err := r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(report.Changes, ", ") != "trusted roots changed, app com.example.app added" {
+		t.Fatalf("Wrong changes: %v", report.Changes)
+	}
+
+	if result, _ := r.Verify(context.Background(), data, ""); result.Status != 21002 {
+		t.Fatalf("Status should be 21002, not %d", result.Status)
+	}
+
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 2 {
+		t.Fatalf("Wrong cache stats: %+v", stats)
+	}
+
+	// An invalid configuration is rejected, and the current one is kept
+	writeFile(t, name, []byte("trusted_roots: [missing.pem]\n"))
+
+	report, err = r.Reload()
+	if err == nil || report.Error == "" {
+		t.Fatalf("Reload should be rejected: %+v", report)
+	}
+
+	if len(r.Config().Apps) != 1 {
+		t.Fatalf("Configuration should be kept: %+v", r.Config())
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+
+	cert, data := testutil.SignedReceipt(t, testutil.Receipt())
+	otherCert, _ := testutil.Certificate(t)
+
+	certFileName := filepath.Join(dir, "cert.pem")
+	writeFile(t, certFileName, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: otherCert.Raw}))
+
+	r, err := NewReloader("", certFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	// The certificate is rotated
+	writeFile(t, certFileName, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	os.Chtimes(certFileName, time.Now().Add(time.Second), time.Now().Add(time.Second))
+
+	for i := 0; i < 500; i++ {
+		if result, _ := r.Verify(context.Background(), data, ""); result.Status == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("Certificate is not reloaded")
+}
+
+func TestReloadHandler(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "nolmandy.yaml")
+	writeFile(t, name, []byte("apps:\n  - bundle_id: com.example.app\n"))
+
+	r, err := NewReloader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, name, []byte("apps:\n  - bundle_id: com.example.app\n    shared_secret: secret\n"))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "shared secret of com.example.app changed") {
+		t.Fatalf("Wrong response: %d %s", w.Code, w.Body)
+	}
+
+	writeFile(t, name, []byte("apps: [\n"))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), `"error"`) {
+		t.Fatalf("Wrong response: %d %s", w.Code, w.Body)
+	}
+}
+
+func writeFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,231 @@
+// Package entitlements computes what a user is entitled to from receipts and
+// a product catalog, so that clients don't have to interpret in-app purchase
+// receipts by themselves.
+package entitlements
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aktsk/nolmandy/catalog"
+	"github.com/aktsk/nolmandy/receipt"
+	"github.com/guregu/null/v5"
+)
+
+// State is the state of an entitlement
+type State string
+
+// States of entitlements. Entitlements are active in StateActive and
+// StateGracePeriod.
+const (
+	StateActive       State = "active"
+	StateGracePeriod  State = "grace_period"
+	StateBillingRetry State = "billing_retry"
+	StateExpired      State = "expired"
+	StateRevoked      State = "revoked"
+)
+
+// rank orders states from the most preferred
+var rank = map[State]int{
+	StateActive:       0,
+	StateGracePeriod:  1,
+	StateBillingRetry: 2,
+	StateExpired:      3,
+	StateRevoked:      4,
+}
+
+// Entitlement is an entitlement with the transaction which grants it
+type Entitlement struct {
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+	State  State  `json:"state"`
+
+	ProductID             string       `json:"product_id"`
+	ProductType           catalog.Type `json:"product_type"`
+	TransactionID         string       `json:"transaction_id"`
+	OriginalTransactionID string       `json:"original_transaction_id"`
+
+	PurchaseDate           time.Time  `json:"purchase_date"`
+	ExpiresDate            *time.Time `json:"expires_date,omitempty"`
+	GracePeriodExpiresDate *time.Time `json:"grace_period_expires_date,omitempty"`
+	RevocationDate         *time.Time `json:"revocation_date,omitempty"`
+	RevocationReason       string     `json:"revocation_reason,omitempty"`
+}
+
+// FromReceipt computes entitlements at a given time from the in-app
+// purchases of a receipt
+func FromReceipt(c *catalog.Catalog, rcpt *receipt.Receipt, at time.Time) []Entitlement {
+	var inApp []receipt.InApp
+	if rcpt != nil {
+		for _, i := range rcpt.InApp {
+			inApp = append(inApp, *i)
+		}
+	}
+
+	return Compute(c, inApp, nil, at)
+}
+
+// FromResult computes entitlements at a given time from a verifyReceipt
+// result. The latest receipt info and the in-app purchases of the receipt are
+// merged, and the pending renewal info is used for grace periods and billing
+// retry.
+func FromResult(c *catalog.Catalog, result receipt.Result, at time.Time) []Entitlement {
+	inApp := append([]receipt.InApp{}, result.LatestReceiptInfo...)
+	if result.Receipt != nil {
+		for _, i := range result.Receipt.InApp {
+			inApp = append(inApp, *i)
+		}
+	}
+
+	return Compute(c, inApp, result.PendingRenewalInfo, at)
+}
+
+// Compute computes entitlements at a given time from in-app purchases and
+// pending renewal info. Purchases of products which are not in the catalog,
+// and consumables, are ignored, and only the first of the same transaction ID
+// is used. An entitlement is returned for each name, with the transaction in
+// the most preferred state, and sorted by name.
+func Compute(c *catalog.Catalog, inApp []receipt.InApp, renewals []receipt.PendingRenewalInfo, at time.Time) []Entitlement {
+	renewalInfo := map[string]receipt.PendingRenewalInfo{}
+	for _, r := range renewals {
+		renewalInfo[r.OriginalTransactionID] = r
+	}
+
+	// Only the latest transactions of subscriptions may be in grace periods
+	// or in billing retry
+	latest := map[string]time.Time{}
+	for _, i := range inApp {
+		if expires := null.Time(i.ExpiresDate.Date).Time; expires.After(latest[i.OriginalTransactionID]) {
+			latest[i.OriginalTransactionID] = expires
+		}
+	}
+
+	best := map[string]Entitlement{}
+	seen := map[string]bool{}
+
+	for _, i := range inApp {
+		if i.TransactionID != "" {
+			if seen[i.TransactionID] {
+				continue
+			}
+			seen[i.TransactionID] = true
+		}
+
+		p := c.Product(i.ProductID)
+		if p == nil || p.Type == catalog.Consumable {
+			continue
+		}
+
+		var renewal *receipt.PendingRenewalInfo
+		if r, ok := renewalInfo[i.OriginalTransactionID]; ok {
+			renewal = &r
+		}
+		isLatest := !null.Time(i.ExpiresDate.Date).Time.Before(latest[i.OriginalTransactionID])
+
+		e := entitlement(p, i, renewal, isLatest, at)
+		if e.PurchaseDate.After(at) {
+			continue
+		}
+
+		for _, name := range p.EntitlementNames() {
+			e.Name = name
+			if current, ok := best[name]; !ok || preferred(e, current) {
+				best[name] = e
+			}
+		}
+	}
+
+	entitlements := make([]Entitlement, 0, len(best))
+	for _, e := range best {
+		entitlements = append(entitlements, e)
+	}
+	sort.Slice(entitlements, func(i, j int) bool {
+		return entitlements[i].Name < entitlements[j].Name
+	})
+
+	return entitlements
+}
+
+// entitlement returns the entitlement which a transaction grants. renewal is
+// the pending renewal info of the subscription, or nil.
+func entitlement(p *catalog.Product, i receipt.InApp, renewal *receipt.PendingRenewalInfo, isLatest bool, at time.Time) Entitlement {
+	e := Entitlement{
+		ProductID:             i.ProductID,
+		ProductType:           p.Type,
+		TransactionID:         i.TransactionID,
+		OriginalTransactionID: i.OriginalTransactionID,
+		PurchaseDate:          null.Time(i.PurchaseDate.Date).Time,
+		State:                 StateActive,
+	}
+
+	switch p.Type {
+	case catalog.AutoRenewable:
+		if expires := null.Time(i.ExpiresDate.Date); expires.Valid {
+			e.ExpiresDate = &expires.Time
+		}
+	case catalog.NonRenewing:
+		if p.Duration > 0 {
+			expires := e.PurchaseDate.Add(p.Duration)
+			e.ExpiresDate = &expires
+		}
+	}
+
+	if cancellation := null.Time(i.CancellationDate.Date); cancellation.Valid && !cancellation.Time.After(at) {
+		e.State = StateRevoked
+		e.RevocationDate = &cancellation.Time
+		e.RevocationReason = i.CancellationReason
+	} else if i.IsUpgraded {
+		// Upgraded subscriptions are replaced by the transactions of the
+		// products they are upgraded to
+		e.State = StateExpired
+	} else if e.ExpiresDate != nil && !e.ExpiresDate.After(at) {
+		e.State = StateExpired
+		if p.Type == catalog.AutoRenewable && isLatest {
+			e.State, e.GracePeriodExpiresDate = retryState(p, *e.ExpiresDate, renewal, at)
+		}
+	}
+
+	e.Active = e.State == StateActive || e.State == StateGracePeriod
+
+	return e
+}
+
+// retryState returns the state of an expired auto-renewable subscription,
+// which may be in a grace period or in billing retry
+func retryState(p *catalog.Product, expires time.Time, r *receipt.PendingRenewalInfo, at time.Time) (State, *time.Time) {
+	if r == nil {
+		if grace := expires.Add(p.GracePeriod); p.GracePeriod > 0 && grace.After(at) {
+			return StateGracePeriod, &grace
+		}
+		return StateExpired, nil
+	}
+
+	if grace := null.Time(r.GracePeriodExpiresDate.Date); grace.Valid && grace.Time.After(at) {
+		return StateGracePeriod, &grace.Time
+	}
+
+	if r.IsInBillingRetryPeriod == "1" {
+		return StateBillingRetry, nil
+	}
+
+	return StateExpired, nil
+}
+
+// preferred returns true when e is preferred to current. Entitlements in
+// better states are preferred, and then those which expire later.
+func preferred(e, current Entitlement) bool {
+	if rank[e.State] != rank[current.State] {
+		return rank[e.State] < rank[current.State]
+	}
+
+	switch {
+	case e.ExpiresDate == nil && current.ExpiresDate == nil:
+		return e.PurchaseDate.After(current.PurchaseDate)
+	case e.ExpiresDate == nil:
+		return true
+	case current.ExpiresDate == nil:
+		return false
+	default:
+		return e.ExpiresDate.After(*current.ExpiresDate)
+	}
+}
@@ -0,0 +1,139 @@
+package entitlements
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aktsk/nolmandy/catalog"
+	"github.com/aktsk/nolmandy/receipt"
+)
+
+const result = `{
+  "status": 0,
+  "receipt": {
+    "bundle_id": "com.example.app",
+    "in_app": [
+      {"product_id": "coins", "transaction_id": "1", "original_transaction_id": "1", "purchase_date": "2024-01-01 00:00:00 Etc/GMT"},
+      {"product_id": "no_ads", "transaction_id": "2", "original_transaction_id": "2", "purchase_date": "2024-01-02 00:00:00 Etc/GMT"},
+      {"product_id": "level_pack", "transaction_id": "3", "original_transaction_id": "3", "purchase_date": "2024-01-03 00:00:00 Etc/GMT",
+       "cancellation_date": "2024-02-01 00:00:00 Etc/GMT", "cancellation_reason": "0"},
+      {"product_id": "season_pass", "transaction_id": "4", "original_transaction_id": "4", "purchase_date": "2024-05-20 00:00:00 Etc/GMT"}
+    ]
+  },
+  "latest_receipt_info": [
+    {"product_id": "monthly", "transaction_id": "10", "original_transaction_id": "10", "purchase_date": "2024-04-01 00:00:00 Etc/GMT",
+     "expires_date": "2024-05-01 00:00:00 Etc/GMT", "web_order_line_item_id": "100"},
+    {"product_id": "monthly", "transaction_id": "11", "original_transaction_id": "10", "purchase_date": "2024-05-01 00:00:00 Etc/GMT",
+     "expires_date": "2024-06-01 00:00:00 Etc/GMT", "web_order_line_item_id": "101"},
+    {"product_id": "yearly", "transaction_id": "20", "original_transaction_id": "20", "purchase_date": "2023-06-03 00:00:00 Etc/GMT",
+     "expires_date": "2024-06-03 00:00:00 Etc/GMT", "web_order_line_item_id": "200"}
+  ],
+  "pending_renewal_info": [
+    {"product_id": "monthly", "original_transaction_id": "10", "auto_renew_status": "1",
+     "is_in_billing_retry_period": "1", "grace_period_expires_date": "2024-06-08 00:00:00 Etc/GMT"},
+    {"product_id": "yearly", "original_transaction_id": "20", "auto_renew_status": "1", "is_in_billing_retry_period": "1"}
+  ]
+}`
+
+func testCatalog() *catalog.Catalog {
+	return catalog.New(
+		&catalog.Product{ID: "coins", Type: catalog.Consumable},
+		&catalog.Product{ID: "no_ads", Type: catalog.NonConsumable},
+		&catalog.Product{ID: "level_pack", Type: catalog.NonConsumable},
+		&catalog.Product{ID: "season_pass", Type: catalog.NonRenewing, Duration: 30 * 24 * time.Hour},
+		&catalog.Product{ID: "monthly", Type: catalog.AutoRenewable, Entitlements: []string{"premium"}},
+		&catalog.Product{ID: "yearly", Type: catalog.AutoRenewable, Entitlements: []string{"premium", "yearly_bonus"}},
+	)
+}
+
+func TestFromResult(t *testing.T) {
+	var r receipt.Result
+	if err := json.Unmarshal([]byte(result), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		at       string
+		expected map[string]State
+	}{
+		{"2024-05-15T00:00:00Z", map[string]State{
+			"level_pack":   StateRevoked,
+			"no_ads":       StateActive,
+			"premium":      StateActive,
+			"yearly_bonus": StateActive,
+		}},
+		{"2024-06-05T00:00:00Z", map[string]State{
+			"level_pack":   StateRevoked,
+			"no_ads":       StateActive,
+			"premium":      StateGracePeriod,
+			"season_pass":  StateActive,
+			"yearly_bonus": StateBillingRetry,
+		}},
+		{"2024-07-01T00:00:00Z", map[string]State{
+			"level_pack":   StateRevoked,
+			"no_ads":       StateActive,
+			"premium":      StateBillingRetry,
+			"season_pass":  StateExpired,
+			"yearly_bonus": StateBillingRetry,
+		}},
+	}
+
+	for _, test := range tests {
+		at, err := time.Parse(time.RFC3339, test.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entitlements := FromResult(testCatalog(), r, at)
+		if len(entitlements) != len(test.expected) {
+			t.Fatalf("Wrong entitlements at %s: %+v", test.at, entitlements)
+		}
+
+		for _, e := range entitlements {
+			if e.State != test.expected[e.Name] {
+				t.Fatalf("Wrong state of %s at %s: %s", e.Name, test.at, e.State)
+			}
+
+			if e.Active != (e.State == StateActive || e.State == StateGracePeriod) {
+				t.Fatalf("Wrong active of %s at %s: %v", e.Name, test.at, e.Active)
+			}
+		}
+
+		if test.at != "2024-06-05T00:00:00Z" {
+			if premium := entitlements[2]; premium.TransactionID != "20" {
+				t.Fatalf("premium should be granted by the subscription which expires later: %+v", premium)
+			}
+		}
+	}
+}
+
+func TestFromReceiptGracePeriod(t *testing.T) {
+	var r receipt.Result
+	if err := json.Unmarshal([]byte(result), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	c := testCatalog()
+	c.Products["monthly"].GracePeriod = 3 * 24 * time.Hour
+
+	rcpt := &receipt.Receipt{}
+	for i := range r.LatestReceiptInfo[:2] {
+		rcpt.InApp = append(rcpt.InApp, &r.LatestReceiptInfo[i])
+	}
+
+	at := time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC)
+	entitlements := FromReceipt(c, rcpt, at)
+	if len(entitlements) != 1 || entitlements[0].State != StateGracePeriod {
+		t.Fatalf("Wrong entitlements: %+v", entitlements)
+	}
+
+	if grace := entitlements[0].GracePeriodExpiresDate; grace == nil || !grace.Equal(time.Date(2024, 6, 4, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Wrong grace period: %v", grace)
+	}
+
+	entitlements = FromReceipt(c, rcpt, at.Add(3*24*time.Hour))
+	if len(entitlements) != 1 || entitlements[0].State != StateExpired {
+		t.Fatalf("Wrong entitlements: %+v", entitlements)
+	}
+}
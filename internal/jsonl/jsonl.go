@@ -0,0 +1,167 @@
+// Package jsonl appends values to files in JSON lines, which are loaded again
+// when the files are opened
+package jsonl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// File is a file of values in JSON lines
+type File[T any] struct {
+	name string
+	f    *os.File
+	n    int
+}
+
+// Open opens a file, creating it if it does not exist, and calls fn with
+// each value in it. A partially written last line, by a crash for example,
+// is ignored and dropped, so that values are appended to complete lines.
+func Open[T any](name string, fn func(T)) (*File[T], error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	size, n, err := load(f, fn)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &File[T]{name: name, f: f, n: n}, nil
+}
+
+// load calls fn with each value, and returns the size of the complete lines
+// and the number of values
+func load[T any](r io.Reader, fn func(T)) (int64, int, error) {
+	reader := bufio.NewReader(r)
+	var size int64
+	n := 0
+
+	for line := 1; ; line++ {
+		b, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// The last line without a newline is partially written
+			return size, n, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if len(bytes.TrimSpace(b)) > 0 {
+			var v T
+			if err := json.Unmarshal(b, &v); err != nil {
+				return 0, 0, fmt.Errorf("line %d: %w", line, err)
+			}
+			fn(v)
+			n++
+		}
+
+		size += int64(len(b))
+	}
+}
+
+// Append appends values to the file, and syncs it. Values are not appended
+// partially when they can not be written.
+func (f *File[T]) Append(values []T) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	b, err := encode(values)
+	if err != nil {
+		return err
+	}
+
+	offset, err := f.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.f.Write(b); err != nil {
+		// Drop a partially written line
+		f.f.Truncate(offset)
+		f.f.Seek(offset, io.SeekStart)
+		return err
+	}
+
+	if err := f.f.Sync(); err != nil {
+		return err
+	}
+
+	f.n += len(values)
+	return nil
+}
+
+// Rewrite replaces the values in the file, to compact it for example. The
+// values are written to a temporary file, which is renamed to the file, so
+// that the file is not lost by a crash while it is rewritten.
+func (f *File[T]) Rewrite(values []T) error {
+	b, err := encode(values)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.name), filepath.Base(f.name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.name); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	f.f.Close()
+	f.f = tmp
+	f.n = len(values)
+	return nil
+}
+
+// Len returns the number of values in the file
+func (f *File[T]) Len() int {
+	return f.n
+}
+
+func encode[T any](values []T) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, v := range values {
+		if err := encoder.Encode(v); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Close closes the file
+func (f *File[T]) Close() error {
+	return f.f.Close()
+}
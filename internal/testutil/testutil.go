@@ -0,0 +1,71 @@
+// Package testutil provides receipts signed by test certificates for tests
+package testutil
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/aktsk/nolmandy/receipt"
+)
+
+// Certificate returns a self-signed certificate and its private key
+func Certificate(t testing.TB) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"Acme Co"}, CommonName: "Test Signer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+// SignedReceipt returns base 64 encoded receipt data of rcpt signed by a
+// self-signed certificate, and the certificate
+func SignedReceipt(t testing.TB, rcpt *receipt.Receipt) (*x509.Certificate, string) {
+	t.Helper()
+
+	cert, key := Certificate(t)
+
+	data, err := rcpt.Sign(cert, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, data
+}
+
+// Receipt returns a receipt for com.example.app
+func Receipt() *receipt.Receipt {
+	return &receipt.Receipt{
+		ReceiptType:                "ProductionSandbox",
+		BundleID:                   "com.example.app",
+		ApplicationVersion:         "1",
+		OriginalApplicationVersion: "1",
+	}
+}
@@ -0,0 +1,73 @@
+package ledger
+
+import (
+	"context"
+	"time"
+
+	"github.com/aktsk/nolmandy/internal/jsonl"
+)
+
+// File is a Ledger in a file. Entries are appended to the file in JSON lines
+// whenever they are recorded or granted, the last line of a transaction wins,
+// and all of them are kept in memory.
+type File struct {
+	*Memory
+
+	f *jsonl.File[Entry]
+}
+
+// OpenFile opens a file as a Ledger, creating it if it does not exist. A
+// partially written last line, by a crash for example, is ignored.
+func OpenFile(name string) (*File, error) {
+	m := NewMemory()
+
+	f, err := jsonl.Open(name, m.put)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{Memory: m, f: f}, nil
+}
+
+// Record records entries which are not recorded yet, and writes them to the
+// file before they are recorded in memory
+func (l *File) Record(ctx context.Context, entries []Entry) ([]Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	added := l.added(entries)
+	if err := l.f.Append(added); err != nil {
+		return nil, err
+	}
+
+	for _, e := range added {
+		l.put(e)
+	}
+
+	return added, nil
+}
+
+// Grant marks a transaction as granted, and writes it to the file before it
+// is granted in memory
+func (l *File) Grant(ctx context.Context, transactionID string, at time.Time) (Entry, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, granted, err := l.grant(transactionID, at)
+	if !granted {
+		return e, false, err
+	}
+
+	if err := l.f.Append([]Entry{e}); err != nil {
+		return Entry{}, false, err
+	}
+
+	l.put(e)
+
+	return e, true, nil
+}
+
+// Close closes the file
+func (l *File) Close() error {
+	return l.f.Close()
+}
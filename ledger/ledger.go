@@ -0,0 +1,196 @@
+// Package ledger keeps consumable purchases, which Apple removes from later
+// receipts once they are finished, and grants each of them once.
+package ledger
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aktsk/nolmandy/catalog"
+	"github.com/aktsk/nolmandy/receipt"
+	"github.com/guregu/null/v5"
+)
+
+// ErrNotFound is returned when a transaction is not in a ledger
+var ErrNotFound = errors.New("transaction not found")
+
+// Entry is a consumable purchase of a user
+type Entry struct {
+	TransactionID string    `json:"transaction_id"`
+	ProductID     string    `json:"product_id"`
+	BundleID      string    `json:"bundle_id,omitempty"`
+	UserID        string    `json:"user_id"`
+	Quantity      int64     `json:"quantity"`
+	PurchaseDate  time.Time `json:"purchase_date"`
+	RecordedAt    time.Time `json:"recorded_at"`
+
+	// GrantedAt is when the purchase was granted by Grant
+	GrantedAt *time.Time `json:"granted_at,omitempty"`
+}
+
+// Ledger records consumable purchases the first time they appear
+type Ledger interface {
+	// Record records entries which are not recorded yet, and returns them.
+	// Entries keep the users they are first recorded for.
+	Record(ctx context.Context, entries []Entry) ([]Entry, error)
+
+	// History returns the entries of a user by purchase date
+	History(ctx context.Context, userID string) ([]Entry, error)
+
+	// Grant marks a transaction as granted at a time, and returns its
+	// entry. It returns false when the transaction is already granted, and
+	// ErrNotFound when it is not recorded.
+	Grant(ctx context.Context, transactionID string, at time.Time) (Entry, bool, error)
+
+	Close() error
+}
+
+// Entries returns the consumable purchases of a result for a user. Products
+// are consumables by the catalog, and nothing is returned without a catalog.
+func Entries(c *catalog.Catalog, result receipt.Result, userID string, now time.Time) []Entry {
+	if result.Receipt == nil {
+		return nil
+	}
+
+	var entries []Entry
+	seen := map[string]bool{}
+
+	for _, i := range result.Receipt.InApp {
+		product := c.Product(i.ProductID)
+		if product == nil || product.Type != catalog.Consumable || i.TransactionID == "" || seen[i.TransactionID] {
+			continue
+		}
+		seen[i.TransactionID] = true
+
+		quantity := i.Quantity
+		if quantity == 0 {
+			quantity = 1
+		}
+
+		entries = append(entries, Entry{
+			TransactionID: i.TransactionID,
+			ProductID:     i.ProductID,
+			BundleID:      result.Receipt.BundleID,
+			UserID:        userID,
+			Quantity:      quantity,
+			PurchaseDate:  null.Time(i.PurchaseDate.Date).Time,
+			RecordedAt:    now,
+		})
+	}
+
+	return entries
+}
+
+// Totals returns the total quantities of entries by product ID
+func Totals(entries []Entry) map[string]int64 {
+	totals := map[string]int64{}
+	for _, e := range entries {
+		totals[e.ProductID] += e.Quantity
+	}
+	return totals
+}
+
+// Memory is a Ledger in memory
+type Memory struct {
+	mu      sync.RWMutex
+	entries map[string]Entry
+	users   map[string][]string
+}
+
+// NewMemory returns an empty Ledger in memory
+func NewMemory() *Memory {
+	return &Memory{
+		entries: map[string]Entry{},
+		users:   map[string][]string{},
+	}
+}
+
+// Record records entries which are not recorded yet
+func (m *Memory) Record(ctx context.Context, entries []Entry) ([]Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	added := m.added(entries)
+	for _, e := range added {
+		m.put(e)
+	}
+
+	return added, nil
+}
+
+// History returns the entries of a user by purchase date
+func (m *Memory) History(ctx context.Context, userID string) ([]Entry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries := []Entry{}
+	for _, id := range m.users[userID] {
+		entries = append(entries, m.entries[id])
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].PurchaseDate.Before(entries[j].PurchaseDate)
+	})
+
+	return entries, nil
+}
+
+// Grant marks a transaction as granted
+func (m *Memory) Grant(ctx context.Context, transactionID string, at time.Time) (Entry, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, granted, err := m.grant(transactionID, at)
+	if granted {
+		m.put(e)
+	}
+
+	return e, granted, err
+}
+
+// Close does nothing
+func (m *Memory) Close() error {
+	return nil
+}
+
+// added returns the entries which are not recorded yet
+func (m *Memory) added(entries []Entry) []Entry {
+	var added []Entry
+	seen := map[string]bool{}
+
+	for _, e := range entries {
+		if _, ok := m.entries[e.TransactionID]; ok || seen[e.TransactionID] {
+			continue
+		}
+		seen[e.TransactionID] = true
+		added = append(added, e)
+	}
+
+	return added
+}
+
+// grant returns the granted entry of a transaction without putting it, and
+// false when it is already granted
+func (m *Memory) grant(transactionID string, at time.Time) (Entry, bool, error) {
+	e, ok := m.entries[transactionID]
+	if !ok {
+		return Entry{}, false, ErrNotFound
+	}
+	if e.GrantedAt != nil {
+		return e, false, nil
+	}
+
+	e.GrantedAt = &at
+	return e, true, nil
+}
+
+// put adds or replaces an entry
+func (m *Memory) put(e Entry) {
+	if _, ok := m.entries[e.TransactionID]; !ok {
+		m.users[e.UserID] = append(m.users[e.UserID], e.TransactionID)
+	}
+	m.entries[e.TransactionID] = e
+}
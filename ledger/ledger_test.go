@@ -0,0 +1,141 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aktsk/nolmandy/catalog"
+	"github.com/aktsk/nolmandy/receipt"
+)
+
+const result = `{
+  "status": 0,
+  "receipt": {
+    "bundle_id": "com.example.app",
+    "in_app": [
+      {"product_id": "coins", "transaction_id": "1", "quantity": "2", "purchase_date": "2024-01-02 00:00:00 Etc/GMT"},
+      {"product_id": "no_ads", "transaction_id": "2", "quantity": "1", "purchase_date": "2024-01-01 00:00:00 Etc/GMT"},
+      {"product_id": "coins", "transaction_id": "3", "quantity": "1", "purchase_date": "2024-01-01 00:00:00 Etc/GMT"}
+    ]
+  }
+}`
+
+func TestEntries(t *testing.T) {
+	var r receipt.Result
+	if err := json.Unmarshal([]byte(result), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	c := catalog.New(
+		&catalog.Product{ID: "coins", Type: catalog.Consumable},
+		&catalog.Product{ID: "no_ads", Type: catalog.NonConsumable},
+	)
+
+	entries := Entries(c, r, "alice", time.Now())
+	if len(entries) != 2 || entries[0].TransactionID != "1" || entries[0].Quantity != 2 || entries[0].BundleID != "com.example.app" {
+		t.Fatalf("Wrong entries: %+v", entries)
+	}
+
+	if totals := Totals(entries); totals["coins"] != 3 || len(totals) != 1 {
+		t.Fatalf("Wrong totals: %v", totals)
+	}
+
+	if entries := Entries(nil, r, "alice", time.Now()); len(entries) != 0 {
+		t.Fatalf("Nothing should be consumables without a catalog: %+v", entries)
+	}
+}
+
+func testLedger(t *testing.T, l Ledger) {
+	ctx := context.Background()
+	purchased := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	entries := []Entry{
+		{TransactionID: "1", ProductID: "coins", UserID: "alice", Quantity: 2, PurchaseDate: purchased.Add(time.Hour)},
+		{TransactionID: "2", ProductID: "coins", UserID: "alice", Quantity: 1, PurchaseDate: purchased},
+	}
+
+	if added, err := l.Record(ctx, entries); err != nil || len(added) != 2 {
+		t.Fatalf("Wrong added entries: %+v, %v", added, err)
+	}
+
+	// Entries keep the users they are first recorded for
+	entries = append(entries, Entry{TransactionID: "3", ProductID: "coins", UserID: "bob", Quantity: 1})
+	entries[0].UserID = "bob"
+	if added, err := l.Record(ctx, entries); err != nil || len(added) != 1 || added[0].TransactionID != "3" {
+		t.Fatalf("Wrong added entries: %+v, %v", added, err)
+	}
+
+	history, err := l.History(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].TransactionID != "2" {
+		t.Fatalf("Wrong history: %+v", history)
+	}
+
+	if history, _ := l.History(ctx, "carol"); history == nil || len(history) != 0 {
+		t.Fatalf("History of an unknown user should be empty: %+v", history)
+	}
+
+	e, granted, err := l.Grant(ctx, "1", purchased)
+	if err != nil || !granted || e.GrantedAt == nil || !e.GrantedAt.Equal(purchased) {
+		t.Fatalf("Wrong grant: %+v, %v, %v", e, granted, err)
+	}
+
+	e, granted, err = l.Grant(ctx, "1", time.Now())
+	if err != nil || granted || !e.GrantedAt.Equal(purchased) {
+		t.Fatalf("Transaction should be granted once: %+v, %v, %v", e, granted, err)
+	}
+
+	if _, _, err := l.Grant(ctx, "9", time.Now()); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Wrong error of an unknown transaction: %v", err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testLedger(t, NewMemory())
+}
+
+func TestFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "ledger.jsonl")
+
+	l, err := OpenFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testLedger(t, l)
+	l.Close()
+
+	// A partially written line is dropped on reopen
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"transaction_id":"2","granted_at":`)
+	f.Close()
+
+	l, err = OpenFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx := context.Background()
+
+	if _, granted, err := l.Grant(ctx, "1", time.Now()); err != nil || granted {
+		t.Fatalf("Grants should be kept after reopen: %v, %v", granted, err)
+	}
+
+	if _, granted, err := l.Grant(ctx, "2", time.Now()); err != nil || !granted {
+		t.Fatalf("Wrong grant after reopen: %v, %v", granted, err)
+	}
+
+	if history, _ := l.History(ctx, "alice"); len(history) != 2 || history[0].GrantedAt == nil {
+		t.Fatalf("Wrong history after reopen: %+v", history)
+	}
+}
@@ -0,0 +1,195 @@
+// Package logging builds structured loggers shared by nolmandy commands and
+// servers. Loggers redact sensitive attributes such as receipt data, and add
+// request IDs from contexts.
+package logging
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// DefaultRedactedKeys are the attribute keys which are redacted by default
+var DefaultRedactedKeys = []string{
+	"receipt_data",
+	"password",
+	"transaction_id",
+	"original_transaction_id",
+}
+
+// Options configures a logger
+type Options struct {
+	// Level is the minimum level to log
+	Level slog.Level
+
+	// Format is "text" or "json". "text" is used when Format is empty.
+	Format string
+
+	// RedactedKeys are attribute keys whose values are redacted.
+	// DefaultRedactedKeys are used when RedactedKeys is nil.
+	RedactedKeys []string
+
+	// RedactionSalt makes redacted values pseudonyms derived with
+	// HMAC-SHA256, so that log lines of the same value can be correlated.
+	// Redacted values are replaced with "[REDACTED]" when RedactionSalt is
+	// empty.
+	RedactionSalt []byte
+}
+
+// RegisterFlags defines -logLevel, -logFormat, -logRedactedKeys and
+// -logRedactionSalt flags which set o
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.TextVar(&o.Level, "logLevel", o.Level, "Log level (debug, info, warn or error)")
+	fs.StringVar(&o.Format, "logFormat", o.Format, "Log format (text or json)")
+	fs.Func("logRedactedKeys", "Comma separated log attribute keys to redact (default "+strings.Join(DefaultRedactedKeys, ",")+")", func(s string) error {
+		o.RedactedKeys = ParseKeys(s)
+		return nil
+	})
+	fs.Func("logRedactionSalt", "Salt to log redacted values as pseudonyms instead of [REDACTED]", func(s string) error {
+		o.RedactionSalt = []byte(s)
+		return nil
+	})
+}
+
+// New returns a logger which writes to w
+func New(w io.Writer, opts Options) (*slog.Logger, error) {
+	redactor := NewRedactor(opts)
+
+	handlerOptions := &slog.HandlerOptions{
+		Level: opts.Level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if redactor.Redacted(groups, a.Key) {
+				a.Value = slog.StringValue(redactor.Redact(a.Value.String()))
+			}
+			return a
+		},
+	}
+
+	var handler slog.Handler
+	switch opts.Format {
+	case "", "text":
+		handler = slog.NewTextHandler(w, handlerOptions)
+	case "json":
+		handler = slog.NewJSONHandler(w, handlerOptions)
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", opts.Format)
+	}
+
+	return slog.New(&contextHandler{handler}), nil
+}
+
+// ParseLevel parses a level name such as "debug", "info", "warn" or "error"
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// ParseKeys parses a comma separated list of attribute keys
+func ParseKeys(s string) []string {
+	keys := []string{}
+	for _, key := range strings.Split(s, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Redactor redacts values of attributes like loggers of New, for records
+// which are not written by loggers
+type Redactor struct {
+	keys map[string]bool
+	salt []byte
+}
+
+// NewRedactor returns a redactor of the redacted keys and the salt of opts
+func NewRedactor(opts Options) *Redactor {
+	redacted := opts.RedactedKeys
+	if redacted == nil {
+		redacted = DefaultRedactedKeys
+	}
+
+	keys := make(map[string]bool, len(redacted))
+	for _, key := range redacted {
+		keys[key] = true
+	}
+
+	return &Redactor{keys: keys, salt: opts.RedactionSalt}
+}
+
+// Redacted reports whether the attribute of key in groups is redacted.
+// Attributes in groups of redacted keys are redacted too.
+func (r *Redactor) Redacted(groups []string, key string) bool {
+	if r.keys[key] {
+		return true
+	}
+	for _, group := range groups {
+		if r.keys[group] {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact returns "[REDACTED]", or a pseudonym of value when the salt is set
+func (r *Redactor) Redact(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	if len(r.salt) == 0 {
+		return "[REDACTED]"
+	}
+
+	mac := hmac.New(sha256.New, r.salt)
+	mac.Write([]byte(value))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context which makes loggers add id as request_id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID of ctx, or an empty string
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns a random request ID
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// contextHandler adds the request ID of a context to records
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,115 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Options{Format: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Info("test", "receipt_data", "MIIT6QYJK", "password", "secret", "transaction_id", "1000000000000001", "bundle_id", "com.example.app")
+
+	for _, secret := range []string{"MIIT6QYJK", "secret", "1000000000000001"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Fatalf("%s is not redacted: %s", secret, buf.String())
+		}
+	}
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	if record["password"] != "[REDACTED]" {
+		t.Fatalf("Wrong password: %v", record["password"])
+	}
+
+	if record["bundle_id"] != "com.example.app" {
+		t.Fatalf("Wrong bundle_id: %v", record["bundle_id"])
+	}
+}
+
+func TestRedactionInGroups(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Options{Format: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.WithGroup("request").Info("test",
+		"transaction_id", "1000000000000001",
+		slog.Group("transaction_id", "local", "1000000000000002", "upstream", "1000000000000003"),
+		slog.Group("in_app", "product_id", "com.example.app.iap"))
+
+	for _, secret := range []string{"1000000000000001", "1000000000000002", "1000000000000003"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Fatalf("%s is not redacted: %s", secret, buf.String())
+		}
+	}
+
+	if !strings.Contains(buf.String(), "com.example.app.iap") {
+		t.Fatalf("product_id should not be redacted: %s", buf.String())
+	}
+}
+
+func TestRedactionWithSalt(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Options{Format: "json", RedactedKeys: []string{"user"}, RedactionSalt: []byte("salt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Info("test", "user", "alice", "transaction_id", "1000000000000001")
+	logger.Info("test", "user", "alice")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	var first, second map[string]interface{}
+	json.Unmarshal([]byte(lines[0]), &first)
+	json.Unmarshal([]byte(lines[1]), &second)
+
+	if first["user"] == "alice" || first["user"] != second["user"] {
+		t.Fatalf("user should be the same pseudonym: %v, %v", first["user"], second["user"])
+	}
+
+	if first["transaction_id"] != "1000000000000001" {
+		t.Fatalf("transaction_id should not be redacted: %v", first["transaction_id"])
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := WithRequestID(context.Background(), "abc123")
+	logger.With("component", "test").InfoContext(ctx, "test")
+
+	if !strings.Contains(buf.String(), "request_id=abc123") {
+		t.Fatalf("request_id is not logged: %s", buf.String())
+	}
+
+	buf.Reset()
+	logger.Log(context.Background(), slog.LevelDebug, "test")
+
+	if buf.Len() != 0 {
+		t.Fatalf("Debug log should not be written: %s", buf.String())
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, Options{Format: "xml"}); err == nil {
+		t.Fatal("Unknown format should be an error")
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"log/slog"
+	"net/http"
+
+	"github.com/aktsk/nolmandy/client"
+	"github.com/aktsk/nolmandy/receipt"
+	"github.com/aktsk/nolmandy/server"
+)
+
+// Proxy forwards requests to an upstream verifyReceipt endpoint and responds
+// with the upstream response.
+type Proxy struct {
+	// Client posts requests to the upstream endpoint. Its sandbox fallback
+	// and retries apply to proxied requests.
+	Client *client.Client
+
+	// ValidateLocally makes the proxy validate receipts before forwarding
+	// them. Receipts which fail local validation are not forwarded, and the
+	// local result is returned when the upstream endpoint is unavailable.
+	ValidateLocally bool
+
+	// Cert is the certificate for local validation. Apple Inc Root
+	// Certificate is used when Cert is nil.
+	Cert *x509.Certificate
+
+	// Verifier validates receipts locally, with per-app settings for
+	// example. Cert is used when Verifier is nil.
+	Verifier server.Verifier
+
+	// MaxBodySize limits the size of request bodies as in server.DecodeRequest
+	MaxBodySize int64
+}
+
+// ServeHTTP proxies a verifyReceipt request
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	request, ok := server.ReadRequest(w, r, p.MaxBodySize)
+	if !ok {
+		return
+	}
+
+	var local receipt.Result
+	if p.ValidateLocally {
+		local = p.verify(r.Context(), request)
+		if local.Status != 0 && !local.IsRetryable {
+			server.WriteResult(w, local)
+			return
+		}
+	}
+
+	upstream, err := p.Client.Verify(r.Context(), request.AppStoreRequest())
+	if err == nil && !client.IsRetryable(upstream) {
+		server.WriteResult(w, *upstream)
+		return
+	}
+
+	if err != nil {
+		slog.WarnContext(r.Context(), "failed to verify receipt upstream", "error", err)
+	}
+
+	if p.ValidateLocally && local.Status == 0 {
+		server.WriteResult(w, local)
+		return
+	}
+
+	if err == nil {
+		server.WriteResult(w, *upstream)
+		return
+	}
+
+	server.WriteResult(w, receipt.Result{Status: 21100, IsRetryable: true})
+}
+
+func (p *Proxy) verify(ctx context.Context, request server.Request) receipt.Result {
+	if p.Verifier != nil {
+		return server.VerifyWith(ctx, p.Verifier, request)
+	}
+	return server.VerifyContext(ctx, p.Cert, request)
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aktsk/nolmandy/client"
+	"github.com/aktsk/nolmandy/internal/testutil"
+	"github.com/aktsk/nolmandy/receipt"
+	"github.com/aktsk/nolmandy/server"
+)
+
+func TestProxy(t *testing.T) {
+	production := upstream(t, `{"status":21007}`, nil)
+	defer production.Close()
+
+	sandbox := upstream(t, `{"status":0,"environment":"Sandbox","some_upstream_field":true}`, nil)
+	defer sandbox.Close()
+
+	p := &Proxy{Client: &client.Client{URL: production.URL, SandboxURL: sandbox.URL}}
+
+	result := request(t, p, "MIIT6QYJK...")
+
+	if result.Status != 0 {
+		t.Fatalf("Status should be 0, not %d", result.Status)
+	}
+
+	if result.Environment != "Sandbox" {
+		t.Fatalf("Wrong environment: %s", result.Environment)
+	}
+
+	if _, ok := result.Extra["some_upstream_field"]; !ok {
+		t.Fatalf("Upstream response should be returned as is: %v", result.Extra)
+	}
+}
+
+func TestUpstreamUnavailable(t *testing.T) {
+	down := upstream(t, "", nil)
+	down.Close()
+
+	cert, data := testutil.SignedReceipt(t, testutil.Receipt())
+
+	p := &Proxy{Client: &client.Client{URL: down.URL}}
+
+	result := request(t, p, data)
+
+	if result.Status != 21100 || !result.IsRetryable {
+		t.Fatalf("Status should be retryable 21100, not %d", result.Status)
+	}
+
+	p.ValidateLocally = true
+	p.Cert = cert
+
+	result = request(t, p, data)
+
+	if result.Status != 0 {
+		t.Fatalf("Status should be 0, not %d", result.Status)
+	}
+
+	if result.Receipt.BundleID != "com.example.app" {
+		t.Fatalf("Wrong bundle_id: %s", result.Receipt.BundleID)
+	}
+}
+
+func TestInvalidReceiptIsNotForwarded(t *testing.T) {
+	var requests int32
+	s := upstream(t, `{"status":0}`, &requests)
+	defer s.Close()
+
+	cert, _ := testutil.SignedReceipt(t, testutil.Receipt())
+
+	p := &Proxy{
+		Client:          &client.Client{URL: s.URL},
+		ValidateLocally: true,
+		Cert:            cert,
+	}
+
+	result := request(t, p, "invalid receipt")
+
+	if result.Status != 21002 {
+		t.Fatalf("Status should be 21002, not %d", result.Status)
+	}
+
+	if requests != 0 {
+		t.Fatalf("Invalid receipt should not be forwarded")
+	}
+}
+
+func upstream(t *testing.T, response string, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests != nil {
+			atomic.AddInt32(requests, 1)
+		}
+		w.Write([]byte(response))
+	}))
+}
+
+func request(t *testing.T, p *Proxy, data string) receipt.Result {
+	s := httptest.NewServer(p)
+	defer s.Close()
+
+	reqBody, err := json.Marshal(server.Request{ReceiptData: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(s.URL, "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result receipt.Result
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
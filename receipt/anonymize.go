@@ -0,0 +1,131 @@
+package receipt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"strconv"
+	"time"
+
+	"github.com/guregu/null/v5"
+)
+
+// Anonymizer replaces identifiers in a receipt with pseudonyms so that
+// production receipts can be used as test fixtures.
+//
+// The same identifier is always mapped to the same pseudonym for the same
+// salt, so transactions keep referring to their original transactions.
+type Anonymizer struct {
+	Salt      []byte
+	DateShift time.Duration
+}
+
+// Anonymize pseudonymizes transaction IDs, web order line item IDs, the
+// opaque value and the SHA-1 hash of a receipt, and shifts its dates by
+// DateShift. Attributes and JSON fields which nolmandy does not know are
+// dropped, since they may identify users.
+func (a *Anonymizer) Anonymize(r *Receipt) {
+	r.OpaqueValue = a.pseudonymBytes("opaque_value", r.OpaqueValue)
+	r.SHA1Hash = a.pseudonymBytes("sha1_hash", r.SHA1Hash)
+	r.unknownAttributes = nil
+	r.Extra = nil
+
+	r.CreationDate.shift(a.DateShift)
+	r.OriginalPurchaseDate.shift(a.DateShift)
+	r.ExpirationDate.shift(a.DateShift)
+	r.PreorderDate.shift(a.DateShift)
+
+	for _, inApp := range r.InApp {
+		inApp.unknownAttributes = nil
+		inApp.Extra = nil
+
+		inApp.TransactionID = a.pseudonymDigits("transaction_id", inApp.TransactionID)
+		inApp.OriginalTransactionID = a.pseudonymDigits("transaction_id", inApp.OriginalTransactionID)
+		if inApp.WebOrderLineItemID != 0 {
+			id := a.pseudonymDigits("web_order_line_item_id", strconv.FormatInt(inApp.WebOrderLineItemID, 10))
+			inApp.WebOrderLineItemID, _ = strconv.ParseInt(id, 10, 64)
+		}
+
+		inApp.PurchaseDate.shift(a.DateShift)
+		inApp.OriginalPurchaseDate.shift(a.DateShift)
+		inApp.ExpiresDate.shift(a.DateShift)
+		inApp.CancellationDate.shift(a.DateShift)
+	}
+}
+
+// pseudonymDigits maps a decimal identifier to another decimal identifier of
+// the same length.
+func (a *Anonymizer) pseudonymDigits(kind string, s string) string {
+	if s == "" {
+		return s
+	}
+
+	sum := a.pseudonymBytes(kind, []byte(s))
+	digits := make([]byte, len(s))
+	for i := range digits {
+		digits[i] = '0' + sum[i]%10
+	}
+	// Keep the leading digit non-zero, and small enough for 19 digit
+	// identifiers to fit in int64.
+	digits[0] = '1' + sum[0]%8
+
+	return string(digits)
+}
+
+// pseudonymBytes maps bytes to other bytes of the same length
+func (a *Anonymizer) pseudonymBytes(kind string, b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+
+	var sum []byte
+	for counter := 0; len(sum) < len(b); counter++ {
+		mac := hmac.New(sha256.New, a.Salt)
+		mac.Write([]byte(kind))
+		mac.Write([]byte{0, byte(counter)})
+		mac.Write(b)
+		sum = mac.Sum(sum)
+	}
+
+	return sum[:len(b)]
+}
+
+func (d *CreationDate) shift(shift time.Duration) {
+	d.Date, d.DateMS, d.DatePST = shiftDates(d.Date, d.DateMS, d.DatePST, shift)
+}
+
+func (d *OriginalPurchaseDate) shift(shift time.Duration) {
+	d.Date, d.DateMS, d.DatePST = shiftDates(d.Date, d.DateMS, d.DatePST, shift)
+}
+
+func (d *ExpirationDate) shift(shift time.Duration) {
+	d.Date, d.DateMS, d.DatePST = shiftDates(d.Date, d.DateMS, d.DatePST, shift)
+}
+
+func (d *PreorderDate) shift(shift time.Duration) {
+	d.Date, d.DateMS, d.DatePST = shiftDates(d.Date, d.DateMS, d.DatePST, shift)
+}
+
+func (d *PurchaseDate) shift(shift time.Duration) {
+	d.Date, d.DateMS, d.DatePST = shiftDates(d.Date, d.DateMS, d.DatePST, shift)
+}
+
+func (d *ExpiresDate) shift(shift time.Duration) {
+	d.Date, d.DateMS, d.DatePST = shiftDates(d.Date, d.DateMS, d.DatePST, shift)
+}
+
+func (d *CancellationDate) shift(shift time.Duration) {
+	d.Date, d.DateMS, d.DatePST = shiftDates(d.Date, d.DateMS, d.DatePST, shift)
+}
+
+func shiftDates(d date, ms dateMS, pst datePST, shift time.Duration) (date, dateMS, datePST) {
+	return date(shiftTime(null.Time(d), shift)),
+		dateMS(shiftTime(null.Time(ms), shift)),
+		datePST(shiftTime(null.Time(pst), shift))
+}
+
+func shiftTime(t null.Time, shift time.Duration) null.Time {
+	if !t.Valid {
+		return t
+	}
+	return null.TimeFrom(t.Time.Add(shift))
+}
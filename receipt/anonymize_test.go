@@ -0,0 +1,88 @@
+package receipt
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/guregu/null/v5"
+)
+
+func TestAnonymizeAndSign(t *testing.T) {
+	certDER, _ := pem.Decode([]byte(certificate))
+	cert, err := x509.ParseCertificate(certDER.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rcpt, err := Parse(cert, receiptData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Attributes unknown to nolmandy may identify users
+	rcpt.unknownAttributes = append(rcpt.unknownAttributes, attribute{Type: 1, Version: 1, Value: []byte{0x02, 0x01, 0x05}})
+	rcpt.InApp[1].unknownAttributes = append(rcpt.InApp[1].unknownAttributes, attribute{Type: 1720, Version: 1, Value: []byte{0x02, 0x01, 0x01}})
+
+	original := *rcpt.InApp[1]
+	originalCreationDate := null.Time(rcpt.CreationDate.Date).Time
+
+	anonymizer := Anonymizer{Salt: []byte("salt"), DateShift: -24 * time.Hour}
+	anonymizer.Anonymize(rcpt)
+
+	inApp := rcpt.InApp[1]
+
+	if inApp.TransactionID == original.TransactionID || len(inApp.TransactionID) != len(original.TransactionID) {
+		t.Fatalf("Wrong transaction_id: %s", inApp.TransactionID)
+	}
+
+	// Every in-app purchase in the fixture has the same original transaction
+	if inApp.OriginalTransactionID != rcpt.InApp[0].OriginalTransactionID {
+		t.Fatalf("Original transaction IDs are not mapped consistently: %s, %s",
+			inApp.OriginalTransactionID, rcpt.InApp[0].OriginalTransactionID)
+	}
+
+	if inApp.WebOrderLineItemID == original.WebOrderLineItemID {
+		t.Fatalf("Wrong web_order_line_item_id: %d", inApp.WebOrderLineItemID)
+	}
+
+	creationDate := null.Time(rcpt.CreationDate.Date).Time
+	if !creationDate.Equal(originalCreationDate.Add(-24 * time.Hour)) {
+		t.Fatalf("Wrong creation_date: %v", creationDate)
+	}
+
+	testCert, testKey := generateCertificate(t)
+
+	data, err := rcpt.Sign(testCert, testKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resigned, err := Parse(testCert, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resigned.InApp[1].TransactionID != inApp.TransactionID {
+		t.Fatalf("Wrong transaction_id: %s", resigned.InApp[1].TransactionID)
+	}
+
+	if resigned.unknownAttributes != nil || resigned.InApp[1].unknownAttributes != nil {
+		t.Fatalf("Unknown attributes should be dropped: %v, %v", resigned.unknownAttributes, resigned.InApp[1].unknownAttributes)
+	}
+
+	if _, err := Parse(cert, data); err == nil {
+		t.Fatal("Re-signed receipt should not be verified by the original certificate")
+	}
+
+	again, err := Parse(cert, receiptData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymizer.Anonymize(again)
+
+	if again.InApp[1].TransactionID != inApp.TransactionID {
+		t.Fatalf("Pseudonyms should be stable: %s, %s", again.InApp[1].TransactionID, inApp.TransactionID)
+	}
+}
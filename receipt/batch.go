@@ -0,0 +1,129 @@
+package receipt
+
+import (
+	"context"
+	"crypto/x509"
+	"runtime"
+	"sync"
+)
+
+// BatchRequest is a request of a batch
+type BatchRequest struct {
+	// Index identifies the request in its result, the position in the
+	// batch for example
+	Index int
+
+	Data     string
+	Password string
+}
+
+// BatchResult is the result of a request of a batch. Err tells why the
+// receipt is rejected, and does not fail the batch.
+type BatchResult struct {
+	Index  int
+	Result Result
+	Err    error
+}
+
+// VerifyFunc verifies base 64 encoded receipt data with a password, such as
+// Verifier.Verify
+type VerifyFunc func(ctx context.Context, data string, password string) (Result, error)
+
+// VerifyMany verifies requests by verify in a pool of workers, and sends the
+// results in the order of completion. The results are closed when the
+// requests are closed and all of them are verified, or when ctx is done.
+// runtime.GOMAXPROCS(0) workers are used when workers is not positive.
+func VerifyMany(ctx context.Context, verify VerifyFunc, requests <-chan BatchRequest, workers int) <-chan BatchResult {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	results := make(chan BatchResult, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				var request BatchRequest
+				var ok bool
+				select {
+				case <-ctx.Done():
+					return
+				case request, ok = <-requests:
+					if !ok {
+						return
+					}
+				}
+
+				result, err := verify(ctx, request.Data, request.Password)
+
+				select {
+				case <-ctx.Done():
+					return
+				case results <- BatchResult{Index: request.Index, Result: result, Err: err}:
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
+
+// ValidateMany is the same as VerifyMany with Verify of the verifier
+func (v *Verifier) ValidateMany(ctx context.Context, requests <-chan BatchRequest, workers int) <-chan BatchResult {
+	return VerifyMany(ctx, v.Verify, requests, workers)
+}
+
+// ParseBatch parses base 64 encoded receipt data with a given certificate
+// in a pool of workers. Receipts and errors are in the order of data, and
+// the receipts of errors are nil. runtime.GOMAXPROCS(0) workers are used when
+// workers is not positive.
+func ParseBatch(ctx context.Context, root *x509.Certificate, data []string, workers int) ([]*Receipt, []error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	receipts := make([]*Receipt, len(data))
+	errs := make([]error, len(data))
+
+	indexes := make(chan int)
+	go func() {
+		defer close(indexes)
+		for i := range data {
+			select {
+			case <-ctx.Done():
+				return
+			case indexes <- i:
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				receipts[i], errs[i] = ParseContext(ctx, root, data[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Receipts which are not parsed because ctx is done
+	for i := range data {
+		if receipts[i] == nil && errs[i] == nil {
+			errs[i] = ctx.Err()
+		}
+	}
+
+	return receipts, errs
+}
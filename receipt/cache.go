@@ -0,0 +1,285 @@
+package receipt
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Cache keeps receipts which are verified by Verifier, so that the same
+// receipt is not verified again. Receipts are keyed by their DER encoded
+// data and the certificates and CRLs they are verified with, and evicted by
+// least recent use and TTL. A Cache is safe for concurrent use, and may be
+// shared by verifiers. The certificates and CRLs of a verifier must not be
+// changed once it is used with a cache.
+type Cache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List
+	stats   CacheStats
+
+	// fingerprints are the hashes of the certificates and CRLs of recently
+	// used verifiers, which are computed once per verifier
+	fingerprints map[*Verifier][sha256.Size]byte
+}
+
+// maxFingerprints limits the number of verifiers whose fingerprints are
+// kept, which is usually one per reload
+const maxFingerprints = 16
+
+// CacheStats are the statistics of a cache
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+}
+
+type cacheEntry struct {
+	key       [sha256.Size]byte
+	receipt   *Receipt
+	expiresAt time.Time
+}
+
+// NewCache returns a cache of up to size receipts, which expire after ttl.
+// Receipts do not expire when ttl is zero.
+func NewCache(size int, ttl time.Duration) *Cache {
+	return &Cache{
+		size:         size,
+		ttl:          ttl,
+		entries:      map[[sha256.Size]byte]*list.Element{},
+		lru:          list.New(),
+		fingerprints: map[*Verifier][sha256.Size]byte{},
+	}
+}
+
+// Stats returns the statistics of the cache
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// get returns a copy of a cached receipt, with the request date of now
+func (c *Cache) get(key [sha256.Size]byte, now time.Time) (*Receipt, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if ok && c.ttl > 0 && now.After(e.Value.(*cacheEntry).expiresAt) {
+		c.remove(e)
+		ok = false
+	}
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.stats.Hits++
+	c.lru.MoveToFront(e)
+
+	rcpt := e.Value.(*cacheEntry).receipt.clone()
+	rcpt.setRequestDate(now)
+	return rcpt, true
+}
+
+// add caches a copy of a receipt, evicting the least recently used receipt
+// when the cache is full
+func (c *Cache) add(key [sha256.Size]byte, rcpt *Receipt, now time.Time) {
+	if c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+
+	for c.lru.Len() >= c.size {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, receipt: rcpt.clone(), expiresAt: now.Add(c.ttl)})
+}
+
+func (c *Cache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).key)
+}
+
+// cacheKey returns the key of base 64 encoded receipt data verified by a
+// verifier with roots. It returns false when the data can not be decoded.
+func (v *Verifier) cacheKey(data string, roots []*x509.Certificate) ([sha256.Size]byte, bool) {
+	der, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return [sha256.Size]byte{}, false
+	}
+
+	fingerprint := v.Cache.fingerprint(v, roots)
+
+	// The fingerprint is of a fixed size, so that keys are not ambiguous
+	h := sha256.New()
+	h.Write(der)
+	h.Write(fingerprint[:])
+
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key, true
+}
+
+// fingerprint returns the fingerprint of a verifier, computing it only when
+// it is not kept
+func (c *Cache) fingerprint(v *Verifier, roots []*x509.Certificate) [sha256.Size]byte {
+	c.mu.Lock()
+	fingerprint, ok := c.fingerprints[v]
+	c.mu.Unlock()
+	if ok {
+		return fingerprint
+	}
+
+	fingerprint = v.fingerprint(roots)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.fingerprints) >= maxFingerprints {
+		c.fingerprints = map[*Verifier][sha256.Size]byte{}
+	}
+	c.fingerprints[v] = fingerprint
+
+	return fingerprint
+}
+
+// fingerprint hashes the roots, the roots of apps and the CRLs of a verifier
+func (v *Verifier) fingerprint(roots []*x509.Certificate) [sha256.Size]byte {
+	h := sha256.New()
+	write := func(b []byte) {
+		// Lengths separate fields, so that fingerprints are not ambiguous
+		h.Write([]byte{byte(len(b) >> 24), byte(len(b) >> 16), byte(len(b) >> 8), byte(len(b))})
+		h.Write(b)
+	}
+
+	for _, cert := range roots {
+		write(cert.Raw)
+	}
+
+	bundleIDs := make([]string, 0, len(v.Apps))
+	for bundleID, app := range v.Apps {
+		if app != nil && len(app.Roots) > 0 {
+			bundleIDs = append(bundleIDs, bundleID)
+		}
+	}
+	sort.Strings(bundleIDs)
+
+	for _, bundleID := range bundleIDs {
+		write([]byte(bundleID))
+		for _, cert := range v.Apps[bundleID].Roots {
+			write(cert.Raw)
+		}
+	}
+
+	for _, crl := range v.CRLs {
+		write(crl.Raw)
+	}
+
+	var fingerprint [sha256.Size]byte
+	h.Sum(fingerprint[:0])
+	return fingerprint
+}
+
+// clone returns a deep copy of a receipt, so that results can be shaped
+// without changing cached receipts
+func (r *Receipt) clone() *Receipt {
+	c := *r
+	c.rawBundleID = bytes.Clone(r.rawBundleID)
+	c.OpaqueValue = bytes.Clone(r.OpaqueValue)
+	c.SHA1Hash = bytes.Clone(r.SHA1Hash)
+	c.unknownAttributes = cloneAttributes(r.unknownAttributes)
+	c.knownAttributes = cloneAttributes(r.knownAttributes)
+	c.Extra = cloneExtra(r.Extra)
+
+	if r.InApp != nil {
+		c.InApp = make([]*InApp, len(r.InApp))
+	}
+	for i, inApp := range r.InApp {
+		c.InApp[i] = inApp.clone()
+	}
+	return &c
+}
+
+func (inApp *InApp) clone() *InApp {
+	c := *inApp
+	c.unknownAttributes = cloneAttributes(inApp.unknownAttributes)
+	c.knownAttributes = cloneAttributes(inApp.knownAttributes)
+	c.Extra = cloneExtra(inApp.Extra)
+	return &c
+}
+
+// Clone returns a deep copy of a result, so that it can be shaped without
+// changing the result
+func (r Result) Clone() Result {
+	c := r
+	if r.Receipt != nil {
+		c.Receipt = r.Receipt.clone()
+	}
+
+	if r.LatestReceiptInfo != nil {
+		c.LatestReceiptInfo = make([]InApp, len(r.LatestReceiptInfo))
+	}
+	for i := range r.LatestReceiptInfo {
+		c.LatestReceiptInfo[i] = *r.LatestReceiptInfo[i].clone()
+	}
+
+	if r.PendingRenewalInfo != nil {
+		c.PendingRenewalInfo = make([]PendingRenewalInfo, len(r.PendingRenewalInfo))
+	}
+	for i, info := range r.PendingRenewalInfo {
+		info.Extra = cloneExtra(info.Extra)
+		c.PendingRenewalInfo[i] = info
+	}
+
+	c.Rules = slices.Clone(r.Rules)
+	c.Extra = cloneExtra(r.Extra)
+	return c
+}
+
+func cloneAttributes(attrs []attribute) []attribute {
+	if attrs == nil {
+		return nil
+	}
+
+	cloned := make([]attribute, len(attrs))
+	for i, attr := range attrs {
+		attr.Value = bytes.Clone(attr.Value)
+		cloned[i] = attr
+	}
+	return cloned
+}
+
+func cloneExtra(extra map[string]json.RawMessage) map[string]json.RawMessage {
+	if extra == nil {
+		return nil
+	}
+
+	cloned := make(map[string]json.RawMessage, len(extra))
+	for key, value := range extra {
+		cloned[key] = bytes.Clone(value)
+	}
+	return cloned
+}
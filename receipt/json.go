@@ -0,0 +1,235 @@
+package receipt
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/guregu/null/v5"
+)
+
+// The types below have the same fields as the types they are converted from
+// but no methods, so that they are encoded by the default encoder.
+type (
+	resultJSON             Result
+	receiptJSON            Receipt
+	inAppFields            InApp
+	pendingRenewalInfoJSON PendingRenewalInfo
+)
+
+// inAppJSON adds the fields of InApp which are encoded differently from the
+// Go representation.
+type inAppJSON struct {
+	inAppFields
+	IsInIntroOfferPeriod string `json:"is_in_intro_offer_period,omitempty"`
+}
+
+// The types below are encoded instead of the types they embed, so that
+// optional dates are omitted when they are null. Their fields hide the dates
+// of the embedded types, which are deeper.
+type (
+	receiptOutput struct {
+		receiptJSON
+		ExpirationDate    *date    `json:"expiration_date,omitempty"`
+		ExpirationDateMS  *dateMS  `json:"expiration_date_ms,omitempty"`
+		ExpirationDatePST *datePST `json:"expiration_date_pst,omitempty"`
+		PreorderDate      *date    `json:"preorder_date,omitempty"`
+		PreorderDateMS    *dateMS  `json:"preorder_date_ms,omitempty"`
+		PreorderDatePST   *datePST `json:"preorder_date_pst,omitempty"`
+	}
+
+	inAppOutput struct {
+		inAppJSON
+		ExpiresDate         *date    `json:"expires_date,omitempty"`
+		ExpiresDateMS       *dateMS  `json:"expires_date_ms,omitempty"`
+		ExpiresDatePST      *datePST `json:"expires_date_pst,omitempty"`
+		CancellationDate    *date    `json:"cancellation_date,omitempty"`
+		CancellationDateMS  *dateMS  `json:"cancellation_date_ms,omitempty"`
+		CancellationDatePST *datePST `json:"cancellation_date_pst,omitempty"`
+	}
+
+	pendingRenewalInfoOutput struct {
+		pendingRenewalInfoJSON
+		GracePeriodExpiresDate    *date    `json:"grace_period_expires_date,omitempty"`
+		GracePeriodExpiresDateMS  *dateMS  `json:"grace_period_expires_date_ms,omitempty"`
+		GracePeriodExpiresDatePST *datePST `json:"grace_period_expires_date_pst,omitempty"`
+	}
+)
+
+// optionalDate returns nil for a null date
+func optionalDate[T date | dateMS | datePST](d T) *T {
+	if !null.Time(d).Valid {
+		return nil
+	}
+	return &d
+}
+
+// MarshalJSON encodes the result with its extra fields
+func (r Result) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(resultJSON(r), r.Extra)
+}
+
+// UnmarshalJSON decodes the result and keeps fields unknown to Result in Extra
+func (r *Result) UnmarshalJSON(b []byte) error {
+	extra, err := unmarshalWithExtra(b, (*resultJSON)(r))
+	r.Extra = extra
+	return err
+}
+
+// MarshalJSON encodes the receipt with its extra fields
+func (r Receipt) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(receiptOutput{
+		receiptJSON:       receiptJSON(r),
+		ExpirationDate:    optionalDate(r.ExpirationDate.Date),
+		ExpirationDateMS:  optionalDate(r.ExpirationDate.DateMS),
+		ExpirationDatePST: optionalDate(r.ExpirationDate.DatePST),
+		PreorderDate:      optionalDate(r.PreorderDate.Date),
+		PreorderDateMS:    optionalDate(r.PreorderDate.DateMS),
+		PreorderDatePST:   optionalDate(r.PreorderDate.DatePST),
+	}, r.Extra)
+}
+
+// UnmarshalJSON decodes the receipt and keeps fields unknown to Receipt in Extra
+func (r *Receipt) UnmarshalJSON(b []byte) error {
+	extra, err := unmarshalWithExtra(b, (*receiptJSON)(r))
+	r.Extra = extra
+	return err
+}
+
+// MarshalJSON encodes the in-app purchase receipt with its extra fields.
+// is_in_intro_offer_period is written for subscriptions only, like Apple does.
+func (inApp InApp) MarshalJSON() ([]byte, error) {
+	v := inAppOutput{
+		inAppJSON:           inAppJSON{inAppFields: inAppFields(inApp)},
+		ExpiresDate:         optionalDate(inApp.ExpiresDate.Date),
+		ExpiresDateMS:       optionalDate(inApp.ExpiresDate.DateMS),
+		ExpiresDatePST:      optionalDate(inApp.ExpiresDate.DatePST),
+		CancellationDate:    optionalDate(inApp.CancellationDate.Date),
+		CancellationDateMS:  optionalDate(inApp.CancellationDate.DateMS),
+		CancellationDatePST: optionalDate(inApp.CancellationDate.DatePST),
+	}
+	if inApp.IsInIntroPrice || null.Time(inApp.ExpiresDate.Date).Valid {
+		v.IsInIntroOfferPeriod = strconv.FormatBool(inApp.IsInIntroPrice)
+	}
+	return marshalWithExtra(v, inApp.Extra)
+}
+
+// UnmarshalJSON decodes the in-app purchase receipt and keeps fields unknown
+// to InApp in Extra
+func (inApp *InApp) UnmarshalJSON(b []byte) error {
+	var v inAppJSON
+	extra, err := unmarshalWithExtra(b, &v)
+	if err != nil {
+		return err
+	}
+
+	*inApp = InApp(v.inAppFields)
+	inApp.IsInIntroPrice = v.IsInIntroOfferPeriod == "true"
+	inApp.Extra = extra
+
+	return nil
+}
+
+// MarshalJSON encodes the pending renewal information with its extra fields
+func (p PendingRenewalInfo) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(pendingRenewalInfoOutput{
+		pendingRenewalInfoJSON:    pendingRenewalInfoJSON(p),
+		GracePeriodExpiresDate:    optionalDate(p.GracePeriodExpiresDate.Date),
+		GracePeriodExpiresDateMS:  optionalDate(p.GracePeriodExpiresDate.DateMS),
+		GracePeriodExpiresDatePST: optionalDate(p.GracePeriodExpiresDate.DatePST),
+	}, p.Extra)
+}
+
+// UnmarshalJSON decodes the pending renewal information and keeps fields
+// unknown to PendingRenewalInfo in Extra
+func (p *PendingRenewalInfo) UnmarshalJSON(b []byte) error {
+	extra, err := unmarshalWithExtra(b, (*pendingRenewalInfoJSON)(p))
+	p.Extra = extra
+	return err
+}
+
+// marshalWithExtra encodes v and adds extra fields which v does not have
+func marshalWithExtra(v interface{}, extra map[string]json.RawMessage) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return b, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+
+	for name, value := range extra {
+		if _, ok := fields[name]; !ok {
+			fields[name] = value
+		}
+	}
+
+	return json.Marshal(fields)
+}
+
+// unmarshalWithExtra decodes b into v and returns fields of b which v does not have
+func unmarshalWithExtra(b []byte, v interface{}) (map[string]json.RawMessage, error) {
+	if err := json.Unmarshal(b, v); err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+
+	for name := range jsonFieldNames(reflect.TypeOf(v).Elem()) {
+		delete(fields, name)
+	}
+
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	return fields, nil
+}
+
+var jsonFieldNamesCache sync.Map
+
+// jsonFieldNames returns the names of the JSON fields encoded for a struct type,
+// including the fields of embedded structs.
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	if names, ok := jsonFieldNamesCache.Load(t); ok {
+		return names.(map[string]bool)
+	}
+
+	names := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for embedded := range jsonFieldNames(field.Type) {
+				names[embedded] = true
+			}
+			continue
+		}
+
+		if !field.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		names[name] = true
+	}
+
+	jsonFieldNamesCache.Store(t, names)
+
+	return names
+}
@@ -0,0 +1,167 @@
+package receipt
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/guregu/null/v5"
+)
+
+func TestUnmarshalAndMarshalAppleResponses(t *testing.T) {
+	files, err := filepath.Glob("testdata/verify_receipt_*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			golden, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var result Result
+			if err := json.Unmarshal(golden, &result); err != nil {
+				t.Fatal(err)
+			}
+
+			marshaled, err := json.Marshal(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var want, got interface{}
+			if err := json.Unmarshal(golden, &want); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(marshaled, &got); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(want, got) {
+				t.Fatalf("Response is not the same after unmarshaling and marshaling:\n%s", marshaled)
+			}
+		})
+	}
+}
+
+func TestUnmarshalSubscriptionResponse(t *testing.T) {
+	golden, err := os.ReadFile("testdata/verify_receipt_subscription.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result Result
+	if err := json.Unmarshal(golden, &result); err != nil {
+		t.Fatal(err)
+	}
+
+	latest := result.LatestReceiptInfo[0]
+
+	purchaseDate := null.Time(latest.PurchaseDate.DateMS).Time
+	if purchaseDate.UnixMilli() != 1678872912123 {
+		t.Fatalf("Wrong purchase_date_ms: %d", purchaseDate.UnixMilli())
+	}
+
+	expiresDate := null.Time(latest.ExpiresDate.Date).Time
+	if expiresDate.Unix() != 1678873212 {
+		t.Fatalf("Wrong expires_date: %v", expiresDate)
+	}
+
+	if latest.WebOrderLineItemID != 2000000022387157 {
+		t.Fatalf("Wrong web_order_line_item_id: %d", latest.WebOrderLineItemID)
+	}
+
+	if latest.SubscriptionGroupIdentifier != "20929536" {
+		t.Fatalf("Wrong subscription_group_identifier: %s", latest.SubscriptionGroupIdentifier)
+	}
+
+	if result.PendingRenewalInfo[0].ExpirationIntent != "1" {
+		t.Fatalf("Wrong expiration_intent: %s", result.PendingRenewalInfo[0].ExpirationIntent)
+	}
+
+	if result.Receipt.InApp[0].IsTrialPeriod != "true" {
+		t.Fatalf("Wrong is_trial_period: %s", result.Receipt.InApp[0].IsTrialPeriod)
+	}
+}
+
+func TestUnmarshalUnknownFields(t *testing.T) {
+	golden, err := os.ReadFile("testdata/verify_receipt_production.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result Result
+	if err := json.Unmarshal(golden, &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(result.Extra["some_future_field"]) != `"kept as is"` {
+		t.Fatalf("Wrong extra field: %s", result.Extra["some_future_field"])
+	}
+
+	if _, ok := result.Receipt.Extra["some_future_receipt_field"]; !ok {
+		t.Fatalf("Unknown receipt field is not kept: %v", result.Receipt.Extra)
+	}
+
+	if len(result.Receipt.Extra) != 1 {
+		t.Fatalf("Known fields should not be kept as extra fields: %v", result.Receipt.Extra)
+	}
+
+	if result.Receipt.InApp[0].Extra != nil {
+		t.Fatalf("Known fields should not be kept as extra fields: %v", result.Receipt.InApp[0].Extra)
+	}
+}
+
+func TestMarshalOptionalDates(t *testing.T) {
+	var subscription, consumable InApp
+	json.Unmarshal([]byte(`{"product_id":"monthly","web_order_line_item_id":"2000000022387157","expires_date":"2024-02-01 00:00:00 Etc/GMT","expires_date_ms":"1706745600000","expires_date_pst":"2024-01-31 16:00:00 America/Los_Angeles","cancellation_date":"2024-01-15 00:00:00 Etc/GMT","cancellation_date_ms":"1705276800000","cancellation_date_pst":"2024-01-14 16:00:00 America/Los_Angeles"}`), &subscription)
+	json.Unmarshal([]byte(`{"product_id":"coins"}`), &consumable)
+
+	fields := func(v interface{}) map[string]interface{} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(b, &fields); err != nil {
+			t.Fatal(err)
+		}
+		return fields
+	}
+
+	s := fields(subscription)
+	for name, value := range map[string]interface{}{
+		"web_order_line_item_id": "2000000022387157",
+		"expires_date":           "2024-02-01 00:00:00 Etc/GMT",
+		"expires_date_ms":        "1706745600000",
+		"cancellation_date":      "2024-01-15 00:00:00 Etc/GMT",
+		"cancellation_date_pst":  "2024-01-14 16:00:00 America/Los_Angeles",
+	} {
+		if s[name] != value {
+			t.Fatalf("Wrong %s: %v", name, s[name])
+		}
+	}
+
+	c := fields(consumable)
+	for _, name := range []string{"web_order_line_item_id", "expires_date", "expires_date_ms", "expires_date_pst", "cancellation_date", "cancellation_date_ms", "cancellation_date_pst"} {
+		if _, ok := c[name]; ok {
+			t.Fatalf("%s should be omitted: %v", name, c)
+		}
+	}
+
+	r := fields(Receipt{})
+	p := fields(PendingRenewalInfo{})
+	for _, name := range []string{"expiration_date", "preorder_date_ms", "grace_period_expires_date"} {
+		if _, ok := r[name]; ok {
+			t.Fatalf("%s should be omitted: %v", name, r)
+		}
+		if _, ok := p[name]; ok {
+			t.Fatalf("%s should be omitted: %v", name, p)
+		}
+	}
+}
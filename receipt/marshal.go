@@ -0,0 +1,219 @@
+package receipt
+
+import (
+	"encoding/asn1"
+	"sort"
+	"time"
+
+	"github.com/guregu/null/v5"
+)
+
+// attributeVersion is the version written for attributes which were not parsed
+const attributeVersion = 1
+
+// MarshalASN1 encodes the receipt back into the ASN.1 payload which is signed
+// in a PKCS#7 container. Attributes are written with the versions and string
+// types they were parsed with, and attributes which nolmandy does not know
+// are written back as they were, so that an unmodified parsed receipt gives
+// the same payload.
+func (r *Receipt) MarshalASN1() ([]byte, error) {
+	e := &attributeEncoder{parsed: r.knownAttributes}
+
+	e.string(0, r.ReceiptType, false)
+	e.string(2, r.BundleID, true)
+	e.string(3, r.ApplicationVersion, true)
+	e.bytes(4, r.OpaqueValue)
+	e.bytes(5, r.SHA1Hash)
+	e.time(12, null.Time(r.CreationDate.Date))
+	for _, inApp := range r.InApp {
+		value, err := inApp.MarshalASN1()
+		if err != nil {
+			return nil, err
+		}
+		e.add(17, value)
+	}
+	e.time(18, null.Time(r.OriginalPurchaseDate.Date))
+	e.string(19, r.OriginalApplicationVersion, true)
+	e.time(21, null.Time(r.ExpirationDate.Date))
+
+	if e.err != nil {
+		return nil, e.err
+	}
+	return marshalAttributeSet(r.attributesTag, e.attrs, r.unknownAttributes)
+}
+
+// MarshalASN1 encodes the in-app purchase receipt into the ASN.1 set which is
+// the value of an in-app purchase receipt attribute.
+func (inApp *InApp) MarshalASN1() ([]byte, error) {
+	e := &attributeEncoder{parsed: inApp.knownAttributes}
+
+	e.int(1701, inApp.Quantity, true)
+	e.string(1702, inApp.ProductID, true)
+	e.string(1703, inApp.TransactionID, true)
+	e.time(1704, null.Time(inApp.PurchaseDate.Date))
+	e.string(1705, inApp.OriginalTransactionID, true)
+	e.time(1706, null.Time(inApp.OriginalPurchaseDate.Date))
+	e.time(1708, null.Time(inApp.ExpiresDate.Date))
+	e.int(1711, inApp.WebOrderLineItemID, false)
+	e.time(1712, null.Time(inApp.CancellationDate.Date))
+	e.bool(1713, inApp.IsTrialPeriod == "true", true)
+	e.bool(1719, inApp.IsInIntroPrice, true)
+	e.string(1721, inApp.PromotionalOfferID, false)
+
+	if e.err != nil {
+		return nil, e.err
+	}
+	return marshalAttributeSet(inApp.attributesTag, e.attrs, inApp.unknownAttributes)
+}
+
+// attributeEncoder encodes known attributes like they were parsed. Attributes
+// of a receipt which was not parsed are written with attributeVersion and
+// default string types, and required attributes are always written.
+type attributeEncoder struct {
+	parsed []attribute
+	attrs  []attribute
+	err    error
+}
+
+// original returns the attribute of the type as it was parsed
+func (e *attributeEncoder) original(typ int) (attribute, bool) {
+	for _, attr := range e.parsed {
+		if attr.Type == typ {
+			return attr, true
+		}
+	}
+	return attribute{}, false
+}
+
+// present reports whether the attribute of the type is written
+func (e *attributeEncoder) present(typ int, set bool, required bool) bool {
+	if set {
+		return true
+	}
+	if e.parsed == nil {
+		return required
+	}
+	_, ok := e.original(typ)
+	return ok
+}
+
+func (e *attributeEncoder) add(typ int, value []byte) {
+	version := attributeVersion
+	if attr, ok := e.original(typ); ok {
+		version = attr.Version
+	}
+	e.attrs = append(e.attrs, attribute{Type: typ, Version: version, Value: value})
+}
+
+func (e *attributeEncoder) marshal(typ int, value any, params string) {
+	if e.err != nil {
+		return
+	}
+	b, err := asn1.MarshalWithParams(value, params)
+	if err != nil {
+		e.err = err
+		return
+	}
+	e.add(typ, b)
+}
+
+// stringParams returns the parameters to marshal a string attribute with
+// the string type it was parsed with
+func (e *attributeEncoder) stringParams(typ int, s string, params string) string {
+	attr, ok := e.original(typ)
+	if !ok {
+		return params
+	}
+
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(attr.Value, &raw); err != nil {
+		return params
+	}
+	switch raw.Tag {
+	case asn1.TagPrintableString:
+		// Not every string can be encoded as PrintableString
+		if _, err := asn1.MarshalWithParams(s, "printable"); err == nil {
+			return "printable"
+		}
+	case asn1.TagIA5String:
+		if _, err := asn1.MarshalWithParams(s, "ia5"); err == nil {
+			return "ia5"
+		}
+	case asn1.TagUTF8String:
+		return "utf8"
+	}
+	return params
+}
+
+func (e *attributeEncoder) string(typ int, s string, required bool) {
+	if e.present(typ, s != "", required) {
+		e.marshal(typ, s, e.stringParams(typ, s, "utf8"))
+	}
+}
+
+func (e *attributeEncoder) int(typ int, i int64, required bool) {
+	if e.present(typ, i != 0, required) {
+		e.marshal(typ, i, "")
+	}
+}
+
+// bool encodes a boolean as an integer like Apple does
+func (e *attributeEncoder) bool(typ int, b bool, required bool) {
+	var i int64
+	if b {
+		i = 1
+	}
+	e.int(typ, i, required)
+}
+
+func (e *attributeEncoder) bytes(typ int, b []byte) {
+	if b != nil {
+		e.add(typ, b)
+	}
+}
+
+func (e *attributeEncoder) time(typ int, t null.Time) {
+	if t.Valid {
+		s := t.Time.UTC().Format(time.RFC3339)
+		e.marshal(typ, s, e.stringParams(typ, s, "ia5"))
+		return
+	}
+
+	// Null dates are parsed from empty or zero dates, which are kept
+	if attr, ok := e.original(typ); ok {
+		if parsed, err := asn1ParseTime(attr.Value); err == nil && !parsed.Valid {
+			e.add(typ, attr.Value)
+		}
+	}
+}
+
+// marshalAttributeSet encodes known and unknown attributes ordered by
+// attribute type, as an ASN.1 set unless another tag was parsed.
+func marshalAttributeSet(tag int, known []attribute, unknown []attribute) ([]byte, error) {
+	if tag == 0 {
+		tag = asn1.TagSet
+	}
+
+	attrs := make([]attribute, 0, len(known)+len(unknown))
+	attrs = append(attrs, known...)
+	attrs = append(attrs, unknown...)
+	sort.SliceStable(attrs, func(i, j int) bool {
+		return attrs[i].Type < attrs[j].Type
+	})
+
+	var content []byte
+	for _, attr := range attrs {
+		b, err := asn1.Marshal(attr)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, b...)
+	}
+
+	return asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassUniversal,
+		Tag:        tag,
+		IsCompound: true,
+		Bytes:      content,
+	})
+}
@@ -2,6 +2,7 @@ package receipt
 
 import (
 	"bytes"
+	"encoding/json"
 	"strconv"
 	"time"
 
@@ -48,7 +49,7 @@ func (nd dateMS) MarshalJSON() ([]byte, error) {
 	}
 	d := null.Time(nd).Time
 
-	t := strconv.FormatInt(time.Time(d).Unix()*1000, 10)
+	t := strconv.FormatInt(time.Time(d).UnixMilli(), 10)
 	return []byte(`"` + t + `"`), nil
 }
 
@@ -63,12 +64,12 @@ func (nd *dateMS) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
-	sec, err := strconv.ParseInt(msString, 10, 64)
+	ms, err := strconv.ParseInt(msString, 10, 64)
 	if err != nil {
 		return err
 	}
 
-	t := time.Unix(sec/1000, 0)
+	t := time.UnixMilli(ms)
 	*nd = dateMS(null.TimeFrom(t))
 
 	return nil
@@ -126,13 +127,21 @@ type Receipt struct {
 	VersionExternalIdentifier  int64    `json:"version_external_identifier"`
 	OriginalApplicationVersion string   `json:"original_application_version"`
 	InApp                      []*InApp `json:"in_app"`
-	ExpirationDate             date     `json:"-"`
 	rawBundleID                []byte
 	OpaqueValue                []byte `json:"-"`
 	SHA1Hash                   []byte `json:"-"`
+	unknownAttributes          []attribute
+	knownAttributes            []attribute
+	attributesTag              int
 	CreationDate
 	RequestDate
 	OriginalPurchaseDate
+	ExpirationDate
+	PreorderDate
+
+	// Extra holds JSON fields which are not modeled by Receipt, so that
+	// they are preserved when decoding and encoding the receipt again.
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // InApp represents the receipt for in-app purchase
@@ -142,7 +151,7 @@ type InApp struct {
 	ProductID             string `json:"product_id"`
 	TransactionID         string `json:"transaction_id"`
 	OriginalTransactionID string `json:"original_transaction_id"`
-	WebOrderLineItemID    int64  `json:"web_order_line_item_id,omitempty"`
+	WebOrderLineItemID    int64  `json:"web_order_line_item_id,string,omitempty"`
 
 	IsTrialPeriod string `json:"is_trial_period"`
 	ExpiresDate
@@ -153,6 +162,38 @@ type InApp struct {
 	CancellationDate
 	CancellationReason string `json:"cancellation_reason,omitempty"`
 	IsInIntroPrice     bool   `json:"-"`
+
+	IsUpgraded                  bool   `json:"is_upgraded,string,omitempty"`
+	PromotionalOfferID          string `json:"promotional_offer_id,omitempty"`
+	OfferCodeRefName            string `json:"offer_code_ref_name,omitempty"`
+	SubscriptionGroupIdentifier string `json:"subscription_group_identifier,omitempty"`
+	InAppOwnershipType          string `json:"in_app_ownership_type,omitempty"`
+	AppAccountToken             string `json:"app_account_token,omitempty"`
+	unknownAttributes           []attribute
+	knownAttributes             []attribute
+	attributesTag               int
+
+	// Extra holds JSON fields which are not modeled by InApp
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// PendingRenewalInfo represents the renewal information of an auto-renewable subscription
+// https://developer.apple.com/documentation/appstorereceipts/responsebody/pending_renewal_info
+type PendingRenewalInfo struct {
+	AutoRenewProductID string `json:"auto_renew_product_id,omitempty"`
+	AutoRenewStatus    string `json:"auto_renew_status,omitempty"`
+	ExpirationIntent   string `json:"expiration_intent,omitempty"`
+	GracePeriodExpiresDate
+	IsInBillingRetryPeriod string `json:"is_in_billing_retry_period,omitempty"`
+	OfferCodeRefName       string `json:"offer_code_ref_name,omitempty"`
+	OriginalTransactionID  string `json:"original_transaction_id"`
+	PriceConsentStatus     string `json:"price_consent_status,omitempty"`
+	PriceIncreaseStatus    string `json:"price_increase_status,omitempty"`
+	ProductID              string `json:"product_id"`
+	PromotionalOfferID     string `json:"promotional_offer_id,omitempty"`
+
+	// Extra holds JSON fields which are not modeled by PendingRenewalInfo
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // CreationDate is the date when the app receipt was created
@@ -169,11 +210,25 @@ type RequestDate struct {
 	DatePST datePST `json:"request_date_pst"`
 }
 
+// ExpirationDate is the date that the app receipt expires
+type ExpirationDate struct {
+	Date    date    `json:"expiration_date"`
+	DateMS  dateMS  `json:"expiration_date_ms"`
+	DatePST datePST `json:"expiration_date_pst"`
+}
+
+// PreorderDate is the date when the user ordered the app available for pre-order
+type PreorderDate struct {
+	Date    date    `json:"preorder_date"`
+	DateMS  dateMS  `json:"preorder_date_ms"`
+	DatePST datePST `json:"preorder_date_pst"`
+}
+
 // ExpiresDate is for the subscription
 type ExpiresDate struct {
-	Date    date    `json:"-"`
-	DateMS  dateMS  `json:"-"`
-	DatePST datePST `json:"-"`
+	Date    date    `json:"expires_date"`
+	DateMS  dateMS  `json:"expires_date_ms"`
+	DatePST datePST `json:"expires_date_pst"`
 }
 
 // PurchaseDate is the date and time that the item was purchased
@@ -192,7 +247,14 @@ type OriginalPurchaseDate struct {
 
 // CancellationDate is for a transaction that was canceled by Apple customer support
 type CancellationDate struct {
-	Date    date    `json:"-"`
-	DateMS  dateMS  `json:"-"`
-	DatePST datePST `json:"-"`
+	Date    date    `json:"cancellation_date"`
+	DateMS  dateMS  `json:"cancellation_date_ms"`
+	DatePST datePST `json:"cancellation_date_pst"`
+}
+
+// GracePeriodExpiresDate is the date when the billing grace period for a subscription renewal expires
+type GracePeriodExpiresDate struct {
+	Date    date    `json:"grace_period_expires_date"`
+	DateMS  dateMS  `json:"grace_period_expires_date_ms"`
+	DatePST datePST `json:"grace_period_expires_date_pst"`
 }
@@ -1,27 +1,47 @@
 package receipt
 
 import (
+	"bytes"
+	"context"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
+	"strconv"
+	"sync"
 	"time"
 
 	_ "github.com/aktsk/nolmandy/statik" // Need to load assets
 	"github.com/fullsailor/pkcs7"
 	"github.com/guregu/null/v5"
 	"github.com/rakyll/statik/fs"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Result is the validation result
+// https://developer.apple.com/documentation/appstorereceipts/responsebody
 type Result struct {
-	Status            int      `json:"status"`
-	Environment       string   `json:"environment,omitempty"`
-	Receipt           *Receipt `json:"receipt,omitempty"`
-	LatestReceiptInfo []InApp  `json:"latest_receipt_info,omitempty"`
-	LatestReceipt     string   `json:"latest_receipt,omitempty"`
-	IsRetryable       bool     `json:"is-retryable,omitempty"`
+	Status             int                  `json:"status"`
+	Environment        string               `json:"environment,omitempty"`
+	Receipt            *Receipt             `json:"receipt,omitempty"`
+	LatestReceiptInfo  []InApp              `json:"latest_receipt_info,omitempty"`
+	LatestReceipt      string               `json:"latest_receipt,omitempty"`
+	PendingRenewalInfo []PendingRenewalInfo `json:"pending_renewal_info,omitempty"`
+	IsRetryable        bool                 `json:"is-retryable,omitempty"`
+
+	// Reason tells why nolmandy rejected the receipt by its policy. It is
+	// not a field of the App Store.
+	Reason string `json:"reason,omitempty"`
+
+	// Rules are the outcomes of triggered rules of Verifier
+	Rules []RuleOutcome `json:"rules,omitempty"`
+
+	// Extra holds JSON fields which are not modeled by Result
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 func GetAppleRootCert() (*x509.Certificate, error) {
@@ -59,50 +79,122 @@ func ParseWithAppleRootCert(data string) (*Receipt, error) {
 
 // Parse parsed base 64 encoded receipt data with a given certificate
 func Parse(root *x509.Certificate, data string) (*Receipt, error) {
-	receiptData, err := base64.StdEncoding.DecodeString(data)
-	if err != nil {
-		return nil, err
-	}
+	return ParseContext(context.Background(), root, data)
+}
 
-	pkcs, err := pkcs7.Parse(receiptData)
-	if err != nil {
-		return nil, err
-	}
+// PhaseObserver is called with the duration of each phase of parsing.
+// Phases are "base64", "pkcs7", "attributes", "chain" and "signature".
+type PhaseObserver func(phase string, d time.Duration)
 
-	if err := verifySignerCert(root, pkcs); err != nil {
-		return nil, err
-	}
+type phaseObserverKey struct{}
 
-	if err := pkcs.Verify(); err != nil {
-		return nil, err
-	}
+// WithPhaseObserver returns a context which makes ParseContext report the
+// duration of each phase to observer
+func WithPhaseObserver(ctx context.Context, observer PhaseObserver) context.Context {
+	return context.WithValue(ctx, phaseObserverKey{}, observer)
+}
+
+// ParseContext is the same as Parse, except that it reports the duration of
+// each phase to the PhaseObserver of ctx, and emits OpenTelemetry spans of the
+// phases as children of the span of ctx
+func ParseContext(ctx context.Context, root *x509.Certificate, data string) (*Receipt, error) {
+	return ParseWithRoots(ctx, data, func(string) []*x509.Certificate {
+		return []*x509.Certificate{root}
+	})
+}
 
-	receipt, err := parsePKCS(pkcs)
+// ParseWithRoots is the same as ParseContext, except that the receipt is
+// verified with the root certificates which roots returns for its bundle ID
+func ParseWithRoots(ctx context.Context, data string, roots func(bundleID string) []*x509.Certificate) (*Receipt, error) {
+	return parse(ctx, data, roots, nil)
+}
+
+// parse parses receipt data, and verifies it with roots and CRLs
+func parse(ctx context.Context, data string, roots func(bundleID string) []*x509.Certificate, crls []*x509.RevocationList) (*Receipt, error) {
+	ctx, span := tracer.Start(ctx, "receipt.Parse")
+	defer span.End()
+
+	var receiptData []byte
+	var pkcs *pkcs7.PKCS7
+	var receipt *Receipt
+
+	err := runPhases(ctx, []phase{
+		{"base64", func() (err error) {
+			receiptData, err = base64.StdEncoding.DecodeString(data)
+			return err
+		}},
+		{"pkcs7", func() (err error) {
+			pkcs, err = parsePKCS7(receiptData)
+			return err
+		}},
+		{"attributes", func() (err error) {
+			receipt, err = parsePKCS(pkcs)
+			return err
+		}},
+		{"chain", func() error {
+			return verifySignerCert(roots(receipt.BundleID), crls, pkcs)
+		}},
+		{"signature", func() error {
+			return pkcs.Verify()
+		}},
+	})
 	if err != nil {
+		recordError(span, err)
 		return nil, err
 	}
 
+	span.SetAttributes(receipt.traceAttributes()...)
+
 	return receipt, nil
 }
 
 // Validate is for validating receipt
 func (r *Receipt) Validate() (Result, error) {
+	return r.ValidateContext(context.Background())
+}
+
+// ValidateContext is the same as Validate, except that it emits an
+// OpenTelemetry span as a child of the span of ctx
+func (r *Receipt) ValidateContext(ctx context.Context) (Result, error) {
+	_, span := tracer.Start(ctx, "receipt.Validate", trace.WithAttributes(r.traceAttributes()...))
+	defer span.End()
+
 	return Result{
 		Status:      0,
-		Environment: "Sandbox",
+		Environment: r.Environment(),
 		Receipt:     r,
 	}, nil
 }
 
-func verifySignerCert(root *x509.Certificate, pkcs *pkcs7.PKCS7) error {
+// Environment returns "Production" for receipts of the App Store, and
+// "Sandbox" for the others
+func (r *Receipt) Environment() string {
+	switch r.ReceiptType {
+	case "Production", "ProductionVPP":
+		return "Production"
+	default:
+		return "Sandbox"
+	}
+}
+
+func verifySignerCert(rootCerts []*x509.Certificate, crls []*x509.RevocationList, pkcs *pkcs7.PKCS7) error {
+	if len(rootCerts) == 0 {
+		return errors.New("no trusted root certificate")
+	}
+
 	roots := x509.NewCertPool()
-	roots.AddCert(root)
+	for _, root := range rootCerts {
+		roots.AddCert(root)
+	}
 
 	signer := pkcs.GetOnlySigner()
+	if signer == nil {
+		return errors.New("receipt must have exactly one signer")
+	}
 
 	intermediates := x509.NewCertPool()
 	for _, cert := range pkcs.Certificates {
-		if cert != signer && !cert.Equal(root) {
+		if cert != signer && !isRoot(rootCerts, cert) {
 			intermediates.AddCert(cert)
 		}
 	}
@@ -116,7 +208,7 @@ func verifySignerCert(root *x509.Certificate, pkcs *pkcs7.PKCS7) error {
 		currentTime = time.Now()
 	}
 
-	_, err := signer.Verify(x509.VerifyOptions{
+	chains, err := signer.Verify(x509.VerifyOptions{
 		Intermediates: intermediates,
 		Roots:         roots,
 		CurrentTime:   currentTime,
@@ -126,23 +218,75 @@ func verifySignerCert(root *x509.Certificate, pkcs *pkcs7.PKCS7) error {
 		return err
 	}
 
+	for _, chain := range chains {
+		if err := checkRevocation(chain, crls); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// checkRevocation checks that certificates in a chain are not revoked by
+// CRLs of their issuers
+func checkRevocation(chain []*x509.Certificate, crls []*x509.RevocationList) error {
+	for i := 0; i < len(chain)-1; i++ {
+		cert, issuer := chain[i], chain[i+1]
+
+		for _, crl := range crls {
+			if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) || crl.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+
+			for _, entry := range crl.RevokedCertificateEntries {
+				if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return fmt.Errorf("certificate %s is revoked", cert.Subject)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func isRoot(roots []*x509.Certificate, cert *x509.Certificate) bool {
+	for _, root := range roots {
+		if cert.Equal(root) {
+			return true
+		}
+	}
+	return false
+}
+
 type attribute struct {
 	Type    int
 	Version int
 	Value   []byte
 }
 
+// pkcs7Mutex serializes pkcs7.Parse, whose BER decoding writes a package
+// variable of github.com/fullsailor/pkcs7 without synchronization
+var pkcs7Mutex sync.Mutex
+
+func parsePKCS7(data []byte) (*pkcs7.PKCS7, error) {
+	pkcs7Mutex.Lock()
+	defer pkcs7Mutex.Unlock()
+	return pkcs7.Parse(data)
+}
+
 func parsePKCS(pkcs *pkcs7.PKCS7) (*Receipt, error) {
+	return parsePayload(pkcs.Content)
+}
+
+func parsePayload(payload []byte) (*Receipt, error) {
 	var receipt Receipt
 
 	var r asn1.RawValue
-	_, err := asn1.Unmarshal(pkcs.Content, &r)
+	_, err := asn1.Unmarshal(payload, &r)
 	if err != nil {
 		return nil, err
 	}
+	receipt.attributesTag = r.Tag
 	rest := r.Bytes
 	for len(rest) > 0 {
 		var ra attribute
@@ -181,6 +325,8 @@ func parsePKCS(pkcs *pkcs7.PKCS7) (*Receipt, error) {
 				return nil, err
 			}
 			receipt.InApp = append(receipt.InApp, inApp)
+			// The value is encoded from the in-app purchase receipt
+			ra.Value = nil
 		case 19:
 			if _, err = asn1.Unmarshal(ra.Value, &receipt.OriginalApplicationVersion); err != nil {
 				return nil, err
@@ -190,7 +336,9 @@ func parsePKCS(pkcs *pkcs7.PKCS7) (*Receipt, error) {
 			if err != nil {
 				return nil, err
 			}
-			receipt.ExpirationDate = date(t)
+			receipt.ExpirationDate.Date = date(t)
+			receipt.ExpirationDate.DateMS = dateMS(t)
+			receipt.ExpirationDate.DatePST = datePST(t)
 
 		// Field types below are not listed in https://developer.apple.com/library/content/releasenotes/General/ValidateAppStoreReceipt/Chapters/ReceiptFields.html
 		case 0:
@@ -205,18 +353,27 @@ func parsePKCS(pkcs *pkcs7.PKCS7) (*Receipt, error) {
 			receipt.OriginalPurchaseDate.Date = date(t)
 			receipt.OriginalPurchaseDate.DateMS = dateMS(t)
 			receipt.OriginalPurchaseDate.DatePST = datePST(t)
+		default:
+			receipt.unknownAttributes = append(receipt.unknownAttributes, ra)
+			continue
 		}
+		receipt.knownAttributes = append(receipt.knownAttributes, ra)
 	}
 
-	loc, _ := time.LoadLocation("Etc/GMT")
-	now := time.Now().In(loc)
-	receipt.RequestDate.Date = date(null.TimeFrom(now))
-	receipt.RequestDate.DateMS = dateMS(null.TimeFrom(now))
-	receipt.RequestDate.DatePST = datePST(null.TimeFrom(now))
+	receipt.setRequestDate(time.Now())
 
 	return &receipt, nil
 }
 
+// setRequestDate sets the date when the verify request was issued
+func (r *Receipt) setRequestDate(now time.Time) {
+	loc, _ := time.LoadLocation("Etc/GMT")
+	now = now.In(loc)
+	r.RequestDate.Date = date(null.TimeFrom(now))
+	r.RequestDate.DateMS = dateMS(null.TimeFrom(now))
+	r.RequestDate.DatePST = datePST(null.TimeFrom(now))
+}
+
 func parseInApp(data []byte) (*InApp, error) {
 	var inApp InApp
 
@@ -225,6 +382,7 @@ func parseInApp(data []byte) (*InApp, error) {
 	if err != nil {
 		return nil, err
 	}
+	inApp.attributesTag = r.Tag
 	data = r.Bytes
 	for len(data) > 0 {
 		var ra attribute
@@ -271,6 +429,8 @@ func parseInApp(data []byte) (*InApp, error) {
 				return nil, err
 			}
 			inApp.ExpiresDate.Date = date(t)
+			inApp.ExpiresDate.DateMS = dateMS(t)
+			inApp.ExpiresDate.DatePST = datePST(t)
 		case 1711:
 			if _, err = asn1.Unmarshal(ra.Value, &inApp.WebOrderLineItemID); err != nil {
 				return nil, err
@@ -281,13 +441,29 @@ func parseInApp(data []byte) (*InApp, error) {
 				return nil, err
 			}
 			inApp.CancellationDate.Date = date(t)
+			inApp.CancellationDate.DateMS = dateMS(t)
+			inApp.CancellationDate.DatePST = datePST(t)
+		case 1713:
+			var trialPeriod int
+			if _, err = asn1.Unmarshal(ra.Value, &trialPeriod); err != nil {
+				return nil, err
+			}
+			inApp.IsTrialPeriod = strconv.FormatBool(trialPeriod != 0)
 		case 1719:
 			var introPrice int
 			if _, err = asn1.Unmarshal(ra.Value, &introPrice); err != nil {
 				return nil, err
 			}
 			inApp.IsInIntroPrice = (introPrice != 0)
+		case 1721:
+			if _, err = asn1.Unmarshal(ra.Value, &inApp.PromotionalOfferID); err != nil {
+				return nil, err
+			}
+		default:
+			inApp.unknownAttributes = append(inApp.unknownAttributes, ra)
+			continue
 		}
+		inApp.knownAttributes = append(inApp.knownAttributes, ra)
 	}
 
 	if inApp.IsTrialPeriod == "" {
@@ -1,12 +1,18 @@
 package receipt
 
 import (
+	"bytes"
+	"context"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/aktsk/nolmandy/catalog"
 	"github.com/guregu/null/v5"
 )
 
@@ -98,6 +104,113 @@ func TestParseAndValidate(t *testing.T) {
 	}
 }
 
+func TestParseContextObservesPhases(t *testing.T) {
+	certDER, _ := pem.Decode([]byte(certificate))
+	cert, err := x509.ParseCertificate(certDER.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var phases []string
+	ctx := WithPhaseObserver(context.Background(), func(phase string, d time.Duration) {
+		phases = append(phases, phase)
+	})
+
+	if _, err := ParseContext(ctx, cert, receiptData); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"base64", "pkcs7", "attributes", "chain", "signature"}
+	if !reflect.DeepEqual(phases, expected) {
+		t.Fatalf("Wrong phases: %v", phases)
+	}
+
+	phases = nil
+	if _, err := ParseContext(ctx, cert, "invalid receipt"); err == nil {
+		t.Fatal("Invalid receipt should not be parsed")
+	}
+
+	if !reflect.DeepEqual(phases, []string{"base64"}) {
+		t.Fatalf("Wrong phases: %v", phases)
+	}
+}
+
+func TestParseBatch(t *testing.T) {
+	certDER, _ := pem.Decode([]byte(certificate))
+	cert, err := x509.ParseCertificate(certDER.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []string{receiptData, "invalid receipt", receiptData, receiptData}
+
+	receipts, errs := ParseBatch(context.Background(), cert, data, 2)
+	if len(receipts) != len(data) || len(errs) != len(data) {
+		t.Fatalf("Wrong number of results: %d, %d", len(receipts), len(errs))
+	}
+
+	for i := range data {
+		if (i == 1) != (errs[i] != nil) || (i == 1) != (receipts[i] == nil) {
+			t.Fatalf("Wrong result %d: %v, %v", i, receipts[i], errs[i])
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, errs := ParseBatch(ctx, cert, data, 2); !errors.Is(errs[3], context.Canceled) {
+		t.Fatalf("Receipts should not be parsed after cancel: %v", errs[3])
+	}
+}
+
+func TestResultShape(t *testing.T) {
+	c := catalog.New(
+		&catalog.Product{ID: "coins", Type: catalog.Consumable},
+		&catalog.Product{ID: "no_ads", Type: catalog.NonConsumable},
+		&catalog.Product{ID: "monthly", Type: catalog.AutoRenewable, SubscriptionGroup: "21432517"},
+	)
+
+	var result Result
+	err := json.Unmarshal([]byte(`{"status": 0, "receipt": {"in_app": [
+		{"product_id": "coins", "transaction_id": "1", "purchase_date": "2024-01-01 00:00:00 Etc/GMT"},
+		{"product_id": "monthly", "transaction_id": "2", "purchase_date": "2024-02-01 00:00:00 Etc/GMT"},
+		{"product_id": "no_ads", "transaction_id": "3", "purchase_date": "2024-03-01 00:00:00 Etc/GMT"}
+	]}}`), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result.Shape(c)
+
+	if group := result.Receipt.InApp[1].SubscriptionGroupIdentifier; group != "21432517" {
+		t.Fatalf("Wrong subscription_group_identifier: %s", group)
+	}
+
+	var transactions []string
+	for _, inApp := range result.LatestReceiptInfo {
+		transactions = append(transactions, inApp.TransactionID)
+	}
+	if !reflect.DeepEqual(transactions, []string{"3", "2"}) {
+		t.Fatalf("Wrong latest_receipt_info: %v", transactions)
+	}
+
+	// Consumables are left in the receipt
+	if len(result.Receipt.InApp) != 3 || result.Receipt.InApp[0].ProductID != "coins" {
+		t.Fatalf("in_app of the receipt should be left: %+v", result.Receipt.InApp)
+	}
+
+	result.Shape(c)
+	if len(result.LatestReceiptInfo) != 2 {
+		t.Fatalf("Shape should be idempotent: %d", len(result.LatestReceiptInfo))
+	}
+
+	result = Result{Receipt: &Receipt{InApp: []*InApp{{ProductID: "coins"}}}}
+	result.Shape(c)
+	if result.LatestReceiptInfo != nil {
+		t.Fatalf("latest_receipt_info should be only for receipts with subscriptions: %v", result.LatestReceiptInfo)
+	}
+}
+
 func TestMarshalAndUnmarshalDate(t *testing.T) {
 	date1 := date{}
 
@@ -120,6 +233,71 @@ func TestMarshalAndUnmarshalDate(t *testing.T) {
 	}
 }
 
+func TestMarshalASN1(t *testing.T) {
+	certDER, _ := pem.Decode([]byte(certificate))
+	cert, err := x509.ParseCertificate(certDER.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rcpt, err := Parse(cert, receiptData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := base64.StdEncoding.DecodeString(receiptData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs, err := parsePKCS7(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, err := rcpt.MarshalASN1()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(original, pkcs.Content) {
+		t.Fatal("Marshaling a parsed receipt should give the original payload")
+	}
+
+	// Attributes unknown to nolmandy must survive marshaling
+	rcpt.unknownAttributes = append(rcpt.unknownAttributes, attribute{Type: 1, Version: 1, Value: []byte{0x02, 0x01, 0x05}})
+	rcpt.InApp[0].unknownAttributes = append(rcpt.InApp[0].unknownAttributes, attribute{Type: 1720, Version: 1, Value: []byte{0x02, 0x01, 0x01}})
+
+	payload, err := rcpt.MarshalASN1()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reparsed, err := parsePayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reparsed.InApp) != len(rcpt.InApp) {
+		t.Fatalf("Wrong number of in_app: %d", len(reparsed.InApp))
+	}
+
+	// The request date is set when parsing
+	rcpt.RequestDate, reparsed.RequestDate = RequestDate{}, RequestDate{}
+
+	if !reflect.DeepEqual(rcpt, reparsed) {
+		t.Fatalf("Receipt is not the same after marshaling:\n%+v\n%+v", rcpt, reparsed)
+	}
+
+	remarshaled, err := reparsed.MarshalASN1()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(payload, remarshaled) {
+		t.Fatal("Marshaling a reparsed receipt should give the same payload")
+	}
+}
+
 var receiptData = `
 MIIHeQYJKoZIhvcNAQcCoIIHajCCB2YCAQExCTAHBgUrDgMCGjCCBDYGCSqGSIb3DQEHAaCCBCcEggQjMIIEHzAbAgEAAgEABBMTEVByb2R1Y3Rpb25TYW5kYm94MCACAQICAQAEGBMWanAuYWt0c2sua2FsdmFkb3MudGVzdDAeAgEMAgEABBYTFDIwMTgtMDItMTBUMTc6Mzc6MDBaMIIBIgIBEQIBAASCARgwggEUMAwCAgalAgEABAMCAQAwJgICBqYCAQAEHRMbanAuYWt0c2sua2FsdmFkb3MudGVzdC5pYXAwMBoCAganAgEABBETDzIyMDAwMDM1MDcyOTk3MDAfAgIGqAIBAAQWExQyMDE3LTA3LTI0VDAzOjE3OjE1WjAaAgIGqQIBAAQREw8yMjAwMDAzNDg3ODg1NTcwHwICBqoCAQAEFhMUMjAxNy0wNy0xN1QwMzoxNzoxNlowHwICBqwCAQAEFhMUMDAwMS0wMS0wMVQwMDowMDowMFowEgICBq8CAQAECQIHAMgWwiK7SzAfAgIGsAIBAAQWExQwMDAxLTAxLTAxVDAwOjAwOjAwWjAMAgIGtwIBAAQDAgEAMIIBIgIBEQIBAASCARgwggEUMAwCAgalAgEABAMCAQEwJgICBqYCAQAEHRMbanAuYWt0c2sua2FsdmFkb3MudGVzdC5pYXAxMBoCAganAgEABBETDzIyMDAwMDM1OTg5Mzk3OTAfAgIGqAIBAAQWExQyMDE3LTA4LTI0VDAzOjE3OjE1WjAaAgIGqQIBAAQREw8yMjAwMDAzNDg3ODg1NTcwHwICBqoCAQAEFhMUMjAxNy0wNy0xN1QwMzoxNzoxNlowHwICBqwCAQAEFhMUMDAwMS0wMS0wMVQwMDowMDowMFowEgICBq8CAQAECQIHAMgWwi1WEjAfAgIGsAIBAAQWExQwMDAxLTAxLTAxVDAwOjAwOjAwWjAMAgIGtwIBAAQDAgEAMIIBIgIBEQIBAASCARgwggEUMAwCAgalAgEABAMCAQIwJgICBqYCAQAEHRMbanAuYWt0c2sua2FsdmFkb3MudGVzdC5pYXAyMBoCAganAgEABBETDzIyMDAwMDM2ODkzMjU1ODAfAgIGqAIBAAQWExQyMDE3LTA5LTI0VDAzOjE3OjE1WjAaAgIGqQIBAAQREw8yMjAwMDAzNDg3ODg1NTcwHwICBqoCAQAEFhMUMjAxNy0wNy0xN1QwMzoxNzoxNlowHwICBqwCAQAEFhMUMDAwMS0wMS0wMVQwMDowMDowMFowEgICBq8CAQAECQIHAMgWwl6wVzAfAgIGsAIBAAQWExQwMDAxLTAxLTAxVDAwOjAwOjAwWjAMAgIGtwIBAAQDAgEAMB4CARICAQAEFhMUMjAxNy0wNy0wN1QxNTozNjowN1owDAIBEwIBAAQEEwI0OTAeAgEVAgEABBYTFDAwMDEtMDEtMDFUMDA6MDA6MDBaoIIB4TCCAd0wggFGoAMCAQICBHKLbMIwDQYJKoZIhvcNAQELBQAwKDEQMA4GA1UEChMHQWNtZSBDbzEUMBIGA1UEAxMLVGVzdCBJc3N1ZXIwIBcNMTgwNDAyMDQwNjI5WhgPMzg0MzA0MDIwNDA2MjlaMCgxEDAOBgNVBAoTB0FjbWUgQ28xFDASBgNVBAMTC1Rlc3QgSXNzdWVyMIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDG/PY5C0Q47ndl7bWKF7HFghkygK/k2L+3cJO2F6mm7+G4R+V9ebG4PXKeVFmc7u8oKF+Pjf+PAGvwGUofKaUGWKWu98YplHrBfFvmQ13jrHsaD7kclypbY11/3i5JQZXVQQfFnsoqeFoZhkwoLk1FuXhT7bHiBAR8baNdoweoJwIDAQABoxIwEDAOBgNVHQ8BAf8EBAMCAqQwDQYJKoZIhvcNAQELBQADgYEAvmm1BpEjQuZ+q+E42wqwB2XBSNMgnCt/H0toPXO5W1XL5bTaMdkli/aMo8m3c5tYmaFbbB17kPESrM3VSgoezdUVDhg4LbsHz9l5ygiqD1vVXyymfmOGJ6LhGQVI7Et/XYCwthCeunt5Fnwq0ehzbElsBNAN5lZ3zVMC74LR/0ExggE1MIIBMQIBATAwMCgxEDAOBgNVBAoTB0FjbWUgQ28xFDASBgNVBAMTC1Rlc3QgSXNzdWVyAgRyi2zCMAcGBSsOAwIaoGEwGAYJKoZIhvcNAQkDMQsGCSqGSIb3DQEHATAgBgkqhkiG9w0BCQUxExcRMTgwNDAyMTMwNjI5KzA5MDAwIwYJKoZIhvcNAQkEMRYEFI+RZrTxDq+AjJKnEVX7TlsKhbHEMAsGCSqGSIb3DQEBBQSBgBbpUdEISumlE740mmdW0RIMa8otvs2Fwe2eNnSMmYgZGjMcOrB1luCLIwJeoqi+3CgSnauXZQvXXZL52brBPT5fTiwdFGhZGCzhsiq7cZJA0//vWF4mqwRmj/t1xy329ElWAwbtTZkBQ1nivyKVJH/IGbnPr51FAZ5JEm5xntGf`
 
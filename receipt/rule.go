@@ -0,0 +1,172 @@
+package receipt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/guregu/null/v5"
+)
+
+// StatusRejectedByRule is the status for receipts which are rejected by a
+// rule of Verifier
+const StatusRejectedByRule = 21303
+
+// Severities of rules
+const (
+	SeverityReject = "reject"
+	SeverityWarn   = "warn"
+)
+
+// Rule is a validation rule written in the expression language of
+// github.com/expr-lang/expr. A rule is triggered when its expression is true.
+// Expressions refer to Receipt, InApp, Environment and Now, for example:
+//
+//	Now - Receipt.CreationDate > duration("720h")
+//	Environment != "Production"
+//	len(uniq(map(InApp, .TransactionID))) != len(InApp)
+type Rule struct {
+	Name string
+
+	// Severity is SeverityReject or SeverityWarn
+	Severity string
+
+	// Message tells why the rule is triggered. Name is used when Message is
+	// empty.
+	Message string
+
+	program *vm.Program
+}
+
+// RuleOutcome is the outcome of a triggered rule
+type RuleOutcome struct {
+	Name     string `json:"name"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+
+	// Error is set when the rule could not be evaluated. Rules which could
+	// not be evaluated are regarded as triggered.
+	Error string `json:"error,omitempty"`
+}
+
+// ruleEnv is the environment of rule expressions
+type ruleEnv struct {
+	Receipt     ruleReceipt
+	InApp       []ruleInApp
+	Environment string
+	Now         time.Time
+}
+
+type ruleReceipt struct {
+	ReceiptType                string
+	BundleID                   string
+	ApplicationVersion         string
+	OriginalApplicationVersion string
+	CreationDate               time.Time
+	OriginalPurchaseDate       time.Time
+	ExpirationDate             time.Time
+	InApp                      []ruleInApp
+}
+
+type ruleInApp struct {
+	ProductID             string
+	TransactionID         string
+	OriginalTransactionID string
+	Quantity              int64
+	IsTrialPeriod         bool
+	IsInIntroPrice        bool
+	PurchaseDate          time.Time
+	OriginalPurchaseDate  time.Time
+	ExpiresDate           time.Time
+	CancellationDate      time.Time
+	WebOrderLineItemID    int64
+	InAppOwnershipType    string
+}
+
+// NewRule compiles the expression of a rule
+func NewRule(name, expression, severity, message string) (*Rule, error) {
+	switch severity {
+	case SeverityReject, SeverityWarn:
+	default:
+		return nil, fmt.Errorf("rule %s: unknown severity: %s", name, severity)
+	}
+
+	program, err := expr.Compile(expression, expr.Env(ruleEnv{}), expr.AsBool())
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", name, err)
+	}
+
+	if message == "" {
+		message = name
+	}
+
+	return &Rule{Name: name, Severity: severity, Message: message, program: program}, nil
+}
+
+// evaluateRules returns the outcomes of triggered rules, and whether any of
+// them rejects the receipt
+func evaluateRules(rules []*Rule, rcpt *Receipt, now time.Time) ([]RuleOutcome, bool) {
+	if len(rules) == 0 {
+		return nil, false
+	}
+
+	env := newRuleEnv(rcpt, now)
+
+	var outcomes []RuleOutcome
+	rejected := false
+
+	for _, rule := range rules {
+		outcome := RuleOutcome{Name: rule.Name, Severity: rule.Severity, Message: rule.Message}
+
+		triggered, err := expr.Run(rule.program, env)
+		if err != nil {
+			outcome.Error = err.Error()
+		} else if triggered != true {
+			continue
+		}
+
+		outcomes = append(outcomes, outcome)
+		if rule.Severity == SeverityReject {
+			rejected = true
+		}
+	}
+
+	return outcomes, rejected
+}
+
+func newRuleEnv(rcpt *Receipt, now time.Time) ruleEnv {
+	inApp := make([]ruleInApp, 0, len(rcpt.InApp))
+	for _, i := range rcpt.InApp {
+		inApp = append(inApp, ruleInApp{
+			ProductID:             i.ProductID,
+			TransactionID:         i.TransactionID,
+			OriginalTransactionID: i.OriginalTransactionID,
+			Quantity:              i.Quantity,
+			IsTrialPeriod:         i.IsTrialPeriod == "true",
+			IsInIntroPrice:        i.IsInIntroPrice,
+			PurchaseDate:          null.Time(i.PurchaseDate.Date).Time,
+			OriginalPurchaseDate:  null.Time(i.OriginalPurchaseDate.Date).Time,
+			ExpiresDate:           null.Time(i.ExpiresDate.Date).Time,
+			CancellationDate:      null.Time(i.CancellationDate.Date).Time,
+			WebOrderLineItemID:    i.WebOrderLineItemID,
+			InAppOwnershipType:    i.InAppOwnershipType,
+		})
+	}
+
+	return ruleEnv{
+		Receipt: ruleReceipt{
+			ReceiptType:                rcpt.ReceiptType,
+			BundleID:                   rcpt.BundleID,
+			ApplicationVersion:         rcpt.ApplicationVersion,
+			OriginalApplicationVersion: rcpt.OriginalApplicationVersion,
+			CreationDate:               null.Time(rcpt.CreationDate.Date).Time,
+			OriginalPurchaseDate:       null.Time(rcpt.OriginalPurchaseDate.Date).Time,
+			ExpirationDate:             null.Time(rcpt.ExpirationDate.Date).Time,
+			InApp:                      inApp,
+		},
+		InApp:       inApp,
+		Environment: rcpt.Environment(),
+		Now:         now,
+	}
+}
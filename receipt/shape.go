@@ -0,0 +1,59 @@
+package receipt
+
+import (
+	"sort"
+
+	"github.com/aktsk/nolmandy/catalog"
+	"github.com/guregu/null/v5"
+)
+
+// Shape shapes a result with a product catalog, like the App Store does.
+// Subscription group identifiers of auto-renewable subscriptions are filled.
+// When the receipt has auto-renewable subscriptions and the result has no
+// latest receipt info, it is made of the in-app purchases except consumables,
+// which are finished when they are not in the receipt any more. The most
+// recent purchase comes first. The in-app purchases of the receipt are left
+// as they are, with consumables, since the receipt has consumables until they
+// are finished.
+func (r *Result) Shape(c *catalog.Catalog) {
+	if c == nil || r.Receipt == nil {
+		return
+	}
+
+	hasSubscriptions := false
+	for _, inApp := range r.Receipt.InApp {
+		if p := c.Product(inApp.ProductID); p != nil && p.Type == catalog.AutoRenewable {
+			hasSubscriptions = true
+		}
+		shapeInApp(c, inApp)
+	}
+
+	for i := range r.LatestReceiptInfo {
+		shapeInApp(c, &r.LatestReceiptInfo[i])
+	}
+
+	if !hasSubscriptions || len(r.LatestReceiptInfo) > 0 {
+		return
+	}
+
+	for _, inApp := range r.Receipt.InApp {
+		if p := c.Product(inApp.ProductID); p == nil || p.Type != catalog.Consumable {
+			r.LatestReceiptInfo = append(r.LatestReceiptInfo, *inApp)
+		}
+	}
+
+	sort.SliceStable(r.LatestReceiptInfo, func(i, j int) bool {
+		return null.Time(r.LatestReceiptInfo[i].PurchaseDate.Date).Time.After(null.Time(r.LatestReceiptInfo[j].PurchaseDate.Date).Time)
+	})
+}
+
+func shapeInApp(c *catalog.Catalog, inApp *InApp) {
+	p := c.Product(inApp.ProductID)
+	if p == nil || p.Type != catalog.AutoRenewable {
+		return
+	}
+
+	if inApp.SubscriptionGroupIdentifier == "" {
+		inApp.SubscriptionGroupIdentifier = p.SubscriptionGroup
+	}
+}
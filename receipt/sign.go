@@ -0,0 +1,40 @@
+package receipt
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+
+	"github.com/fullsailor/pkcs7"
+)
+
+// Sign encodes the receipt and signs it with a given certificate and private
+// key. The certificates in chain are embedded to let verifiers build a chain to
+// their root certificate. It returns base 64 encoded receipt data, which can be
+// parsed by Parse with the root certificate of the chain.
+func (r *Receipt) Sign(cert *x509.Certificate, key crypto.PrivateKey, chain []*x509.Certificate) (string, error) {
+	payload, err := r.MarshalASN1()
+	if err != nil {
+		return "", err
+	}
+
+	signedData, err := pkcs7.NewSignedData(payload)
+	if err != nil {
+		return "", err
+	}
+
+	if err := signedData.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		return "", err
+	}
+
+	for _, c := range chain {
+		signedData.AddCertificate(c)
+	}
+
+	signed, err := signedData.Finish()
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(signed), nil
+}
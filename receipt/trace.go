@@ -0,0 +1,59 @@
+package receipt
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	attr "go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/aktsk/nolmandy/receipt")
+
+// phase is a phase of parsing, which is observed and traced
+type phase struct {
+	name string
+	run  func() error
+}
+
+// runPhases runs phases in order until one of them fails
+func runPhases(ctx context.Context, phases []phase) error {
+	observe, _ := ctx.Value(phaseObserverKey{}).(PhaseObserver)
+
+	for _, p := range phases {
+		_, span := tracer.Start(ctx, "receipt.Parse."+p.name)
+		start := time.Now()
+
+		err := p.run()
+
+		if observe != nil {
+			observe(p.name, time.Since(start))
+		}
+		recordError(span, err)
+		span.End()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recordError records err to a span when err is not nil
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+func (r *Receipt) traceAttributes() []attr.KeyValue {
+	return []attr.KeyValue{
+		attr.String("receipt.bundle_id", r.BundleID),
+		attr.String("receipt.receipt_type", r.ReceiptType),
+		attr.Int("receipt.in_app_count", len(r.InApp)),
+	}
+}
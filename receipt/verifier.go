@@ -0,0 +1,257 @@
+package receipt
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/aktsk/nolmandy/catalog"
+)
+
+// Statuses for receipts which are rejected by the policy of Verifier
+const (
+	// StatusBundleIDNotAllowed is the status for receipts of apps which are
+	// not allowed
+	StatusBundleIDNotAllowed = 21300
+
+	// StatusApplicationVersionNotAllowed is the status for receipts of
+	// application versions which are not allowed for the app
+	StatusApplicationVersionNotAllowed = 21301
+
+	// StatusOriginalApplicationVersionNotAllowed is the status for receipts
+	// of original application versions which are not allowed for the app
+	StatusOriginalApplicationVersionNotAllowed = 21302
+)
+
+// App is the settings of an app to verify its receipts
+type App struct {
+	// SharedSecret is the app-specific shared secret. Requests must have
+	// the same password when SharedSecret is not empty.
+	SharedSecret string
+
+	// Environments are the allowed environments, "Production" and
+	// "Sandbox". All environments are allowed when Environments is empty.
+	Environments []string
+
+	// ApplicationVersions are the allowed application versions, which are
+	// versions or ranges such as ">=1.2, <2.0" (see VersionRange). All
+	// versions are allowed when ApplicationVersions is empty.
+	ApplicationVersions []string
+
+	// OriginalApplicationVersions are the allowed original application
+	// versions, in the same format as ApplicationVersions
+	OriginalApplicationVersions []string
+
+	// Roots are the trusted root certificates of the app. Verifier.Roots
+	// are used when Roots is empty.
+	Roots []*x509.Certificate
+
+	// Rules are evaluated for receipts of the app after Verifier.Rules
+	Rules []*Rule
+}
+
+// Verifier parses and validates receipts with per-app settings
+type Verifier struct {
+	// Roots are the trusted root certificates. Apple Inc Root Certificate is
+	// used when Roots is empty.
+	Roots []*x509.Certificate
+
+	// Apps are the settings of apps by bundle ID. Receipts of apps which
+	// are not in Apps are verified with Roots.
+	Apps map[string]*App
+
+	// AllowedBundleIDs are patterns of bundle IDs allowed in addition to
+	// Apps, such as "com.example.*" (see path.Match). When AllowedBundleIDs
+	// is not empty or RejectUnknownApps is true, receipts of other apps are
+	// rejected with StatusBundleIDNotAllowed.
+	AllowedBundleIDs []string
+
+	// RejectUnknownApps rejects receipts of apps which are neither in Apps
+	// nor AllowedBundleIDs
+	RejectUnknownApps bool
+
+	// Rules are evaluated for all receipts which are accepted by the other
+	// settings. Outcomes of triggered rules are included in the result.
+	Rules []*Rule
+
+	// Catalog shapes results by Result.Shape when it is not nil
+	Catalog *catalog.Catalog
+
+	// CRLs are certificate revocation lists. Receipts signed by revoked
+	// certificates are rejected.
+	CRLs []*x509.RevocationList
+
+	// Cache keeps verified receipts when it is not nil, so that receipts
+	// which are sent again are not verified again. Settings other than the
+	// certificates and CRLs are applied to cached receipts.
+	Cache *Cache
+}
+
+// Verify parses and validates base 64 encoded receipt data with a password
+// of a verifyReceipt request. The status of the result is not 0 when the
+// receipt is rejected, and err tells why.
+func (v *Verifier) Verify(ctx context.Context, data string, password string) (Result, error) {
+	roots, err := v.roots()
+	if err != nil {
+		return Result{Status: 21100, IsRetryable: true}, err
+	}
+
+	rcpt, err := v.parse(ctx, data, roots)
+	if err != nil {
+		return Result{Status: 21002}, err
+	}
+
+	if !v.bundleIDAllowed(rcpt.BundleID) {
+		err := fmt.Errorf("bundle ID %s is not allowed", rcpt.BundleID)
+		return Result{Status: StatusBundleIDNotAllowed, Reason: err.Error()}, err
+	}
+
+	rules := v.Rules
+	if app := v.Apps[rcpt.BundleID]; app != nil {
+		if result, err := app.check(rcpt, password); err != nil {
+			result.Reason = err.Error()
+			return result, err
+		}
+		rules = append(rules[:len(rules):len(rules)], app.Rules...)
+	}
+
+	result, err := rcpt.ValidateContext(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	outcomes, rejected := evaluateRules(rules, rcpt, time.Now())
+	if rejected {
+		for _, outcome := range outcomes {
+			if outcome.Severity == SeverityReject {
+				err := fmt.Errorf("rejected by rule %s: %s", outcome.Name, outcome.Message)
+				return Result{Status: StatusRejectedByRule, Environment: result.Environment, Reason: outcome.Message, Rules: outcomes}, err
+			}
+		}
+	}
+	result.Rules = outcomes
+	result.Shape(v.Catalog)
+
+	return result, nil
+}
+
+// parse parses and verifies receipt data, or returns a copy of the receipt
+// in the cache
+func (v *Verifier) parse(ctx context.Context, data string, roots []*x509.Certificate) (*Receipt, error) {
+	var key [sha256.Size]byte
+	cacheable := false
+	if v.Cache != nil {
+		if key, cacheable = v.cacheKey(data, roots); cacheable {
+			if rcpt, ok := v.Cache.get(key, time.Now()); ok {
+				return rcpt, nil
+			}
+		}
+	}
+
+	rcpt, err := parse(ctx, data, func(bundleID string) []*x509.Certificate {
+		if app := v.Apps[bundleID]; app != nil && len(app.Roots) > 0 {
+			return app.Roots
+		}
+		return roots
+	}, v.CRLs)
+	if err != nil {
+		return nil, err
+	}
+
+	if cacheable {
+		v.Cache.add(key, rcpt, time.Now())
+	}
+
+	return rcpt, nil
+}
+
+// Certificates returns all trusted root certificates
+func (v *Verifier) Certificates() ([]*x509.Certificate, error) {
+	roots, err := v.roots()
+	if err != nil {
+		return nil, err
+	}
+
+	certs := append([]*x509.Certificate{}, roots...)
+	for _, app := range v.Apps {
+		certs = append(certs, app.Roots...)
+	}
+
+	return certs, nil
+}
+
+func (v *Verifier) roots() ([]*x509.Certificate, error) {
+	if len(v.Roots) > 0 {
+		return v.Roots, nil
+	}
+
+	root, err := GetAppleRootCert()
+	if err != nil {
+		return nil, err
+	}
+
+	return []*x509.Certificate{root}, nil
+}
+
+func (v *Verifier) bundleIDAllowed(bundleID string) bool {
+	if len(v.AllowedBundleIDs) == 0 && !v.RejectUnknownApps {
+		return true
+	}
+
+	if v.Apps[bundleID] != nil {
+		return true
+	}
+
+	for _, pattern := range v.AllowedBundleIDs {
+		if ok, _ := path.Match(pattern, bundleID); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check checks a receipt with the settings of the app
+func (a *App) check(rcpt *Receipt, password string) (Result, error) {
+	if a.SharedSecret != "" && subtle.ConstantTimeCompare([]byte(a.SharedSecret), []byte(password)) != 1 {
+		return Result{Status: 21004}, fmt.Errorf("shared secret of %s does not match", rcpt.BundleID)
+	}
+
+	if env := rcpt.Environment(); !allowed(a.Environments, env) {
+		// Same as the App Store, which responds with 21007 to sandbox
+		// receipts and with 21008 to production receipts
+		status := 21007
+		if env == "Production" {
+			status = 21008
+		}
+		return Result{Status: status, Environment: env}, fmt.Errorf("%s environment is not allowed for %s", env, rcpt.BundleID)
+	}
+
+	if !versionAllowed(a.ApplicationVersions, rcpt.ApplicationVersion) {
+		return Result{Status: StatusApplicationVersionNotAllowed}, fmt.Errorf("application version %s is not allowed for %s", rcpt.ApplicationVersion, rcpt.BundleID)
+	}
+
+	if !versionAllowed(a.OriginalApplicationVersions, rcpt.OriginalApplicationVersion) {
+		return Result{Status: StatusOriginalApplicationVersionNotAllowed}, fmt.Errorf("original application version %s is not allowed for %s", rcpt.OriginalApplicationVersion, rcpt.BundleID)
+	}
+
+	return Result{}, nil
+}
+
+func allowed(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,481 @@
+package receipt
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/guregu/null/v5"
+)
+
+func TestVerifier(t *testing.T) {
+	cert, key := generateCertificate(t)
+	otherCert, _ := generateCertificate(t)
+
+	rcpt := &Receipt{
+		ReceiptType:                "ProductionSandbox",
+		BundleID:                   "com.example.app",
+		ApplicationVersion:         "2",
+		OriginalApplicationVersion: "1.5",
+	}
+
+	data, err := rcpt.Sign(cert, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		v      *Verifier
+		secret string
+		status int
+	}{
+		{"no apps", &Verifier{Roots: []*x509.Certificate{cert}}, "", 0},
+		{"untrusted root", &Verifier{Roots: []*x509.Certificate{otherCert}}, "", 21002},
+		{"app roots", &Verifier{
+			Roots: []*x509.Certificate{otherCert},
+			Apps:  map[string]*App{"com.example.app": {Roots: []*x509.Certificate{cert}}},
+		}, "", 0},
+		{"roots of other app", &Verifier{
+			Roots: []*x509.Certificate{otherCert},
+			Apps:  map[string]*App{"com.example.other": {Roots: []*x509.Certificate{cert}}},
+		}, "", 21002},
+		{"shared secret", &Verifier{
+			Roots: []*x509.Certificate{cert},
+			Apps:  map[string]*App{"com.example.app": {SharedSecret: "secret"}},
+		}, "secret", 0},
+		{"wrong shared secret", &Verifier{
+			Roots: []*x509.Certificate{cert},
+			Apps:  map[string]*App{"com.example.app": {SharedSecret: "secret"}},
+		}, "wrong", 21004},
+		{"sandbox is not allowed", &Verifier{
+			Roots: []*x509.Certificate{cert},
+			Apps:  map[string]*App{"com.example.app": {Environments: []string{"Production"}}},
+		}, "", 21007},
+		{"application version", &Verifier{
+			Roots: []*x509.Certificate{cert},
+			Apps:  map[string]*App{"com.example.app": {ApplicationVersions: []string{"1", "2"}}},
+		}, "", 0},
+		{"application version is not allowed", &Verifier{
+			Roots: []*x509.Certificate{cert},
+			Apps:  map[string]*App{"com.example.app": {ApplicationVersions: []string{"1"}}},
+		}, "", StatusApplicationVersionNotAllowed},
+		{"application version range", &Verifier{
+			Roots: []*x509.Certificate{cert},
+			Apps:  map[string]*App{"com.example.app": {ApplicationVersions: []string{">=1.10, <3"}}},
+		}, "", 0},
+		{"application version is out of range", &Verifier{
+			Roots: []*x509.Certificate{cert},
+			Apps:  map[string]*App{"com.example.app": {ApplicationVersions: []string{">=2.1"}}},
+		}, "", StatusApplicationVersionNotAllowed},
+		{"original application version is out of range", &Verifier{
+			Roots: []*x509.Certificate{cert},
+			Apps:  map[string]*App{"com.example.app": {OriginalApplicationVersions: []string{">=1.10"}}},
+		}, "", StatusOriginalApplicationVersionNotAllowed},
+		{"allowed bundle ID", &Verifier{
+			Roots:            []*x509.Certificate{cert},
+			AllowedBundleIDs: []string{"com.example.*"},
+		}, "", 0},
+		{"bundle ID is not allowed", &Verifier{
+			Roots:            []*x509.Certificate{cert},
+			AllowedBundleIDs: []string{"com.example.other*"},
+		}, "", StatusBundleIDNotAllowed},
+		{"known app", &Verifier{
+			Roots:             []*x509.Certificate{cert},
+			Apps:              map[string]*App{"com.example.app": {}},
+			RejectUnknownApps: true,
+		}, "", 0},
+		{"unknown app", &Verifier{
+			Roots:             []*x509.Certificate{cert},
+			Apps:              map[string]*App{"com.example.other": {}},
+			RejectUnknownApps: true,
+		}, "", StatusBundleIDNotAllowed},
+	}
+
+	for _, test := range tests {
+		result, err := test.v.Verify(context.Background(), data, test.secret)
+
+		if result.Status != test.status {
+			t.Fatalf("Status for %s should be %d, not %d: %v", test.name, test.status, result.Status, err)
+		}
+
+		if (err == nil) != (test.status == 0) {
+			t.Fatalf("Wrong error for %s: %v", test.name, err)
+		}
+
+		if test.status != 0 && test.status != 21002 && result.Reason == "" {
+			t.Fatalf("Wrong reason for %s: %q", test.name, result.Reason)
+		}
+
+		if test.status == 0 && result.Environment != "Sandbox" {
+			t.Fatalf("Wrong environment for %s: %s", test.name, result.Environment)
+		}
+	}
+}
+
+func TestVersionRange(t *testing.T) {
+	tests := []struct {
+		r       string
+		version string
+		ok      bool
+	}{
+		{"1.0", "1", true},
+		{"1.0", "1.0.1", false},
+		{">=1.2, <2.0", "1.10", true},
+		{">=1.2, <2.0", "1.1", false},
+		{">=1.2, <2.0", "2.0.0", false},
+		{"!= 1.5", "1.5", false},
+		{"> 1.0b", "1.0c", true},
+	}
+
+	for _, test := range tests {
+		r, err := ParseVersionRange(test.r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Contains(test.version) != test.ok {
+			t.Fatalf("Wrong result of %q for %s", test.r, test.version)
+		}
+	}
+
+	for _, s := range []string{"", ">=", "1.0, "} {
+		if _, err := ParseVersionRange(s); err == nil {
+			t.Fatalf("Version range should be invalid: %q", s)
+		}
+	}
+}
+
+func TestVerifierWithCRL(t *testing.T) {
+	ca, caKey := createCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(72 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+
+	signer, key := createCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test Signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(48 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, ca, caKey)
+
+	data, err := (&Receipt{BundleID: "com.example.app"}).Sign(signer, key, []*x509.Certificate{ca})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number: big.NewInt(1),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: signer.SerialNumber, RevocationTime: time.Now()},
+		},
+	}, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crl, err := x509.ParseRevocationList(crlDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := &Verifier{Roots: []*x509.Certificate{ca}}
+	if result, err := v.Verify(context.Background(), data, ""); result.Status != 0 {
+		t.Fatalf("Status should be 0, not %d: %v", result.Status, err)
+	}
+
+	v.CRLs = []*x509.RevocationList{crl}
+	if result, _ := v.Verify(context.Background(), data, ""); result.Status != 21002 {
+		t.Fatalf("Status should be 21002, not %d", result.Status)
+	}
+}
+
+func TestVerifierRules(t *testing.T) {
+	cert, key := generateCertificate(t)
+
+	rcpt := &Receipt{
+		ReceiptType:  "ProductionSandbox",
+		BundleID:     "com.example.app",
+		CreationDate: CreationDate{Date: date(null.TimeFrom(time.Now().Add(-60 * 24 * time.Hour)))},
+		InApp: []*InApp{
+			{ProductID: "coin", TransactionID: "1", Quantity: 1},
+			{ProductID: "coin", TransactionID: "1", Quantity: 1},
+		},
+	}
+
+	data, err := rcpt.Sign(cert, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule := func(name, expression, severity string) *Rule {
+		r, err := NewRule(name, expression, severity, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	old := rule("old", `Now - Receipt.CreationDate > duration("720h")`, SeverityWarn)
+	duplicated := rule("duplicated", `len(uniq(map(InApp, .TransactionID))) != len(InApp)`, SeverityReject)
+	production := rule("production", `Environment != "Production"`, SeverityReject)
+	recent := rule("recent", `Now - Receipt.CreationDate < duration("24h")`, SeverityReject)
+
+	tests := []struct {
+		name     string
+		v        *Verifier
+		status   int
+		outcomes []string
+	}{
+		{"warn", &Verifier{Rules: []*Rule{old, recent}}, 0, []string{"old"}},
+		{"reject", &Verifier{Rules: []*Rule{old, duplicated}}, StatusRejectedByRule, []string{"old", "duplicated"}},
+		{"app rules", &Verifier{
+			Rules: []*Rule{old},
+			Apps:  map[string]*App{"com.example.app": {Rules: []*Rule{production}}},
+		}, StatusRejectedByRule, []string{"old", "production"}},
+		{"rules of other app", &Verifier{
+			Apps: map[string]*App{"com.example.other": {Rules: []*Rule{production}}},
+		}, 0, nil},
+	}
+
+	for _, test := range tests {
+		test.v.Roots = []*x509.Certificate{cert}
+		result, _ := test.v.Verify(context.Background(), data, "")
+
+		if result.Status != test.status {
+			t.Fatalf("Status for %s should be %d, not %d", test.name, test.status, result.Status)
+		}
+
+		if result.Environment != "Sandbox" {
+			t.Fatalf("Wrong environment for %s: %s", test.name, result.Environment)
+		}
+
+		if len(result.Rules) != len(test.outcomes) {
+			t.Fatalf("Wrong outcomes for %s: %+v", test.name, result.Rules)
+		}
+
+		for i, name := range test.outcomes {
+			if result.Rules[i].Name != name || result.Rules[i].Error != "" {
+				t.Fatalf("Wrong outcome for %s: %+v", test.name, result.Rules[i])
+			}
+		}
+	}
+
+	for _, expression := range []string{`Receipt.Unknown == 1`, `len(InApp)`, `Environment ==`} {
+		if _, err := NewRule("invalid", expression, SeverityReject, ""); err == nil {
+			t.Fatalf("Rule should be invalid: %s", expression)
+		}
+	}
+
+	if _, err := NewRule("invalid", "true", "error", ""); err == nil {
+		t.Fatal("Severity should be invalid")
+	}
+}
+
+func TestVerifierCache(t *testing.T) {
+	cert, key := generateCertificate(t)
+	otherCert, _ := generateCertificate(t)
+
+	sign := func(bundleID string) string {
+		rcpt := &Receipt{
+			ReceiptType:        "ProductionSandbox",
+			BundleID:           bundleID,
+			ApplicationVersion: "1",
+			InApp:              []*InApp{{ProductID: "coin", TransactionID: "1", Quantity: 1}},
+		}
+		data, err := rcpt.Sign(cert, key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	data := sign("com.example.app")
+	cache := NewCache(2, time.Hour)
+	v := &Verifier{Roots: []*x509.Certificate{cert}, Cache: cache}
+
+	first, err := v.Verify(context.Background(), data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Results may be shaped, which must not change the cached receipt
+	first.Receipt.InApp[0].ProductID = "changed"
+
+	for _, e := range cache.entries {
+		e.Value.(*cacheEntry).receipt.setRequestDate(time.Now().Add(-time.Hour))
+	}
+
+	second, err := v.Verify(context.Background(), data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Fatalf("Wrong stats: %+v", stats)
+	}
+
+	if second.Receipt.InApp[0].ProductID != "coin" {
+		t.Fatalf("Cached receipt is changed: %s", second.Receipt.InApp[0].ProductID)
+	}
+
+	if requestDate := null.Time(second.Receipt.RequestDate.Date).Time; time.Since(requestDate) > time.Minute {
+		t.Fatalf("Request date should be recomputed: %s", requestDate)
+	}
+
+	// Settings other than certificates are applied to cached receipts
+	strict := &Verifier{
+		Roots: []*x509.Certificate{cert},
+		Apps:  map[string]*App{"com.example.app": {ApplicationVersions: []string{">= 2"}}},
+		Cache: cache,
+	}
+	if result, _ := strict.Verify(context.Background(), data, ""); result.Status != StatusApplicationVersionNotAllowed {
+		t.Fatalf("Wrong status of a cached receipt: %d", result.Status)
+	}
+
+	// Receipts are verified again with other certificates
+	other := &Verifier{Roots: []*x509.Certificate{otherCert}, Cache: cache}
+	if result, _ := other.Verify(context.Background(), data, ""); result.Status != 21002 {
+		t.Fatalf("Wrong status with other certificates: %d", result.Status)
+	}
+
+	for _, bundleID := range []string{"com.example.other", "com.example.another"} {
+		if _, err := v.Verify(context.Background(), sign(bundleID), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stats := cache.Stats(); stats.Hits != 2 || stats.Evictions != 1 || stats.Entries != 2 {
+		t.Fatalf("Wrong stats: %+v", stats)
+	}
+
+	// Fingerprints are computed once per verifier
+	if len(cache.fingerprints) != 3 {
+		t.Fatalf("Wrong fingerprints: %d", len(cache.fingerprints))
+	}
+
+	cached := &Receipt{
+		Extra:             map[string]json.RawMessage{"extra": json.RawMessage(`"value"`)},
+		unknownAttributes: []attribute{{Type: 1000, Value: []byte{1}}},
+		InApp:             []*InApp{{Extra: map[string]json.RawMessage{"extra": json.RawMessage(`1`)}}},
+	}
+	cloned := cached.clone()
+	cloned.Extra["extra"][1] = 'V'
+	cloned.unknownAttributes[0].Value[0] = 2
+	cloned.InApp[0].Extra["other"] = json.RawMessage(`2`)
+
+	if string(cached.Extra["extra"]) != `"value"` || cached.unknownAttributes[0].Value[0] != 1 || len(cached.InApp[0].Extra) != 1 {
+		t.Fatalf("Cached receipt is changed: %+v", cached)
+	}
+
+	expiring := &Verifier{Roots: []*x509.Certificate{cert}, Cache: NewCache(1, time.Millisecond)}
+	for i := 0; i < 2; i++ {
+		if _, err := expiring.Verify(context.Background(), data, ""); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	if stats := expiring.Cache.Stats(); stats.Hits != 0 || stats.Misses != 2 {
+		t.Fatalf("Receipts should expire: %+v", stats)
+	}
+}
+
+func TestValidateMany(t *testing.T) {
+	cert, key := generateCertificate(t)
+
+	rcpt := &Receipt{ReceiptType: "ProductionSandbox", BundleID: "com.example.app"}
+	data, err := rcpt.Sign(cert, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := &Verifier{
+		Roots: []*x509.Certificate{cert},
+		Apps:  map[string]*App{"com.example.app": {SharedSecret: "secret"}},
+	}
+
+	requests := make(chan BatchRequest)
+	go func() {
+		defer close(requests)
+		for i := 0; i < 20; i++ {
+			request := BatchRequest{Index: i, Data: data, Password: "secret"}
+			if i%5 == 0 {
+				request.Password = "wrong"
+			}
+			requests <- request
+		}
+	}()
+
+	seen := map[int]bool{}
+	for result := range v.ValidateMany(context.Background(), requests, 4) {
+		if seen[result.Index] {
+			t.Fatalf("Result %d is duplicated", result.Index)
+		}
+		seen[result.Index] = true
+
+		if result.Index%5 == 0 {
+			if result.Result.Status != 21004 || result.Err == nil {
+				t.Fatalf("Wrong result %d: %+v", result.Index, result)
+			}
+		} else if result.Result.Status != 0 || result.Err != nil {
+			t.Fatalf("Wrong result %d: %+v", result.Index, result)
+		}
+	}
+
+	if len(seen) != 20 {
+		t.Fatalf("Wrong number of results: %d", len(seen))
+	}
+}
+
+// generateCertificate returns a self-signed certificate and its private key
+func generateCertificate(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+	return createCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"Acme Co"}, CommonName: "Test Signer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+}
+
+// createCertificate returns a certificate of template with a new private key,
+// signed by parent, or self-signed when parent is nil
+func createCertificate(t *testing.T, template, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
@@ -0,0 +1,130 @@
+package receipt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VersionRange is a range of application versions, which is a version such
+// as "1.2", or comma separated constraints such as ">=1.2, <2.0". The
+// operators of constraints are =, !=, <, <=, > and >=. Versions are compared
+// by dot separated components, numerically when both are numbers.
+type VersionRange []versionConstraint
+
+type versionConstraint struct {
+	op      string
+	version string
+}
+
+// ParseVersionRange parses a version range
+func ParseVersionRange(s string) (VersionRange, error) {
+	var r VersionRange
+
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+
+		op := "="
+		for _, o := range []string{">=", "<=", "!=", ">", "<", "="} {
+			if strings.HasPrefix(c, o) {
+				op = o
+				c = strings.TrimSpace(c[len(o):])
+				break
+			}
+		}
+
+		if c == "" {
+			return nil, fmt.Errorf("invalid version range: %q", s)
+		}
+
+		r = append(r, versionConstraint{op: op, version: c})
+	}
+
+	return r, nil
+}
+
+// Contains returns true when version satisfies all constraints of the range
+func (r VersionRange) Contains(version string) bool {
+	for _, c := range r {
+		cmp := CompareVersions(version, c.version)
+
+		var ok bool
+		switch c.op {
+		case "=":
+			ok = cmp == 0
+		case "!=":
+			ok = cmp != 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CompareVersions returns -1, 0 or 1 when a is older than, the same as or
+// newer than b. Missing components are regarded as 0, so "1.0" is the same
+// as "1".
+func CompareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+
+		if cmp := compareComponents(x, y); cmp != 0 {
+			return cmp
+		}
+	}
+
+	return 0
+}
+
+func compareComponents(x, y string) int {
+	m, errM := strconv.ParseUint(x, 10, 64)
+	n, errN := strconv.ParseUint(y, 10, 64)
+
+	switch {
+	case errM == nil && errN == nil:
+		if m < n {
+			return -1
+		} else if m > n {
+			return 1
+		}
+		return 0
+	default:
+		return strings.Compare(x, y)
+	}
+}
+
+// versionAllowed returns true when version is in any of ranges. All versions
+// are allowed when ranges is empty, and invalid ranges match no version.
+func versionAllowed(ranges []string, version string) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+
+	for _, s := range ranges {
+		r, err := ParseVersionRange(s)
+		if err == nil && r.Contains(version) {
+			return true
+		}
+	}
+
+	return false
+}
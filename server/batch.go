@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aktsk/nolmandy/receipt"
+)
+
+// BatchResult is a line of the response of /verifyReceipts. Index is the
+// position of the request in the batch. When the batch is not read to the
+// end, the last line has Index -1, status 21000 and Error.
+type BatchResult struct {
+	Index  int            `json:"index"`
+	Result receipt.Result `json:"result"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// verifyReceipts verifies a batch of requests in a JSON array or in JSON
+// lines, and responds with BatchResult in JSON lines in the order of
+// completion. Requests which can not be decoded or are larger than
+// MaxBodySize are responded with status 21000, and the rest of the batch is
+// verified unless the batch itself can not be read any more. ReadTimeout
+// and WriteTimeout limit each request and each result of the batch, instead
+// of the whole batch.
+func (s *Server) verifyReceipts(w http.ResponseWriter, r *http.Request) {
+	// The request context is canceled when reading the batch fails, by a
+	// timeout for example, but the results read so far are still written.
+	// The batch is canceled when they can not be written.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	defer cancel()
+
+	body, err := decodeContent(r, r.Body, s.maxBatchSize())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Results are written while the rest of the batch is read
+	controller := http.NewResponseController(w)
+	controller.EnableFullDuplex()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	// mu serializes writes and deadlines, so that the read deadline is not
+	// extended after reading is stopped
+	var mu sync.Mutex
+	extendReadDeadline := func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if ctx.Err() == nil {
+			controller.SetReadDeadline(deadline(s.ReadTimeout))
+		}
+	}
+	extendReadDeadline()
+
+	encoder := json.NewEncoder(w)
+	write := func(result BatchResult) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+		controller.SetWriteDeadline(deadline(s.WriteTimeout))
+		if err := encoder.Encode(result); err != nil {
+			// The client is gone
+			cancel()
+			return
+		}
+		controller.Flush()
+	}
+
+	// Requests are kept until they are verified, to shape their results
+	var pending sync.Map
+
+	// readErr is read after done is closed
+	var readErr error
+	requests := make(chan receipt.BatchRequest)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(requests)
+
+		readErr = readBatch(body, s.maxBodySize(), func(index int, request Request, err error) bool {
+			extendReadDeadline()
+
+			if err != nil {
+				slog.WarnContext(ctx, "failed to decode request", "index", index, "error", err)
+				result := receipt.Result{Status: 21000}
+				observeResult(result)
+				write(BatchResult{Index: index, Result: result})
+				return true
+			}
+
+			pending.Store(index, request)
+			select {
+			case requests <- receipt.BatchRequest{Index: index, Data: request.ReceiptData, Password: request.Password}:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+		if readErr != nil {
+			slog.WarnContext(ctx, "failed to read batch", "error", readErr)
+		}
+	}()
+
+	v := s.verifier()
+	verify := func(ctx context.Context, data string, password string) (receipt.Result, error) {
+		return VerifyWith(ctx, v, Request{ReceiptData: data, Password: password}), nil
+	}
+
+	for result := range receipt.VerifyMany(ctx, verify, requests, s.BatchWorkers) {
+		request, _ := pending.LoadAndDelete(result.Index)
+		s.shapeResult(ctx, request.(Request), &result.Result)
+		observeResult(result.Result)
+		write(BatchResult{Index: result.Index, Result: result.Result})
+	}
+
+	// Stop reading the rest of the batch, and wait for the reader not to
+	// write after returning
+	if ctx.Err() != nil {
+		mu.Lock()
+		controller.SetReadDeadline(time.Now())
+		mu.Unlock()
+	}
+	<-done
+
+	// Tell the client that the results are cut short
+	if readErr != nil {
+		write(BatchResult{Index: -1, Result: receipt.Result{Status: 21000}, Error: "batch is not read to the end: " + readErr.Error()})
+	}
+
+	// The end of the response is written after returning
+	mu.Lock()
+	controller.SetWriteDeadline(deadline(s.WriteTimeout))
+	mu.Unlock()
+}
+
+// deadline returns the deadline after timeout, or no deadline when timeout
+// is not positive
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// readBatch reads requests in a JSON array or in JSON lines, and calls fn
+// with each of them and its index until fn returns false. Requests larger
+// than maxSize bytes are not read unless maxSize is negative. Requests in JSON
+// lines which can not be decoded or are too large are given to fn with
+// errors, and the next lines are read. A JSON array can not be read after an
+// error, which is given to fn and returned.
+func readBatch(body io.Reader, maxSize int64, fn func(index int, request Request, err error) bool) error {
+	reader := bufio.NewReader(body)
+
+	// Skip spaces to see whether the batch is a JSON array
+	for {
+		b, err := reader.Peek(1)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			fn(0, Request{}, err)
+			return err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		reader.ReadByte()
+	}
+
+	if b, _ := reader.Peek(1); b[0] == '[' {
+		element := &elementReader{r: reader, limit: maxSize}
+		decoder := json.NewDecoder(element)
+		decoder.Token()
+
+		for index := 0; decoder.More(); index++ {
+			var request Request
+			if err := decoder.Decode(&request); err != nil {
+				fn(index, Request{}, err)
+				return err
+			}
+			element.start = decoder.InputOffset()
+			if !fn(index, request, nil) {
+				return nil
+			}
+		}
+
+		return nil
+	}
+
+	for index := 0; ; {
+		line, tooLarge, err := readLine(reader, maxSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			fn(index, Request{}, err)
+			return err
+		}
+
+		if tooLarge {
+			if !fn(index, Request{}, &http.MaxBytesError{Limit: maxSize}) {
+				return nil
+			}
+			index++
+		} else if len(bytes.TrimSpace(line)) > 0 {
+			request, decodeErr := decodeJSON(line)
+			if !fn(index, request, decodeErr) {
+				return nil
+			}
+			index++
+		}
+
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// readLine reads a line up to maxSize bytes unless maxSize is negative. The
+// rest of a larger line is skipped, and tooLarge is returned.
+func readLine(reader *bufio.Reader, maxSize int64) (line []byte, tooLarge bool, err error) {
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLarge {
+			if maxSize >= 0 && int64(len(line)+len(chunk)) > maxSize {
+				tooLarge = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+
+		if err != bufio.ErrBufferFull {
+			return line, tooLarge, err
+		}
+	}
+}
+
+// elementReader limits bytes read for an element of a JSON array to limit,
+// counting from the end of the previous element at start
+type elementReader struct {
+	r     io.Reader
+	limit int64
+	start int64
+	n     int64
+}
+
+func (e *elementReader) Read(p []byte) (int, error) {
+	if e.limit >= 0 {
+		remaining := e.start + e.limit + 1 - e.n
+		if remaining <= 0 {
+			return 0, &http.MaxBytesError{Limit: e.limit}
+		}
+		if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+
+	n, err := e.r.Read(p)
+	e.n += int64(n)
+	return n, err
+}
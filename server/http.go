@@ -0,0 +1,408 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aktsk/nolmandy/catalog"
+	"github.com/aktsk/nolmandy/entitlements"
+	"github.com/aktsk/nolmandy/ledger"
+	"github.com/aktsk/nolmandy/receipt"
+	"github.com/aktsk/nolmandy/store"
+	"github.com/aktsk/nolmandy/version"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultShutdownTimeout is how long in-flight requests are waited for on shutdown
+const DefaultShutdownTimeout = 30 * time.Second
+
+// Server is a receipt validation server. It implements http.Handler, so
+// that it can be mounted in other servers, and it can also listen by itself.
+type Server struct {
+	// Addr is the TCP address to listen on, ":8000" for example
+	Addr string
+
+	// Cert is the certificate to validate receipts with. Apple Inc Root
+	// Certificate is used when Cert is nil.
+	Cert *x509.Certificate
+
+	// Verifier verifies receipts, with per-app settings for example. Cert is
+	// used when Verifier is nil.
+	Verifier Verifier
+
+	// Handler handles verifyReceipt requests. VerifyHandler(Verifier) is
+	// used when Handler is nil.
+	Handler http.Handler
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// MaxBodySize limits the size of request bodies. DefaultMaxBodySize is
+	// used when MaxBodySize is zero, and negative MaxBodySize means no limit.
+	MaxBodySize int64
+
+	// MaxBatchSize limits the decompressed size of batches of
+	// /verifyReceipts, each request of which is limited by MaxBodySize
+	// instead. DefaultMaxBatchSize is used when MaxBatchSize is zero, and
+	// negative MaxBatchSize means no limit.
+	MaxBatchSize int64
+
+	// TLSCertFile and TLSKeyFile enable TLS
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// ClientCAFile requires TLS clients to present certificates signed
+	// by the certificates in the file. It is an error to set ClientCAFile
+	// without TLSCertFile and TLSKeyFile.
+	ClientCAFile string
+
+	// ShutdownTimeout limits the time to wait for in-flight requests on
+	// shutdown. DefaultShutdownTimeout is used when ShutdownTimeout is zero.
+	ShutdownTimeout time.Duration
+
+	// GitCommit is the revision reported by /version
+	GitCommit string
+
+	// Catalog shapes successful verifyReceipt responses by Result.Shape.
+	// Consumables are omitted from latest_receipt_info, and receipt.in_app
+	// is left unchanged. The catalog of Verifier is used when Catalog is nil.
+	Catalog *catalog.Catalog
+
+	// Entitlements adds the entitlements section computed by
+	// entitlements.FromResult with the catalog to successful verifyReceipt
+	// responses
+	Entitlements bool
+
+	// Store records the transactions of successful verifyReceipt requests
+	// with user IDs. Transactions redeemed for other users are handled by
+	// ReusePolicy.
+	Store store.TransactionStore
+
+	// ReusePolicy is ReuseWarn (the default) or ReuseReject
+	ReusePolicy string
+
+	// Ledger records the consumable purchases of successful verifyReceipt
+	// requests with user IDs, by the catalog. See LedgerHandler.
+	Ledger ledger.Ledger
+
+	// BatchWorkers is the number of receipts verified concurrently in a
+	// batch of /verifyReceipts. runtime.GOMAXPROCS(0) is used when
+	// BatchWorkers is zero.
+	BatchWorkers int
+
+	// AdminAddr is the TCP address to serve admin handlers on, separately
+	// from verifyReceipt requests. Admin handlers are served with the other
+	// handlers when AdminAddr is empty.
+	AdminAddr string
+
+	// AdminToken is the bearer token required by admin handlers. Admin
+	// handlers are not served when AdminToken is empty.
+	AdminToken string
+
+	muxOnce sync.Once
+	mux     *http.ServeMux
+
+	adminMuxOnce sync.Once
+	adminMux     *http.ServeMux
+}
+
+// ServeHTTP routes a request. verifyReceipt requests are accepted with POST
+// on /verifyReceipt and on / for backward compatibility, and batches of them
+// on /verifyReceipts. Health, readiness,
+// version and Prometheus metrics endpoints are served with GET.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Batches are limited by MaxBatchSize, and their requests by MaxBodySize
+	if maxBodySize := s.maxBodySize(); maxBodySize > 0 && r.URL.Path != "/verifyReceipts" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	}
+
+	s.serveMux().ServeHTTP(w, r)
+}
+
+// Handle registers an additional handler for a pattern of http.ServeMux
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.serveMux().Handle(pattern, handler)
+}
+
+// HandleAdmin registers an admin handler for a pattern of http.ServeMux,
+// which requires AdminToken. It is served on AdminAddr when AdminAddr is set.
+func (s *Server) HandleAdmin(pattern string, handler http.Handler) {
+	if s.AdminToken == "" {
+		return
+	}
+
+	handler = RequireToken(s.AdminToken, handler)
+	if s.AdminAddr == "" {
+		s.Handle(pattern, handler)
+		return
+	}
+
+	s.adminServeMux().Handle(pattern, handler)
+}
+
+func (s *Server) adminServeMux() *http.ServeMux {
+	s.adminMuxOnce.Do(func() {
+		s.adminMux = http.NewServeMux()
+	})
+
+	return s.adminMux
+}
+
+func (s *Server) serveMux() *http.ServeMux {
+	s.muxOnce.Do(func() {
+		verify := s.Handler
+		if verify == nil {
+			verify = VerifyHandler(s.verifier(), s.maxBodySize())
+		}
+		verify = instrument(promhttp.InstrumentHandlerInFlight(inFlightRequests, verify), s.shapeResult)
+
+		s.mux = http.NewServeMux()
+		s.mux.Handle("POST /verifyReceipt", verify)
+		s.mux.Handle("POST /{$}", verify)
+		s.mux.Handle("POST /verifyReceipts", instrument(http.HandlerFunc(s.verifyReceipts), nil))
+		s.mux.HandleFunc("GET /healthz", s.healthz)
+		s.mux.HandleFunc("GET /readyz", s.readyz)
+		s.mux.HandleFunc("GET /version", s.version)
+		s.mux.Handle("GET /metrics", s.metricsHandler())
+	})
+
+	return s.mux
+}
+
+// shapeResult records the transactions of a result, and records its
+// consumables, shapes it and adds entitlements when there is a catalog
+func (s *Server) shapeResult(ctx context.Context, request Request, result *receipt.Result) {
+	s.recordTransactions(ctx, request, result)
+
+	c := s.Catalog
+	if c == nil {
+		c = verifierCatalog(s.verifier())
+	}
+
+	if c == nil || result.Status != 0 {
+		return
+	}
+
+	s.recordConsumables(ctx, c, request, *result)
+
+	result.Shape(c)
+
+	if !s.Entitlements {
+		return
+	}
+
+	data, err := json.Marshal(entitlements.FromResult(c, *result, time.Now()))
+	if err != nil {
+		slog.Error("failed to marshal entitlements", "error", err)
+		return
+	}
+
+	extra := map[string]json.RawMessage{"entitlements": data}
+	for k, v := range result.Extra {
+		if k != "entitlements" {
+			extra[k] = v
+		}
+	}
+	result.Extra = extra
+}
+
+func (s *Server) verifier() Verifier {
+	if s.Verifier != nil {
+		return s.Verifier
+	}
+	return certVerifier(s.Cert)
+}
+
+func (s *Server) maxBodySize() int64 {
+	if s.MaxBodySize == 0 {
+		return DefaultMaxBodySize
+	}
+	return s.MaxBodySize
+}
+
+func (s *Server) maxBatchSize() int64 {
+	if s.MaxBatchSize == 0 {
+		return DefaultMaxBatchSize
+	}
+	return s.MaxBatchSize
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readyz checks that the root certificates are loaded and not expired
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	roots, err := certificates(s.verifier())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	now := time.Now()
+	for _, cert := range roots {
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			http.Error(w, fmt.Sprintf("root certificate %s is valid from %s to %s", cert.Subject, cert.NotBefore, cert.NotAfter), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Write([]byte("ok\n"))
+}
+
+func (s *Server) version(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Version   string `json:"version"`
+		GitCommit string `json:"git_commit"`
+	}{
+		Version:   version.Get(),
+		GitCommit: s.GitCommit,
+	})
+}
+
+// ListenAndServe listens on Addr, and on AdminAddr when it is set, and
+// serves requests until ctx is done. Then it shuts down gracefully, waiting
+// for in-flight requests.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	if s.AdminAddr == "" {
+		return s.Serve(ctx, l)
+	}
+
+	adminListener, err := net.Listen("tcp", s.AdminAddr)
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	// Both listeners are shut down when either of them fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	adminErr := make(chan error, 1)
+	go func() {
+		err := s.ServeAdmin(ctx, adminListener)
+		cancel()
+		adminErr <- err
+	}()
+
+	err = s.Serve(ctx, l)
+	cancel()
+
+	if err := <-adminErr; err != nil {
+		return err
+	}
+
+	return err
+}
+
+// Serve serves requests on a listener until ctx is done, and then shuts down
+// gracefully.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	return s.serve(ctx, l, s)
+}
+
+// ServeAdmin serves the admin handlers registered by HandleAdmin on a
+// listener until ctx is done, and then shuts down gracefully.
+func (s *Server) ServeAdmin(ctx context.Context, l net.Listener) error {
+	return s.serve(ctx, l, s.adminServeMux())
+}
+
+func (s *Server) serve(ctx context.Context, l net.Listener, handler http.Handler) error {
+	httpServer := &http.Server{
+		Handler:      handler,
+		ReadTimeout:  s.ReadTimeout,
+		WriteTimeout: s.WriteTimeout,
+		IdleTimeout:  s.IdleTimeout,
+	}
+
+	useTLS := s.TLSCertFile != "" || s.TLSKeyFile != ""
+	if !useTLS && s.ClientCAFile != "" {
+		// Client certificates can not be required without TLS
+		l.Close()
+		return errors.New("ClientCAFile requires TLSCertFile and TLSKeyFile")
+	}
+	if useTLS {
+		tlsConfig, err := s.tlsConfig()
+		if err != nil {
+			l.Close()
+			return err
+		}
+		httpServer.TLSConfig = tlsConfig
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		if useTLS {
+			errCh <- httpServer.ServeTLS(l, s.TLSCertFile, s.TLSKeyFile)
+		} else {
+			errCh <- httpServer.Serve(l)
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	timeout := s.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if s.ClientCAFile != "" {
+		caPEM, err := os.ReadFile(s.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("no certificate found in " + s.ClientCAFile)
+		}
+
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
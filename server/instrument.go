@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/aktsk/nolmandy/logging"
+	"github.com/aktsk/nolmandy/receipt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/aktsk/nolmandy/server")
+
+// validRequestID is the format of X-Request-Id accepted from clients
+var validRequestID = regexp.MustCompile(`^[0-9A-Za-z._-]{1,128}$`)
+
+// resultWriter records the result written by WriteResult, and shapes it
+// with the request read by ReadRequest before it is written
+type resultWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	request Request
+	result  *receipt.Result
+	shape   func(context.Context, Request, *receipt.Result)
+}
+
+func (w *resultWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// instrument assigns a request ID to each request, traces it as a child of
+// the incoming W3C trace context, and logs the result. Results are shaped by
+// shape when it is not nil.
+func instrument(next http.Handler, shape func(context.Context, Request, *receipt.Result)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID.MatchString(id) {
+			id = logging.NewRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, "verifyReceipt",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("nolmandy.request_id", id),
+			),
+		)
+		defer span.End()
+
+		ctx = logging.WithRequestID(ctx, id)
+		rw := &resultWriter{ResponseWriter: w, ctx: ctx, shape: shape}
+		next.ServeHTTP(rw, r.WithContext(ctx))
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Duration("latency", time.Since(start)),
+		}
+
+		if result := rw.result; result != nil {
+			attrs = append(attrs,
+				slog.Int("status", result.Status),
+				slog.String("environment", result.Environment),
+			)
+			span.SetAttributes(
+				attribute.Int("receipt.status", result.Status),
+				attribute.String("receipt.environment", result.Environment),
+			)
+
+			if result.Receipt != nil {
+				attrs = append(attrs,
+					slog.String("bundle_id", result.Receipt.BundleID),
+					slog.Int("transactions", len(result.Receipt.InApp)),
+				)
+				span.SetAttributes(
+					attribute.String("receipt.bundle_id", result.Receipt.BundleID),
+					attribute.Int("receipt.in_app_count", len(result.Receipt.InApp)),
+				)
+			}
+		}
+
+		slog.LogAttrs(ctx, slog.LevelInfo, "verifyReceipt", attrs...)
+	})
+}
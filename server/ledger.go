@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/aktsk/nolmandy/catalog"
+	"github.com/aktsk/nolmandy/ledger"
+	"github.com/aktsk/nolmandy/receipt"
+)
+
+// recordConsumables records the consumable purchases of a successful result
+// for the user of a request. Nothing is recorded for requests without user
+// IDs.
+func (s *Server) recordConsumables(ctx context.Context, c *catalog.Catalog, request Request, result receipt.Result) {
+	if s.Ledger == nil || request.UserID == "" {
+		return
+	}
+
+	entries := ledger.Entries(c, result, request.UserID, time.Now())
+	if len(entries) == 0 {
+		return
+	}
+
+	added, err := s.Ledger.Record(ctx, entries)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to record consumables", "error", err)
+		return
+	}
+
+	if len(added) > 0 {
+		slog.InfoContext(ctx, "consumables recorded", "entries", len(added))
+	}
+}
+
+// History is the consumable history of a user
+type History struct {
+	UserID  string           `json:"user_id"`
+	Entries []ledger.Entry   `json:"entries"`
+	Totals  map[string]int64 `json:"totals"`
+}
+
+// Grant is the response of a grant request. Granted is false when the
+// transaction was already granted.
+type Grant struct {
+	Granted bool         `json:"granted"`
+	Entry   ledger.Entry `json:"entry"`
+}
+
+// LedgerHandler serves a ledger. GET /ledger/users/{user} responds with
+// the History of a user, and POST /ledger/transactions/{transaction}/grant
+// grants a transaction once, and responds with a Grant. Unknown
+// transactions are responded with 404.
+func LedgerHandler(l ledger.Ledger) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /ledger/users/{user}", func(w http.ResponseWriter, r *http.Request) {
+		userID := r.PathValue("user")
+
+		entries, err := l.History(r.Context(), userID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to read consumable history", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(History{UserID: userID, Entries: entries, Totals: ledger.Totals(entries)})
+	})
+
+	mux.HandleFunc("POST /ledger/transactions/{transaction}/grant", func(w http.ResponseWriter, r *http.Request) {
+		entry, granted, err := l.Grant(r.Context(), r.PathValue("transaction"), time.Now())
+		if errors.Is(err, ledger.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to grant consumable", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Grant{Granted: granted, Entry: entry})
+	})
+
+	return mux
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aktsk/nolmandy/receipt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are registered to the default Prometheus registry, and served on
+// /metrics by Server
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nolmandy",
+		Name:      "requests_total",
+		Help:      "Number of verifyReceipt responses by status and environment.",
+	}, []string{"status", "environment"})
+
+	parseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "nolmandy",
+		Name:      "parse_duration_seconds",
+		Help:      "Time to parse and verify receipts by phase.",
+		Buckets:   []float64{.00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+	}, []string{"phase"})
+
+	inAppItems = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "nolmandy",
+		Name:      "in_app_items",
+		Help:      "Number of in-app purchase items in receipts.",
+		Buckets:   []float64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500},
+	})
+
+	ruleOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nolmandy",
+		Name:      "rule_outcomes_total",
+		Help:      "Number of triggered validation rules by rule and severity.",
+	}, []string{"rule", "severity"})
+
+	inFlightRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nolmandy",
+		Name:      "in_flight_requests",
+		Help:      "Number of verifyReceipt requests being served.",
+	})
+)
+
+// metricsHandler serves the metrics of the default registry, with
+// root_certificate_expiry_days of the verifier of s, which is computed when
+// metrics are collected
+func (s *Server) metricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "nolmandy",
+		Name:      "root_certificate_expiry_days",
+		Help:      "Days until the root certificate which expires first among those used for verification.",
+	}, func() float64 {
+		return rootCertExpiryDays(s.verifier())
+	}))
+
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}))
+}
+
+// rootCertExpiryDays returns the days until the root certificate which
+// expires first among those of a verifier
+func rootCertExpiryDays(v Verifier) float64 {
+	certs, err := certificates(v)
+	if err != nil || len(certs) == 0 {
+		return 0
+	}
+
+	notAfter := certs[0].NotAfter
+	for _, cert := range certs[1:] {
+		if cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+	}
+
+	return time.Until(notAfter).Hours() / 24
+}
+
+func observePhase(phase string, d time.Duration) {
+	parseDuration.WithLabelValues(phase).Observe(d.Seconds())
+}
+
+func observeResult(result receipt.Result) {
+	requestsTotal.WithLabelValues(strconv.Itoa(result.Status), result.Environment).Inc()
+
+	if result.Receipt != nil {
+		inAppItems.Observe(float64(len(result.Receipt.InApp)))
+	}
+
+	for _, outcome := range result.Rules {
+		ruleOutcomes.WithLabelValues(outcome.Name, outcome.Severity).Inc()
+	}
+}
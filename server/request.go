@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultMaxBodySize is the default limit of request body size
+const DefaultMaxBodySize = 4 << 20
+
+// DefaultMaxBatchSize is the default limit of decompressed batch size of
+// /verifyReceipts. It is thousands of receipts, and more receipts are sent
+// in several batches.
+const DefaultMaxBatchSize = 64 << 20
+
+// Request is for request to a receipt validation server
+type Request struct {
+	ReceiptData string `json:"receipt-data"`
+	Password    string `json:"password"`
+
+	// UserID identifies the user who redeems the receipt, for the
+	// transaction store of Server. It is not sent to the App Store.
+	UserID string `json:"user-id,omitempty"`
+}
+
+// AppStoreRequest returns the request without the fields which are not sent
+// to the App Store
+func (r Request) AppStoreRequest() Request {
+	r.UserID = ""
+	return r
+}
+
+// DecodeRequest decodes a verifyReceipt request. Receipt data is accepted in
+// these forms, and bodies may be compressed with gzip.
+//
+//   - JSON: {"receipt-data": "...", "password": "...", "user-id": "..."}
+//   - Form: receipt-data=...&password=...&user-id=...
+//   - Base 64 encoded receipt data as text
+//   - DER encoded receipt data (application/pkcs7-mime)
+//
+// The user ID may also be given by X-User-Id header. Bodies larger than
+// maxBodySize are rejected. DefaultMaxBodySize is used when maxBodySize is
+// zero, and negative maxBodySize means no limit.
+func DecodeRequest(r *http.Request, maxBodySize int64) (Request, error) {
+	request, err := decodeRequest(r, maxBodySize)
+	if err == nil && request.UserID == "" {
+		request.UserID = r.Header.Get("X-User-Id")
+	}
+	return request, err
+}
+
+func decodeRequest(r *http.Request, maxBodySize int64) (Request, error) {
+	var request Request
+
+	if maxBodySize == 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+
+	if r.Body == nil {
+		return request, errors.New("request body is empty")
+	}
+
+	body := io.Reader(r.Body)
+	if maxBodySize > 0 {
+		body = http.MaxBytesReader(nil, r.Body, maxBodySize)
+	}
+
+	body, err := decodeContent(r, body, maxBodySize)
+	if err != nil {
+		return request, err
+	}
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return request, err
+	}
+
+	mediaType := ""
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return request, err
+		}
+	}
+
+	switch mediaType {
+	case "application/json":
+		return decodeJSON(b)
+	case "application/x-www-form-urlencoded":
+		return decodeForm(b)
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		return decodeDER(b), nil
+	case "text/plain":
+		return decodeBase64(b), nil
+	case "", "application/octet-stream":
+		// Guess the format from the content
+		trimmed := bytes.TrimSpace(b)
+		switch {
+		case len(trimmed) == 0:
+			return request, errors.New("request body is empty")
+		case trimmed[0] == '{':
+			return decodeJSON(b)
+		case b[0] == 0x30: // ASN.1 SEQUENCE of PKCS #7 ContentInfo
+			return decodeDER(b), nil
+		default:
+			return decodeBase64(b), nil
+		}
+	}
+
+	return request, fmt.Errorf("unsupported content type: %s", mediaType)
+}
+
+// decodeContent decompresses a body by Content-Encoding of a request, and
+// limits the decompressed body to maxSize bytes unless maxSize is negative
+func decodeContent(r *http.Request, body io.Reader, maxSize int64) (io.Reader, error) {
+	switch encoding := strings.ToLower(r.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+	case "gzip":
+		var err error
+		if body, err = gzip.NewReader(body); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+
+	if maxSize < 0 {
+		return body, nil
+	}
+	return &limitedReader{r: body, limit: maxSize}, nil
+}
+
+// limitedReader reads up to limit bytes and fails with http.MaxBytesError
+// after that
+type limitedReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n > l.limit {
+		return 0, &http.MaxBytesError{Limit: l.limit}
+	}
+	if remaining := l.limit - l.n + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		return n - int(l.n-l.limit), &http.MaxBytesError{Limit: l.limit}
+	}
+	return n, err
+}
+
+func decodeJSON(b []byte) (Request, error) {
+	var request Request
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	if err := decoder.Decode(&request); err != nil {
+		return request, err
+	}
+
+	if decoder.More() {
+		return request, errors.New("unexpected data after JSON request")
+	}
+
+	return request, nil
+}
+
+func decodeForm(b []byte) (Request, error) {
+	form, err := url.ParseQuery(string(b))
+	if err != nil {
+		return Request{}, err
+	}
+
+	return Request{
+		ReceiptData: form.Get("receipt-data"),
+		Password:    form.Get("password"),
+		UserID:      form.Get("user-id"),
+	}, nil
+}
+
+func decodeDER(b []byte) Request {
+	return Request{ReceiptData: base64.StdEncoding.EncodeToString(b)}
+}
+
+func decodeBase64(b []byte) Request {
+	return Request{ReceiptData: string(bytes.TrimSpace(b))}
+}
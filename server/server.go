@@ -1,65 +1,143 @@
 package server
 
 import (
+	"context"
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 
+	"github.com/aktsk/nolmandy/catalog"
 	"github.com/aktsk/nolmandy/receipt"
 )
 
-// Request is for request to a receipt validation server
-type Request struct {
-	ReceiptData string `json:"receipt-data"`
-	Password    string `json:"password"`
-}
-
 // Serve is for serving receipt verification
 func Serve(port int, cert *x509.Certificate) {
-	http.HandleFunc("/", Parse(cert))
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	s := &Server{Addr: fmt.Sprintf(":%d", port), Cert: cert}
+	log.Fatal(s.ListenAndServe(context.Background()))
 }
 
 // Parse parsed receipt-data in a request
 func Parse(cert *x509.Certificate) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var request Request
-		json.NewDecoder(r.Body).Decode(&request)
-
-		var rcpt *receipt.Receipt
-		var result receipt.Result
-		var err error
-
-		if cert == nil {
-			cert, err = receipt.GetAppleRootCert()
-			if err != nil {
-				log.Print(err)
-				result.Status = 21100
-				result.IsRetryable = true
-				writeResult(w, result)
-				return
-			}
-		}
+	return parse(cert, DefaultMaxBodySize)
+}
+
+func parse(cert *x509.Certificate, maxBodySize int64) func(http.ResponseWriter, *http.Request) {
+	return VerifyHandler(certVerifier(cert), maxBodySize).ServeHTTP
+}
+
+// Verifier verifies base 64 encoded receipt data with a password. The status
+// of the result is not 0 when the receipt is rejected, and err tells why.
+// *receipt.Verifier is a Verifier.
+type Verifier interface {
+	Verify(ctx context.Context, data string, password string) (receipt.Result, error)
+}
+
+// certificates returns the trusted root certificates of a verifier, when
+// it has Certificates method like *receipt.Verifier
+func certificates(v Verifier) ([]*x509.Certificate, error) {
+	if c, ok := v.(interface {
+		Certificates() ([]*x509.Certificate, error)
+	}); ok {
+		return c.Certificates()
+	}
+	return nil, nil
+}
 
-		rcpt, err = receipt.Parse(cert, request.ReceiptData)
+// verifierCatalog returns the product catalog of a verifier, when it is a
+// *receipt.Verifier or it has Catalog method
+func verifierCatalog(v Verifier) *catalog.Catalog {
+	switch v := v.(type) {
+	case *receipt.Verifier:
+		return v.Catalog
+	case interface{ Catalog() *catalog.Catalog }:
+		return v.Catalog()
+	}
+	return nil
+}
 
-		if err != nil {
-			log.Print(err)
-			result.Status = 21002
-		} else {
-			result, err = rcpt.Validate()
+// VerifyHandler verifies receipts in requests with a verifier
+func VerifyHandler(v Verifier, maxBodySize int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request, ok := ReadRequest(w, r, maxBodySize)
+		if !ok {
+			return
 		}
 
-		writeResult(w, result)
+		WriteResult(w, VerifyWith(r.Context(), v, request))
+	})
+}
+
+// ReadRequest decodes a request by DecodeRequest. When the request can not be
+// decoded, it responds with status 21000 and returns false.
+func ReadRequest(w http.ResponseWriter, r *http.Request, maxBodySize int64) (Request, bool) {
+	request, err := DecodeRequest(r, maxBodySize)
+	if err != nil {
+		slog.WarnContext(r.Context(), "failed to decode request", "error", err)
+		WriteResult(w, receipt.Result{Status: 21000})
+		return request, false
+	}
+
+	if rw, ok := w.(*resultWriter); ok {
+		rw.request = request
 	}
+
+	return request, true
+}
+
+// Verify verifies receipt-data in a request with a given certificate, or
+// with Apple Inc Root Certificate when cert is nil
+func Verify(cert *x509.Certificate, request Request) receipt.Result {
+	return VerifyContext(context.Background(), cert, request)
+}
+
+// VerifyContext is the same as Verify, except that errors are logged with ctx,
+// and parsing and validation are traced as children of the span of ctx
+func VerifyContext(ctx context.Context, cert *x509.Certificate, request Request) receipt.Result {
+	return VerifyWith(ctx, certVerifier(cert), request)
+}
+
+// certVerifier returns a verifier with a root certificate, or with Apple Inc
+// Root Certificate when cert is nil
+func certVerifier(cert *x509.Certificate) *receipt.Verifier {
+	if cert == nil {
+		return &receipt.Verifier{}
+	}
+	return &receipt.Verifier{Roots: []*x509.Certificate{cert}}
+}
+
+// VerifyWith verifies receipt-data and password in a request with a verifier
+func VerifyWith(ctx context.Context, v Verifier, request Request) receipt.Result {
+	ctx = receipt.WithPhaseObserver(ctx, observePhase)
+	result, err := v.Verify(ctx, request.ReceiptData, request.Password)
+	if err != nil {
+		level := slog.LevelWarn
+		if result.Status == 0 || result.IsRetryable {
+			level = slog.LevelError
+		}
+		slog.Log(ctx, level, "failed to verify receipt", "status", result.Status, "error", err)
+	}
+
+	return result
 }
 
-func writeResult(w http.ResponseWriter, result receipt.Result) {
+// WriteResult writes a result as a response body, and counts it in the
+// metrics and the request log
+func WriteResult(w http.ResponseWriter, result receipt.Result) {
+	if rw, ok := w.(*resultWriter); ok {
+		if rw.shape != nil {
+			rw.shape(rw.ctx, rw.request, &result)
+		}
+		rw.result = &result
+	}
+
+	observeResult(result)
+
 	resultBody, err := json.Marshal(result)
 	if err != nil {
-		log.Print(err)
+		slog.Error("failed to marshal result", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
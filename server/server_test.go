@@ -2,15 +2,36 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/aktsk/nolmandy/catalog"
+	"github.com/aktsk/nolmandy/entitlements"
+	"github.com/aktsk/nolmandy/ledger"
 	"github.com/aktsk/nolmandy/receipt"
+	"github.com/aktsk/nolmandy/store"
+	"github.com/aktsk/nolmandy/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 func TestInvalidReceipt(t *testing.T) {
@@ -35,6 +56,867 @@ func TestValidReceipt(t *testing.T) {
 	}
 }
 
+func TestRequestFormats(t *testing.T) {
+	certDER, _ := pem.Decode([]byte(certificate))
+	cert, err := x509.ParseCertificate(certDER.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := base64.StdEncoding.DecodeString(receiptData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jsonBody, err := json.Marshal(Request{ReceiptData: receiptData})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(jsonBody)
+	gz.Close()
+
+	form := url.Values{"receipt-data": {receiptData}}.Encode()
+
+	tests := []struct {
+		name            string
+		contentType     string
+		contentEncoding string
+		body            []byte
+		status          int
+	}{
+		{"json", "application/json", "", jsonBody, 0},
+		{"form", "application/x-www-form-urlencoded", "", []byte(form), 0},
+		{"base64", "text/plain", "", []byte(receiptData + "\n"), 0},
+		{"der", "application/pkcs7-mime", "", der, 0},
+		{"gzip", "application/json", "gzip", gzipped.Bytes(), 0},
+		{"sniffed json", "", "", jsonBody, 0},
+		{"sniffed der", "application/octet-stream", "", der, 0},
+		{"sniffed base64", "", "", []byte(receiptData), 0},
+		{"malformed json", "application/json", "", []byte(`{"receipt-data":`), 21000},
+		{"trailing json", "application/json", "", append(jsonBody, "{}"...), 21000},
+		{"broken gzip", "application/json", "gzip", []byte("not gzip"), 21000},
+		{"unsupported content type", "image/png", "", der, 21000},
+		{"oversize body", "text/plain", "", []byte(strings.Repeat("A", 1025)), 21000},
+	}
+
+	s := httptest.NewServer(&Server{Cert: cert, MaxBodySize: 1024})
+	defer s.Close()
+
+	large := httptest.NewServer(&Server{Cert: cert})
+	defer large.Close()
+
+	for _, test := range tests {
+		ts := large
+		if test.name == "oversize body" {
+			ts = s
+		}
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/verifyReceipt", bytes.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		if test.contentEncoding != "" {
+			req.Header.Set("Content-Encoding", test.contentEncoding)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var result receipt.Result
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if result.Status != test.status {
+			t.Fatalf("Status for %s should be %d, not %d", test.name, test.status, result.Status)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	certDER, _ := pem.Decode([]byte(certificate))
+	cert, err := x509.ParseCertificate(certDER.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewServer(&Server{Cert: cert})
+	defer s.Close()
+
+	reqBody, err := json.Marshal(Request{ReceiptData: receiptData})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(s.URL+"/verifyReceipt", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(s.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, metric := range []string{
+		`nolmandy_requests_total{environment="Sandbox",status="0"}`,
+		`nolmandy_parse_duration_seconds_count{phase="base64"}`,
+		`nolmandy_parse_duration_seconds_count{phase="chain"}`,
+		`nolmandy_parse_duration_seconds_count{phase="attributes"}`,
+		`nolmandy_in_app_items_count`,
+		`nolmandy_in_flight_requests`,
+		`nolmandy_root_certificate_expiry_days`,
+	} {
+		if !strings.Contains(string(body), metric) {
+			t.Fatalf("%s is not found in metrics:\n%s", metric, body)
+		}
+	}
+
+	// The expiry is of the certificate of this server
+	var days float64
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "nolmandy_root_certificate_expiry_days ") {
+			fmt.Sscan(strings.TrimPrefix(line, "nolmandy_root_certificate_expiry_days "), &days)
+		}
+	}
+	if expected := time.Until(cert.NotAfter).Hours() / 24; math.Abs(days-expected) > 1 {
+		t.Fatalf("Wrong root_certificate_expiry_days: %f", days)
+	}
+}
+
+func TestEntitlements(t *testing.T) {
+	certDER, _ := pem.Decode([]byte(certificate))
+	cert, err := x509.ParseCertificate(certDER.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := catalog.New(
+		&catalog.Product{ID: "jp.aktsk.kalvados.test.iap0", Type: catalog.NonConsumable, Entitlements: []string{"premium"}},
+		&catalog.Product{ID: "jp.aktsk.kalvados.test.iap1", Type: catalog.Consumable},
+	)
+
+	s := httptest.NewServer(&Server{Cert: cert, Catalog: c, Entitlements: true})
+	defer s.Close()
+
+	reqBody, err := json.Marshal(Request{ReceiptData: receiptData})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(s.URL+"/verifyReceipt", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Status       int                        `json:"status"`
+		Entitlements []entitlements.Entitlement `json:"entitlements"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Status != 0 || len(body.Entitlements) != 1 {
+		t.Fatalf("Wrong entitlements: %+v", body)
+	}
+
+	if e := body.Entitlements[0]; e.Name != "premium" || !e.Active || e.TransactionID != "220000350729970" {
+		t.Fatalf("Wrong entitlement: %+v", e)
+	}
+
+	if result := request(t, receiptData); result.Extra["entitlements"] != nil {
+		t.Fatal("Entitlements should not be responded without a catalog")
+	}
+
+	// Entitlements are responded only when they are enabled
+	withoutEntitlements := httptest.NewServer(&Server{Cert: cert, Catalog: c})
+	defer withoutEntitlements.Close()
+
+	resp, err = http.Post(withoutEntitlements.URL+"/verifyReceipt", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result receipt.Result
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Status != 0 || result.Extra["entitlements"] != nil {
+		t.Fatalf("Entitlements should not be responded unless they are enabled: %+v", result)
+	}
+}
+
+func TestTransactionReuse(t *testing.T) {
+	certDER, _ := pem.Decode([]byte(certificate))
+	cert, err := x509.ParseCertificate(certDER.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, policy := range []string{ReuseWarn, ReuseReject} {
+		s := httptest.NewServer(&Server{Cert: cert, Store: store.NewMemory(), ReusePolicy: policy})
+
+		verify := func(userID string) receipt.Result {
+			reqBody, err := json.Marshal(Request{ReceiptData: receiptData, UserID: userID})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := http.Post(s.URL+"/verifyReceipt", "application/json", bytes.NewReader(reqBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			var result receipt.Result
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			return result
+		}
+
+		for _, userID := range []string{"alice", "alice", ""} {
+			if result := verify(userID); result.Status != 0 || len(result.Rules) != 0 {
+				t.Fatalf("Wrong result for %q with %s policy: %+v", userID, policy, result)
+			}
+		}
+
+		result := verify("bob")
+		if len(result.Rules) != 1 || result.Rules[0].Name != "transaction_reused" || result.Rules[0].Severity != policy {
+			t.Fatalf("Wrong rules with %s policy: %+v", policy, result.Rules)
+		}
+
+		if policy == ReuseWarn && result.Status != 0 {
+			t.Fatalf("Wrong status with warn policy: %d", result.Status)
+		}
+		if policy == ReuseReject && (result.Status != StatusTransactionReused || result.Receipt != nil || result.Reason == "") {
+			t.Fatalf("Wrong result with reject policy: %+v", result)
+		}
+		if policy == ReuseReject && strings.Contains(result.Reason, "2200000") {
+			t.Fatalf("Transaction ID should not be in reason: %s", result.Reason)
+		}
+
+		s.Close()
+	}
+}
+
+func TestLedger(t *testing.T) {
+	certDER, _ := pem.Decode([]byte(certificate))
+	cert, err := x509.ParseCertificate(certDER.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := ledger.NewMemory()
+	s := httptest.NewServer(&Server{
+		Cert: cert,
+		Catalog: catalog.New(
+			&catalog.Product{ID: "jp.aktsk.kalvados.test.iap0", Type: catalog.NonConsumable},
+			&catalog.Product{ID: "jp.aktsk.kalvados.test.iap1", Type: catalog.Consumable},
+		),
+		Ledger: l,
+	})
+	defer s.Close()
+
+	reqBody, err := json.Marshal(Request{ReceiptData: receiptData, UserID: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(s.URL+"/verifyReceipt", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	admin := httptest.NewServer(LedgerHandler(l))
+	defer admin.Close()
+
+	resp, err = http.Get(admin.URL + "/ledger/users/alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var history History
+	if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history.Entries) == 0 || history.Entries[0].ProductID != "jp.aktsk.kalvados.test.iap1" || history.Totals["jp.aktsk.kalvados.test.iap1"] != int64(len(history.Entries)) {
+		t.Fatalf("Wrong history: %+v", history)
+	}
+
+	for i, expected := range []bool{true, false} {
+		resp, err := http.Post(admin.URL+"/ledger/transactions/"+history.Entries[0].TransactionID+"/grant", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var grant Grant
+		err = json.NewDecoder(resp.Body).Decode(&grant)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if grant.Granted != expected || grant.Entry.GrantedAt == nil {
+			t.Fatalf("Wrong grant %d: %+v", i, grant)
+		}
+	}
+
+	resp, err = http.Post(admin.URL+"/ledger/transactions/unknown/grant", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Wrong status of an unknown transaction: %d", resp.StatusCode)
+	}
+}
+
+func TestAdminTransactions(t *testing.T) {
+	certDER, _ := pem.Decode([]byte(certificate))
+	cert, err := x509.ParseCertificate(certDER.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transactions := store.NewMemory()
+	s := &Server{Cert: cert, Store: transactions, AdminAddr: "127.0.0.1:0", AdminToken: "secret"}
+	s.HandleAdmin("GET /admin/transactions", TransactionsHandler(transactions))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ctx, l)
+
+	adminListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeAdmin(ctx, adminListener)
+
+	reqBody, err := json.Marshal(Request{ReceiptData: receiptData})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post("http://"+l.Addr().String()+"/verifyReceipt", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get("http://" + l.Addr().String() + "/admin/transactions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Admin handlers should not be served with verifyReceipt: %d", resp.StatusCode)
+	}
+
+	get := func(query, token string) (int, Transactions) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+adminListener.Addr().String()+"/admin/transactions?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var transactions Transactions
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&transactions); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, transactions
+	}
+
+	if status, _ := get("", ""); status != http.StatusUnauthorized {
+		t.Fatalf("Wrong status without a token: %d", status)
+	}
+
+	status, all := get("", "secret")
+	if status != http.StatusOK || len(all.Transactions) < 2 || all.NextPageToken != "" {
+		t.Fatalf("Wrong transactions: %d, %+v", status, all)
+	}
+
+	status, page := get("limit=1", "secret")
+	if status != http.StatusOK || len(page.Transactions) != 1 || page.NextPageToken == "" || page.Transactions[0].TransactionID != all.Transactions[0].TransactionID {
+		t.Fatalf("Wrong page: %d, %+v", status, page)
+	}
+
+	status, page = get("limit=1&page_token="+page.NextPageToken, "secret")
+	if status != http.StatusOK || len(page.Transactions) != 1 || page.Transactions[0].TransactionID != all.Transactions[1].TransactionID {
+		t.Fatalf("Wrong next page: %d, %+v", status, page)
+	}
+
+	status, page = get("product_id=jp.aktsk.kalvados.test.iap0", "secret")
+	if status != http.StatusOK || len(page.Transactions) != 1 || page.Transactions[0].ProductID != "jp.aktsk.kalvados.test.iap0" {
+		t.Fatalf("Wrong transactions of a product: %d, %+v", status, page)
+	}
+
+	for _, query := range []string{"limit=0", "from=yesterday", "page_token=!"} {
+		if status, _ := get(query, "secret"); status != http.StatusBadRequest {
+			t.Fatalf("Wrong status of %s: %d", query, status)
+		}
+	}
+}
+
+func TestVerifyReceipts(t *testing.T) {
+	certDER, _ := pem.Decode([]byte(certificate))
+	cert, err := x509.ParseCertificate(certDER.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Batches are larger than MaxBodySize, and their requests are not
+	maxBodySize := int64(len(receiptData) + 64)
+	s := httptest.NewServer(&Server{Cert: cert, BatchWorkers: 2, MaxBodySize: maxBodySize})
+	defer s.Close()
+
+	ndjson := fmt.Sprintf("{\"receipt-data\": %q}\n\n{invalid\n{\"receipt-data\": \"invalid\"}\n{\"receipt-data\": %q}", receiptData, receiptData)
+	array := fmt.Sprintf(" [{\"receipt-data\": %q}, {\"receipt-data\": \"invalid\"}, {\"receipt-data\": %q}, {\"receipt-data\": %q}]", receiptData, receiptData, receiptData)
+	large := fmt.Sprintf("{\"receipt-data\": %q}", strings.Repeat(receiptData, 2))
+	largeLine := fmt.Sprintf("{\"receipt-data\": %q}\n{\"receipt-data\": %q}\n%s\n{\"receipt-data\": %q}\n", receiptData, receiptData, large, receiptData)
+	largeElement := fmt.Sprintf("[{\"receipt-data\": %q}, %s, {\"receipt-data\": %q}]", receiptData, large, receiptData)
+
+	tests := []struct {
+		body     string
+		statuses []int
+		cut      bool
+	}{
+		{ndjson, []int{0, 21000, 21002, 0}, false},
+		{array, []int{0, 21002, 0, 0}, false},
+		{largeLine, []int{0, 0, 21000, 0}, false},
+		{largeElement, []int{0, 21000}, true},
+		{"", []int{}, false},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Post(s.URL+"/verifyReceipts", "application/x-ndjson", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if contentType := resp.Header.Get("Content-Type"); contentType != "application/x-ndjson" {
+			t.Fatalf("Wrong content type: %s", contentType)
+		}
+
+		statuses, cut := batchStatuses(t, resp.Body, len(test.statuses))
+		resp.Body.Close()
+
+		if !reflect.DeepEqual(statuses, test.statuses) {
+			t.Fatalf("Wrong statuses: %v", statuses)
+		}
+
+		if cut != test.cut {
+			t.Fatalf("Wrong cut of batch: %v", cut)
+		}
+	}
+}
+
+func TestVerifyReceiptsTimeouts(t *testing.T) {
+	certDER, _ := pem.Decode([]byte(certificate))
+	cert, err := x509.ParseCertificate(certDER.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Timeouts limit each request of a batch, instead of the whole batch
+	timeout := 500 * time.Millisecond
+	s := httptest.NewUnstartedServer(&Server{Cert: cert, ReadTimeout: timeout, WriteTimeout: timeout})
+	s.Config.ReadTimeout = timeout
+	s.Config.WriteTimeout = timeout
+	s.Start()
+	defer s.Close()
+
+	line := fmt.Sprintf("{\"receipt-data\": %q}\n", receiptData)
+
+	tests := []struct {
+		interval time.Duration
+		statuses []int
+		cut      bool
+	}{
+		{timeout / 5, []int{0, 0, 0, 0, 0, 0, 0, 0}, false},
+		{timeout * 3, []int{0, 21000}, true},
+	}
+
+	for _, test := range tests {
+		body, bodyWriter := io.Pipe()
+		go func() {
+			defer bodyWriter.Close()
+			for i := 0; i < 8; i++ {
+				if i > 0 {
+					time.Sleep(test.interval)
+				}
+				if _, err := io.WriteString(bodyWriter, line); err != nil {
+					return
+				}
+			}
+		}()
+
+		resp, err := http.Post(s.URL+"/verifyReceipts", "application/x-ndjson", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		statuses, cut := batchStatuses(t, resp.Body, len(test.statuses))
+		resp.Body.Close()
+		body.Close()
+
+		if !reflect.DeepEqual(statuses, test.statuses) {
+			t.Fatalf("Wrong statuses with interval %v: %v", test.interval, statuses)
+		}
+
+		if cut != test.cut {
+			t.Fatalf("Wrong cut of batch with interval %v: %v", test.interval, cut)
+		}
+	}
+}
+
+// batchStatuses decodes a response of /verifyReceipts with n requests, and
+// returns their statuses by index, and whether the batch is cut short
+func batchStatuses(t *testing.T, r io.Reader, n int) ([]int, bool) {
+	t.Helper()
+
+	statuses := make([]int, n)
+	seen := map[int]bool{}
+	cut := false
+
+	decoder := json.NewDecoder(r)
+	for decoder.More() {
+		var result BatchResult
+		if err := decoder.Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if cut {
+			t.Fatal("Batch should not be responded after it is cut")
+		}
+		if result.Index == -1 && result.Error != "" {
+			cut = true
+			continue
+		}
+		if result.Index < 0 || result.Index >= n || seen[result.Index] {
+			t.Fatalf("Wrong index: %d", result.Index)
+		}
+		seen[result.Index] = true
+		statuses[result.Index] = result.Result.Status
+	}
+
+	if len(seen) != n {
+		t.Fatalf("Wrong number of results: %d", len(seen))
+	}
+
+	return statuses, cut
+}
+
+func TestRequestID(t *testing.T) {
+	s := httptest.NewServer(&Server{})
+	defer s.Close()
+
+	req, err := http.NewRequest(http.MethodPost, s.URL+"/verifyReceipt", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Request-Id", "abc123")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if id := resp.Header.Get("X-Request-Id"); id != "abc123" {
+		t.Fatalf("Wrong X-Request-Id: %s", id)
+	}
+
+	resp, err = http.Post(s.URL+"/verifyReceipt", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if id := resp.Header.Get("X-Request-Id"); id == "" {
+		t.Fatal("X-Request-Id should be generated")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	certDER, _ := pem.Decode([]byte(certificate))
+	cert, err := x509.ParseCertificate(certDER.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	s := httptest.NewServer(&Server{Cert: cert})
+	defer s.Close()
+
+	reqBody, err := json.Marshal(Request{ReceiptData: receiptData})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.URL+"/verifyReceipt", bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+		if traceID := span.SpanContext().TraceID().String(); traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Fatalf("Wrong trace ID of %s: %s", span.Name(), traceID)
+		}
+	}
+
+	for _, name := range []string{
+		"verifyReceipt",
+		"receipt.Parse",
+		"receipt.Parse.base64",
+		"receipt.Parse.pkcs7",
+		"receipt.Parse.chain",
+		"receipt.Parse.signature",
+		"receipt.Parse.attributes",
+		"receipt.Validate",
+	} {
+		if _, ok := spans[name]; !ok {
+			t.Fatalf("%s span is not recorded", name)
+		}
+	}
+
+	if parent := spans["verifyReceipt"].Parent().SpanID().String(); parent != "00f067aa0ba902b7" {
+		t.Fatalf("Wrong parent of verifyReceipt: %s", parent)
+	}
+
+	found := false
+	for _, kv := range spans["receipt.Parse"].Attributes() {
+		if kv.Key == "receipt.bundle_id" && kv.Value.AsString() != "" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("receipt.bundle_id is not recorded: %v", spans["receipt.Parse"].Attributes())
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	handler := RequireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	for authorization, status := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != status {
+			t.Fatalf("Status for %q should be %d, not %d", authorization, status, w.Code)
+		}
+	}
+}
+
+func TestClientCAWithoutTLS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{ClientCAFile: "ca.pem"}
+	if err := s.Serve(context.Background(), l); err == nil {
+		t.Fatal("ClientCAFile without TLS should be an error")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	certDER, _ := pem.Decode([]byte(certificate))
+	cert, err := x509.ParseCertificate(certDER.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{Cert: cert, ReadTimeout: 5 * time.Second}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Serve(ctx, l)
+	}()
+
+	reqBody, err := json.Marshal(Request{ReceiptData: receiptData})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post("http://"+l.Addr().String(), "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result receipt.Result
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Status != 0 {
+		t.Fatalf("Status should be 0, not %d", result.Status)
+	}
+
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server is not shut down")
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	certDER, _ := pem.Decode([]byte(certificate))
+	cert, err := x509.ParseCertificate(certDER.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewServer(&Server{Cert: cert, GitCommit: "abc1234"})
+	defer s.Close()
+
+	reqBody, err := json.Marshal(Request{ReceiptData: receiptData})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/verifyReceipt", "/"} {
+		resp, err := http.Post(s.URL+path, "application/json", bytes.NewReader(reqBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var result receipt.Result
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if result.Status != 0 {
+			t.Fatalf("Status for %s should be 0, not %d", path, result.Status)
+		}
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/healthz", http.StatusOK},
+		{http.MethodGet, "/readyz", http.StatusOK},
+		{http.MethodGet, "/version", http.StatusOK},
+		{http.MethodGet, "/favicon.ico", http.StatusNotFound},
+		{http.MethodGet, "/verifyReceipt", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/healthz", http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, s.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Fatalf("Status for %s %s should be %d, not %d", test.method, test.path, test.status, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(s.URL + "/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var v map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+
+	if v["version"] != version.Get() || v["git_commit"] != "abc1234" {
+		t.Fatalf("Wrong version: %v", v)
+	}
+}
+
 func request(t *testing.T, data string) receipt.Result {
 	certDER, _ := pem.Decode([]byte(certificate))
 	cert, err := x509.ParseCertificate(certDER.Bytes)
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aktsk/nolmandy/receipt"
+	"github.com/aktsk/nolmandy/store"
+)
+
+// StatusTransactionReused is the status for receipts whose transactions are
+// redeemed for other users, when the reuse policy is ReuseReject
+const StatusTransactionReused = 21304
+
+// Reuse policies of Server
+const (
+	// ReuseWarn responds with a warning outcome in rules
+	ReuseWarn = "warn"
+
+	// ReuseReject rejects receipts with StatusTransactionReused
+	ReuseReject = "reject"
+)
+
+// reuseRule is the name of the rule outcome for reused transactions
+const reuseRule = "transaction_reused"
+
+// recordTransactions records the transactions of a successful result for the
+// user of a request. Transactions of requests without user IDs are recorded
+// for nobody, and are never reused.
+func (s *Server) recordTransactions(ctx context.Context, request Request, result *receipt.Result) {
+	if s.Store == nil || result.Status != 0 {
+		return
+	}
+
+	records := store.Records(*result, request.UserID, time.Now())
+	if len(records) == 0 {
+		return
+	}
+
+	conflicts, err := s.Store.Record(ctx, records)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to record transactions", "error", err)
+		if s.ReusePolicy == ReuseReject {
+			*result = receipt.Result{Status: 21100, IsRetryable: true}
+		}
+		return
+	}
+
+	if len(conflicts) == 0 {
+		return
+	}
+
+	message := conflicts[0].String()
+	if len(conflicts) > 1 {
+		message = fmt.Sprintf("%s, and %d more", message, len(conflicts)-1)
+	}
+
+	slog.WarnContext(ctx, "transactions are reused", "transaction_id", conflicts[0].TransactionID, "conflicts", len(conflicts), "policy", s.ReusePolicy)
+
+	if s.ReusePolicy == ReuseReject {
+		*result = receipt.Result{
+			Status: StatusTransactionReused,
+			Reason: message,
+			Rules:  []receipt.RuleOutcome{{Name: reuseRule, Severity: receipt.SeverityReject, Message: message}},
+		}
+		return
+	}
+
+	result.Rules = append(result.Rules, receipt.RuleOutcome{Name: reuseRule, Severity: receipt.SeverityWarn, Message: message})
+}
+
+// MaxQueryLimit is the maximum number of transactions in a response of
+// TransactionsHandler
+const MaxQueryLimit = 1000
+
+// Transactions is a response of TransactionsHandler
+type Transactions struct {
+	Transactions  []receipt.InApp `json:"transactions"`
+	NextPageToken string          `json:"next_page_token,omitempty"`
+}
+
+// TransactionsHandler queries the transactions of a store with GET, by
+// transaction_id, original_transaction_id, product_id, bundle_id, and
+// purchase dates from (inclusive) and to (exclusive) in RFC 3339. Pages are
+// limited by limit, and the next page is queried with page_token.
+func TransactionsHandler(s store.TransactionStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := parseQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		records, next, err := s.Query(r.Context(), query)
+		if errors.Is(err, store.ErrInvalidPageToken) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to query transactions", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		response := Transactions{Transactions: []receipt.InApp{}, NextPageToken: next}
+		for _, record := range records {
+			if record.InApp != nil {
+				response.Transactions = append(response.Transactions, *record.InApp)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+func parseQuery(values url.Values) (store.Query, error) {
+	query := store.Query{
+		TransactionID:         values.Get("transaction_id"),
+		OriginalTransactionID: values.Get("original_transaction_id"),
+		ProductID:             values.Get("product_id"),
+		BundleID:              values.Get("bundle_id"),
+		PageToken:             values.Get("page_token"),
+	}
+
+	for name, t := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if v := values.Get(name); v != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				return query, fmt.Errorf("invalid %s: %s", name, v)
+			}
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > MaxQueryLimit {
+			return query, fmt.Errorf("limit must be from 1 to %d: %s", MaxQueryLimit, v)
+		}
+		query.Limit = limit
+	}
+
+	return query, nil
+}
@@ -0,0 +1,176 @@
+package shadow
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/aktsk/nolmandy/receipt"
+)
+
+// DefaultIgnoredFields are fields which differ between any two responses
+var DefaultIgnoredFields = []string{
+	"request_date",
+	"request_date_ms",
+	"request_date_pst",
+	"latest_receipt",
+}
+
+// Difference is a field whose values differ between two results. Objects and
+// arrays are compared field by field, and are only recorded as "{...}" and
+// "[...]" when the other value is not an object or an array.
+type Difference struct {
+	Path     string      `json:"path"`
+	Local    interface{} `json:"local"`
+	Upstream interface{} `json:"upstream"`
+}
+
+// Diff structurally compares two results as they are encoded in JSON.
+// Fields named in ignored are skipped at any depth, and in-app purchase
+// receipts are compared in the order of their transaction IDs. latest_receipt
+// is always skipped not to record receipts.
+func Diff(local, upstream receipt.Result, ignored []string) ([]Difference, error) {
+	l, err := normalize(local)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := normalize(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	ignoredFields := map[string]bool{"latest_receipt": true}
+	for _, field := range ignored {
+		ignoredFields[field] = true
+	}
+
+	var diffs []Difference
+	diff("", l, u, ignoredFields, &diffs)
+
+	return diffs, nil
+}
+
+func normalize(result receipt.Result) (interface{}, error) {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	sortTransactions(v)
+
+	return v, nil
+}
+
+// sortTransactions sorts arrays of in-app purchase receipts by transaction ID,
+// since their order is not defined.
+func sortTransactions(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, child := range v {
+			sortTransactions(child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			sortTransactions(child)
+		}
+		sort.SliceStable(v, func(i, j int) bool {
+			return transactionID(v[i]) < transactionID(v[j])
+		})
+	}
+}
+
+func transactionID(v interface{}) string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	id, _ := m["transaction_id"].(string)
+	return id
+}
+
+func diff(path string, local, upstream interface{}, ignored map[string]bool, diffs *[]Difference) {
+	// Missing objects and arrays are compared as empty ones, so that only
+	// the fields in them are recorded
+	if local == nil {
+		switch upstream.(type) {
+		case map[string]interface{}:
+			local = map[string]interface{}{}
+		case []interface{}:
+			local = []interface{}{}
+		}
+	}
+
+	switch l := local.(type) {
+	case map[string]interface{}:
+		u, ok := upstream.(map[string]interface{})
+		if !ok && upstream != nil {
+			break
+		}
+
+		keys := map[string]bool{}
+		for key := range l {
+			keys[key] = true
+		}
+		for key := range u {
+			keys[key] = true
+		}
+
+		sortedKeys := make([]string, 0, len(keys))
+		for key := range keys {
+			if !ignored[key] {
+				sortedKeys = append(sortedKeys, key)
+			}
+		}
+		sort.Strings(sortedKeys)
+
+		for _, key := range sortedKeys {
+			diff(join(path, key), l[key], u[key], ignored, diffs)
+		}
+		return
+	case []interface{}:
+		u, ok := upstream.([]interface{})
+		if !ok && upstream != nil {
+			break
+		}
+
+		for i := 0; i < len(l) || i < len(u); i++ {
+			var lv, uv interface{}
+			if i < len(l) {
+				lv = l[i]
+			}
+			if i < len(u) {
+				uv = u[i]
+			}
+			diff(fmt.Sprintf("%s[%d]", path, i), lv, uv, ignored, diffs)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(local, upstream) {
+		*diffs = append(*diffs, Difference{Path: path, Local: summarize(local), Upstream: summarize(upstream)})
+	}
+}
+
+func summarize(v interface{}) interface{} {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "{...}"
+	case []interface{}:
+		return "[...]"
+	}
+	return v
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
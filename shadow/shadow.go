@@ -0,0 +1,181 @@
+package shadow
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/aktsk/nolmandy/client"
+	"github.com/aktsk/nolmandy/receipt"
+	"github.com/aktsk/nolmandy/server"
+)
+
+// Shadow validates receipts locally and responds with the local result.
+// In the background, it sends the same request to an upstream verifyReceipt
+// endpoint and records the differences between the two results.
+type Shadow struct {
+	// Client posts requests to the upstream endpoint
+	Client *client.Client
+
+	// Cert is the certificate for local validation. Apple Inc Root
+	// Certificate is used when Cert is nil.
+	Cert *x509.Certificate
+
+	// Verifier validates receipts locally, with per-app settings for
+	// example. Cert is used when Verifier is nil.
+	Verifier server.Verifier
+
+	// Sink records mismatches. Mismatches are logged when Sink is nil.
+	Sink Sink
+
+	// IgnoredFields are fields which are not compared. DefaultIgnoredFields
+	// are used when IgnoredFields is nil.
+	IgnoredFields []string
+
+	// Timeout limits the time to wait for the upstream endpoint
+	Timeout time.Duration
+
+	// MaxInFlight limits the number of concurrent upstream requests.
+	// Comparisons beyond the limit are skipped. Zero means no limit.
+	MaxInFlight int
+
+	// MaxBodySize limits the size of request bodies as in server.DecodeRequest
+	MaxBodySize int64
+
+	inFlight   int32
+	compared   int64
+	matched    int64
+	mismatched int64
+	failed     int64
+	skipped    int64
+}
+
+// Stats are the counts of comparisons
+type Stats struct {
+	Compared   int64 `json:"compared"`
+	Matched    int64 `json:"matched"`
+	Mismatched int64 `json:"mismatched"`
+	// Failed is the number of comparisons which failed because of upstream errors
+	Failed int64 `json:"failed"`
+	// Skipped is the number of comparisons skipped because of MaxInFlight
+	Skipped int64 `json:"skipped"`
+	// AgreementRate is the rate of matched comparisons
+	AgreementRate float64 `json:"agreement_rate"`
+}
+
+// Mismatch is recorded when local and upstream results differ. Only the
+// differences are recorded, not the results with the receipt.
+type Mismatch struct {
+	Time time.Time `json:"time"`
+	// ReceiptHash is the SHA-256 hash of the receipt data, to find the
+	// receipt without recording it
+	ReceiptHash string       `json:"receipt_hash"`
+	Differences []Difference `json:"differences"`
+}
+
+// ServeHTTP responds with the local result and compares it with the upstream result
+func (s *Shadow) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	request, ok := server.ReadRequest(w, r, s.MaxBodySize)
+	if !ok {
+		return
+	}
+
+	// Results are shaped when they are written, so a copy is written to
+	// compare the result as it is verified
+	local := s.verify(r.Context(), request)
+	server.WriteResult(w, local.Clone())
+
+	if s.MaxInFlight > 0 && atomic.AddInt32(&s.inFlight, 1) > int32(s.MaxInFlight) {
+		atomic.AddInt32(&s.inFlight, -1)
+		atomic.AddInt64(&s.skipped, 1)
+		return
+	}
+
+	go func() {
+		if s.MaxInFlight > 0 {
+			defer atomic.AddInt32(&s.inFlight, -1)
+		}
+		s.compare(context.WithoutCancel(r.Context()), request, local)
+	}()
+}
+
+func (s *Shadow) compare(ctx context.Context, request server.Request, local receipt.Result) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	upstream, err := s.Client.Verify(ctx, request.AppStoreRequest())
+	if err != nil {
+		slog.WarnContext(ctx, "failed to verify receipt upstream", "error", err)
+		atomic.AddInt64(&s.failed, 1)
+		return
+	}
+
+	ignored := s.IgnoredFields
+	if ignored == nil {
+		ignored = DefaultIgnoredFields
+	}
+
+	diffs, err := Diff(local, *upstream, ignored)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to compare results", "error", err)
+		atomic.AddInt64(&s.failed, 1)
+		return
+	}
+
+	atomic.AddInt64(&s.compared, 1)
+
+	if len(diffs) == 0 {
+		atomic.AddInt64(&s.matched, 1)
+		return
+	}
+
+	atomic.AddInt64(&s.mismatched, 1)
+
+	hash := sha256.Sum256([]byte(request.ReceiptData))
+	mismatch := Mismatch{
+		Time:        time.Now(),
+		ReceiptHash: hex.EncodeToString(hash[:]),
+		Differences: diffs,
+	}
+
+	sink := s.Sink
+	if sink == nil {
+		sink = &LogSink{}
+	}
+
+	if err := sink.Record(mismatch); err != nil {
+		slog.ErrorContext(ctx, "failed to record mismatch", "error", err)
+	}
+}
+
+// Stats returns the counts of comparisons so far
+func (s *Shadow) Stats() Stats {
+	stats := Stats{
+		Compared:   atomic.LoadInt64(&s.compared),
+		Matched:    atomic.LoadInt64(&s.matched),
+		Mismatched: atomic.LoadInt64(&s.mismatched),
+		Failed:     atomic.LoadInt64(&s.failed),
+		Skipped:    atomic.LoadInt64(&s.skipped),
+	}
+
+	if stats.Compared > 0 {
+		stats.AgreementRate = float64(stats.Matched) / float64(stats.Compared)
+	}
+
+	return stats
+}
+
+func (s *Shadow) verify(ctx context.Context, request server.Request) receipt.Result {
+	if s.Verifier != nil {
+		return server.VerifyWith(ctx, s.Verifier, request)
+	}
+	return server.VerifyContext(ctx, s.Cert, request)
+}
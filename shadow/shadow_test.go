@@ -0,0 +1,267 @@
+package shadow
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aktsk/nolmandy/catalog"
+	"github.com/aktsk/nolmandy/client"
+	"github.com/aktsk/nolmandy/internal/testutil"
+	"github.com/aktsk/nolmandy/receipt"
+	"github.com/aktsk/nolmandy/server"
+)
+
+type chanSink chan Mismatch
+
+func (s chanSink) Record(mismatch Mismatch) error {
+	s <- mismatch
+	return nil
+}
+
+func TestShadow(t *testing.T) {
+	cert, data := testutil.SignedReceipt(t, testutil.Receipt())
+
+	// The upstream endpoint is another nolmandy which agrees with the local one
+	agreeing := httptest.NewServer(http.HandlerFunc(server.Parse(cert)))
+	defer agreeing.Close()
+
+	sink := make(chanSink, 1)
+	s := &Shadow{
+		Client: &client.Client{URL: agreeing.URL},
+		Cert:   cert,
+		Sink:   sink,
+	}
+
+	result := request(t, s, data)
+
+	if result.Status != 0 {
+		t.Fatalf("Status should be 0, not %d", result.Status)
+	}
+
+	waitForComparisons(t, s, 1)
+
+	if stats := s.Stats(); stats.Matched != 1 || stats.AgreementRate != 1 {
+		t.Fatalf("Wrong stats: %+v", stats)
+	}
+
+	disagreeing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":0,"environment":"Production","receipt":{"bundle_id":"com.example.other"}}`))
+	}))
+	defer disagreeing.Close()
+
+	s.Client.URL = disagreeing.URL
+
+	request(t, s, data)
+
+	var mismatch Mismatch
+	select {
+	case mismatch = <-sink:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Mismatch is not recorded")
+	}
+
+	if !hasDifference(mismatch.Differences, "environment") || !hasDifference(mismatch.Differences, "receipt.bundle_id") {
+		t.Fatalf("Wrong differences: %+v", mismatch.Differences)
+	}
+
+	if hasDifference(mismatch.Differences, "receipt.request_date") {
+		t.Fatalf("request_date should be ignored: %+v", mismatch.Differences)
+	}
+
+	waitForComparisons(t, s, 2)
+
+	if stats := s.Stats(); stats.Mismatched != 1 || stats.AgreementRate != 0.5 {
+		t.Fatalf("Wrong stats: %+v", stats)
+	}
+}
+
+func TestDiffIgnoresTransactionOrder(t *testing.T) {
+	var local, upstream receipt.Result
+	json.Unmarshal([]byte(`{"status":0,"receipt":{"in_app":[{"transaction_id":"1"},{"transaction_id":"2"}]}}`), &local)
+	json.Unmarshal([]byte(`{"status":0,"receipt":{"in_app":[{"transaction_id":"2"},{"transaction_id":"1"}]}}`), &upstream)
+
+	diffs, err := Diff(local, upstream, DefaultIgnoredFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diffs) != 0 {
+		t.Fatalf("Results should be the same: %+v", diffs)
+	}
+}
+
+func TestShadowWithCatalog(t *testing.T) {
+	rcpt := testutil.Receipt()
+	rcpt.InApp = []*receipt.InApp{{Quantity: 1, ProductID: "com.example.app.monthly", TransactionID: "1", OriginalTransactionID: "1"}}
+	cert, data := testutil.SignedReceipt(t, rcpt)
+
+	upstream := httptest.NewServer(http.HandlerFunc(server.Parse(cert)))
+	defer upstream.Close()
+
+	sink := make(chanSink, 1)
+	s := &Shadow{
+		Client: &client.Client{URL: upstream.URL},
+		Cert:   cert,
+		Sink:   sink,
+	}
+
+	// Results are shaped by the catalog when they are written
+	ts := httptest.NewServer(&server.Server{
+		Handler: s,
+		Catalog: catalog.New(&catalog.Product{ID: "com.example.app.monthly", Type: catalog.AutoRenewable, SubscriptionGroup: "monthly"}),
+	})
+	defer ts.Close()
+
+	reqBody, err := json.Marshal(server.Request{ReceiptData: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(ts.URL+"/verifyReceipt", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result receipt.Result
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.LatestReceiptInfo) != 1 || result.Receipt.InApp[0].SubscriptionGroupIdentifier != "monthly" {
+		t.Fatalf("Result is not shaped: %+v", result)
+	}
+
+	waitForComparisons(t, s, 1)
+
+	select {
+	case mismatch := <-sink:
+		t.Fatalf("Shaped result should not be compared: %+v", mismatch.Differences)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if stats := s.Stats(); stats.Matched != 1 {
+		t.Fatalf("Wrong stats: %+v", stats)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "mismatches.jsonl")
+	sink, err := NewFileSink(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs := []Difference{
+		{Path: "receipt.in_app[0].transaction_id", Local: "1000000000000001", Upstream: "1000000000000002"},
+		{Path: "receipt.bundle_id", Local: "com.example.app", Upstream: "com.example.other"},
+	}
+	if err := sink.Record(Mismatch{ReceiptHash: "hash", Differences: diffs}); err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mismatch Mismatch
+	if err := json.Unmarshal(b, &mismatch); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Difference{
+		{Path: "receipt.in_app[0].transaction_id", Local: "[REDACTED]", Upstream: "[REDACTED]"},
+		{Path: "receipt.bundle_id", Local: "com.example.app", Upstream: "com.example.other"},
+	}
+	if !reflect.DeepEqual(mismatch.Differences, expected) {
+		t.Fatalf("Wrong differences: %s", b)
+	}
+}
+
+func TestLogSink(t *testing.T) {
+	var local, upstream receipt.Result
+	json.Unmarshal([]byte(`{"status":0,"latest_receipt":"local","receipt":{"in_app":[{"transaction_id":"1"}]}}`), &local)
+	json.Unmarshal([]byte(`{"status":0,"latest_receipt":"upstream","receipt":{"in_app":[{"transaction_id":"1"},{"transaction_id":"2","quantity":"1"}]}}`), &upstream)
+
+	diffs, err := Diff(local, upstream, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The missing in-app purchase receipt is compared field by field
+	if !hasDifference(diffs, "receipt.in_app[1].transaction_id") || hasDifference(diffs, "receipt.in_app[1]") || hasDifference(diffs, "latest_receipt") {
+		t.Fatalf("Wrong differences: %+v", diffs)
+	}
+
+	var buf bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer slog.SetDefault(defaultLogger)
+
+	if err := (&LogSink{}).Record(Mismatch{ReceiptHash: "hash", Differences: diffs}); err != nil {
+		t.Fatal(err)
+	}
+
+	var record struct {
+		Differences map[string]map[string]map[string]map[string]interface{} `json:"differences"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := record.Differences["receipt"]["in_app[1]"]["transaction_id"]; !reflect.DeepEqual(d, map[string]interface{}{"local": nil, "upstream": "2"}) {
+		t.Fatalf("Wrong differences: %s", buf.String())
+	}
+}
+
+func hasDifference(diffs []Difference, path string) bool {
+	for _, d := range diffs {
+		if d.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func waitForComparisons(t *testing.T, s *Shadow, n int64) {
+	for i := 0; i < 500; i++ {
+		if s.Stats().Compared >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Comparisons are not finished: %+v", s.Stats())
+}
+
+func request(t *testing.T, s *Shadow, data string) receipt.Result {
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	reqBody, err := json.Marshal(server.Request{ReceiptData: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(ts.URL, "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result receipt.Result
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
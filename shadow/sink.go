@@ -0,0 +1,153 @@
+package shadow
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aktsk/nolmandy/logging"
+)
+
+// Sink records mismatches between local and upstream results
+type Sink interface {
+	Record(mismatch Mismatch) error
+}
+
+// LogSink records mismatches to a logger
+type LogSink struct {
+	// Logger is the logger to write to. The default slog logger is used
+	// when Logger is nil.
+	Logger *log.Logger
+
+	// Redactor redacts differences written to Logger. The default
+	// redaction of logging is used when Redactor is nil. Differences
+	// written to the slog logger are redacted by the logger.
+	Redactor *logging.Redactor
+}
+
+// Record logs a mismatch. Differences are logged to the slog logger in groups
+// by their paths, so that fields such as transaction_id are redacted.
+func (s *LogSink) Record(mismatch Mismatch) error {
+	if s.Logger == nil {
+		slog.Warn("shadow mismatch", "receipt_hash", mismatch.ReceiptHash, slog.Attr{
+			Key:   "differences",
+			Value: slog.GroupValue(differenceAttrs(splitPaths(mismatch.Differences))...),
+		})
+		return nil
+	}
+
+	b, err := json.Marshal(redactDifferences(s.Redactor, mismatch.Differences))
+	if err != nil {
+		return err
+	}
+
+	s.Logger.Printf("shadow mismatch: receipt_hash=%s differences=%s", mismatch.ReceiptHash, b)
+	return nil
+}
+
+// redactDifferences redacts values of differences like logging does for
+// attributes in groups by their paths
+func redactDifferences(r *logging.Redactor, diffs []Difference) []Difference {
+	if r == nil {
+		r = logging.NewRedactor(logging.Options{})
+	}
+
+	redacted := make([]Difference, len(diffs))
+	for i, d := range diffs {
+		keys := strings.Split(d.Path, ".")
+		if r.Redacted(keys[:len(keys)-1], keys[len(keys)-1]) {
+			d.Local = redactValue(r, d.Local)
+			d.Upstream = redactValue(r, d.Upstream)
+		}
+		redacted[i] = d
+	}
+	return redacted
+}
+
+func redactValue(r *logging.Redactor, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	return r.Redact(fmt.Sprint(value))
+}
+
+type pathDifference struct {
+	keys       []string
+	difference Difference
+}
+
+func splitPaths(diffs []Difference) []pathDifference {
+	paths := make([]pathDifference, len(diffs))
+	for i, d := range diffs {
+		paths[i] = pathDifference{keys: strings.Split(d.Path, "."), difference: d}
+	}
+	return paths
+}
+
+// differenceAttrs nests differences in groups by the keys of their paths.
+// Differences of the same group are next to each other, since Diff sorts
+// them by their paths.
+func differenceAttrs(diffs []pathDifference) []slog.Attr {
+	var attrs []slog.Attr
+	for i := 0; i < len(diffs); {
+		key := diffs[i].keys[0]
+
+		if len(diffs[i].keys) == 1 {
+			d := diffs[i].difference
+			attrs = append(attrs, slog.Group(key, slog.Any("local", d.Local), slog.Any("upstream", d.Upstream)))
+			i++
+			continue
+		}
+
+		var children []pathDifference
+		for ; i < len(diffs) && len(diffs[i].keys) > 1 && diffs[i].keys[0] == key; i++ {
+			children = append(children, pathDifference{keys: diffs[i].keys[1:], difference: diffs[i].difference})
+		}
+		attrs = append(attrs, slog.Attr{Key: key, Value: slog.GroupValue(differenceAttrs(children)...)})
+	}
+	return attrs
+}
+
+// FileSink records mismatches to a file as JSON lines
+type FileSink struct {
+	// Redactor redacts differences like logs. The default redaction of
+	// logging is used when Redactor is nil.
+	Redactor *logging.Redactor
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileSink opens a file to append mismatches to
+func NewFileSink(name string) (*FileSink, error) {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{file: file}, nil
+}
+
+// Record appends a mismatch to the file
+func (s *FileSink) Record(mismatch Mismatch) error {
+	mismatch.Differences = redactDifferences(s.Redactor, mismatch.Differences)
+	b, err := json.Marshal(mismatch)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.file.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the file
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+
+	"github.com/aktsk/nolmandy/internal/jsonl"
+)
+
+// compactionSlack is the number of superseded lines which are kept in a File
+// before it is compacted, in addition to as many as the records
+const compactionSlack = 1000
+
+// File is a TransactionStore in a file. Records are appended to the file in
+// JSON lines, and all of them are kept in memory. The file is compacted to the
+// records in memory when it is opened, and when it has more than twice as
+// many lines as the records, by transactions recorded again for users or
+// forgotten beyond MaxUnowned.
+type File struct {
+	*Memory
+
+	f *jsonl.File[Record]
+}
+
+// OpenFile opens a file as a TransactionStore, creating it if it does not
+// exist. A partially written last line, by a crash for example, is ignored.
+func OpenFile(name string) (*File, error) {
+	m := NewMemory()
+
+	f, err := jsonl.Open(name, func(record Record) {
+		m.add([]Record{record})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &File{Memory: m, f: f}
+	if f.Len() > len(m.transactions) {
+		if err := f.Rewrite(m.records()); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Record records transactions for their users except for the conflicts, and
+// writes new records to the file before they are recorded in memory
+func (s *File) Record(ctx context.Context, records []Record) ([]Conflict, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conflicts := s.conflicts(records)
+
+	var added []Record
+	for _, r := range withoutConflicts(records, conflicts) {
+		if s.isNew(r) {
+			added = append(added, r)
+		}
+	}
+
+	if err := s.f.Append(added); err != nil {
+		return nil, err
+	}
+
+	s.add(added)
+
+	if s.f.Len() > 2*len(s.transactions)+compactionSlack {
+		// Records are already written, and are compacted again later
+		// when the file can not be rewritten
+		s.f.Rewrite(s.records())
+	}
+	return conflicts, nil
+}
+
+// Close closes the file
+func (s *File) Close() error {
+	return s.f.Close()
+}
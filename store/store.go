@@ -0,0 +1,402 @@
+// Package store records validated transactions with the users who redeemed
+// them, so that transactions redeemed for several users are detected.
+package store
+
+import (
+	"container/list"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aktsk/nolmandy/receipt"
+	"github.com/guregu/null/v5"
+)
+
+// Record is a transaction redeemed for a user
+type Record struct {
+	TransactionID         string    `json:"transaction_id"`
+	OriginalTransactionID string    `json:"original_transaction_id"`
+	ProductID             string    `json:"product_id"`
+	BundleID              string    `json:"bundle_id,omitempty"`
+	UserID                string    `json:"user_id"`
+	PurchaseDate          time.Time `json:"purchase_date"`
+	RecordedAt            time.Time `json:"recorded_at"`
+
+	// InApp is the transaction in the validated receipt
+	InApp *receipt.InApp `json:"in_app,omitempty"`
+}
+
+// Conflict is a transaction which is already recorded for another user
+type Conflict struct {
+	Record
+
+	// Existing is the record for the other user
+	Existing Record `json:"existing"`
+}
+
+func (c Conflict) String() string {
+	// Transaction IDs are not included, since messages are logged and
+	// returned to clients
+	return fmt.Sprintf("a transaction of %s is redeemed for another user", c.ProductID)
+}
+
+// TransactionStore records transactions for users. A transaction belongs to
+// the first user it is recorded for, and so do the other transactions of the
+// same original transaction ID, such as renewals and restores. Transactions
+// without users are recorded, but belong to nobody until they are recorded
+// for users.
+type TransactionStore interface {
+	// Record records transactions for their users. Transactions which
+	// belong to other users are not recorded, and are returned as conflicts.
+	Record(ctx context.Context, records []Record) ([]Conflict, error)
+
+	// Get returns the record of a transaction ID
+	Get(ctx context.Context, transactionID string) (Record, bool, error)
+
+	// Query returns the records matching a query by purchase date, and the
+	// page token of the next records, which is empty at the last page
+	Query(ctx context.Context, query Query) ([]Record, string, error)
+
+	Close() error
+}
+
+// DefaultLimit is the number of records of a query without Limit
+const DefaultLimit = 100
+
+// Query is a query of records. Empty fields match any records.
+type Query struct {
+	TransactionID         string
+	OriginalTransactionID string
+	ProductID             string
+	BundleID              string
+
+	// From and To limit purchase dates. From is inclusive, and To is
+	// exclusive.
+	From time.Time
+	To   time.Time
+
+	// Limit limits the number of records. DefaultLimit is used when Limit
+	// is zero.
+	Limit int
+
+	// PageToken is the page token returned by the previous query
+	PageToken string
+}
+
+// match reports whether a record matches the query
+func (q Query) match(r Record) bool {
+	switch {
+	case q.TransactionID != "" && r.TransactionID != q.TransactionID:
+		return false
+	case q.OriginalTransactionID != "" && r.OriginalTransactionID != q.OriginalTransactionID:
+		return false
+	case q.ProductID != "" && r.ProductID != q.ProductID:
+		return false
+	case q.BundleID != "" && r.BundleID != q.BundleID:
+		return false
+	case !q.From.IsZero() && r.PurchaseDate.Before(q.From):
+		return false
+	case !q.To.IsZero() && !r.PurchaseDate.Before(q.To):
+		return false
+	}
+	return true
+}
+
+// pageToken returns the page token of the records after a record
+func pageToken(r Record) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(r.PurchaseDate.UnixNano(), 10) + ":" + r.TransactionID))
+}
+
+// parsePageToken returns the purchase date and the transaction ID of the
+// last record of the previous page
+func parsePageToken(token string) (time.Time, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidPageToken
+	}
+
+	nanos, transactionID, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return time.Time{}, "", ErrInvalidPageToken
+	}
+
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidPageToken
+	}
+
+	return time.Unix(0, n), transactionID, nil
+}
+
+// ErrInvalidPageToken is returned by Query for malformed page tokens
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// Records returns the records of the transactions of a result for a user
+func Records(result receipt.Result, userID string, now time.Time) []Record {
+	var inApp []receipt.InApp
+	if result.Receipt != nil {
+		for _, i := range result.Receipt.InApp {
+			inApp = append(inApp, *i)
+		}
+	}
+	inApp = append(inApp, result.LatestReceiptInfo...)
+
+	bundleID := ""
+	if result.Receipt != nil {
+		bundleID = result.Receipt.BundleID
+	}
+
+	var records []Record
+	seen := map[string]bool{}
+
+	for _, i := range inApp {
+		if i.TransactionID == "" || seen[i.TransactionID] {
+			continue
+		}
+		seen[i.TransactionID] = true
+
+		records = append(records, Record{
+			TransactionID:         i.TransactionID,
+			OriginalTransactionID: i.OriginalTransactionID,
+			ProductID:             i.ProductID,
+			BundleID:              bundleID,
+			UserID:                userID,
+			PurchaseDate:          null.Time(i.PurchaseDate.Date).Time,
+			RecordedAt:            now,
+			InApp:                 &i,
+		})
+	}
+
+	return records
+}
+
+// DefaultMaxUnowned is the default number of transactions without users kept
+// by Memory
+const DefaultMaxUnowned = 100000
+
+// Memory is a TransactionStore in memory
+type Memory struct {
+	// MaxUnowned limits the number of transactions without users. The
+	// oldest of them are forgotten beyond the limit. DefaultMaxUnowned is
+	// used when MaxUnowned is zero, and negative MaxUnowned means no limit.
+	MaxUnowned int
+
+	mu           sync.RWMutex
+	transactions map[string]Record
+	owners       map[string]string
+
+	// unowned are the transaction IDs without users, from the oldest
+	unowned         *list.List
+	unownedElements map[string]*list.Element
+}
+
+// NewMemory returns an empty TransactionStore in memory
+func NewMemory() *Memory {
+	return &Memory{
+		transactions:    map[string]Record{},
+		owners:          map[string]string{},
+		unowned:         list.New(),
+		unownedElements: map[string]*list.Element{},
+	}
+}
+
+// Record records transactions for their users, except for the conflicts
+func (m *Memory) Record(ctx context.Context, records []Record) ([]Conflict, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conflicts := m.conflicts(records)
+	m.add(withoutConflicts(records, conflicts))
+
+	return conflicts, nil
+}
+
+// Get returns the record of a transaction ID
+func (m *Memory) Get(ctx context.Context, transactionID string) (Record, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r, ok := m.transactions[transactionID]
+	return r, ok, nil
+}
+
+// Query returns the records matching a query by purchase date
+func (m *Memory) Query(ctx context.Context, query Query) ([]Record, string, error) {
+	var (
+		after        time.Time
+		afterID      string
+		hasPageToken = query.PageToken != ""
+	)
+	if hasPageToken {
+		var err error
+		after, afterID, err = parsePageToken(query.PageToken)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+
+	m.mu.RLock()
+	var records []Record
+	if r, ok := m.transactions[query.TransactionID]; query.TransactionID != "" {
+		if ok && query.match(r) {
+			records = append(records, r)
+		}
+	} else {
+		for _, r := range m.transactions {
+			if query.match(r) {
+				records = append(records, r)
+			}
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		return less(records[i].PurchaseDate, records[i].TransactionID, records[j].PurchaseDate, records[j].TransactionID)
+	})
+
+	if hasPageToken {
+		i := sort.Search(len(records), func(i int) bool {
+			return less(after, afterID, records[i].PurchaseDate, records[i].TransactionID)
+		})
+		records = records[i:]
+	}
+
+	if len(records) <= limit {
+		return records, "", nil
+	}
+
+	records = records[:limit]
+	return records, pageToken(records[limit-1]), nil
+}
+
+// less orders records by purchase date, and then by transaction ID
+func less(date1 time.Time, id1 string, date2 time.Time, id2 string) bool {
+	if !date1.Equal(date2) {
+		return date1.Before(date2)
+	}
+	return id1 < id2
+}
+
+// Close does nothing
+func (m *Memory) Close() error {
+	return nil
+}
+
+// conflicts returns the records which belong to other users
+func (m *Memory) conflicts(records []Record) []Conflict {
+	var conflicts []Conflict
+
+	for _, r := range records {
+		if r.UserID == "" {
+			continue
+		}
+
+		existing, ok := m.transactions[r.TransactionID]
+		if !ok || existing.UserID == "" {
+			owner, owned := m.owners[r.OriginalTransactionID]
+			if !owned || owner == r.UserID {
+				continue
+			}
+			existing, ok = m.transactions[r.OriginalTransactionID]
+			if !ok || existing.UserID != owner {
+				existing = Record{OriginalTransactionID: r.OriginalTransactionID, UserID: owner}
+			}
+		}
+
+		if existing.UserID != r.UserID {
+			conflicts = append(conflicts, Conflict{Record: r, Existing: existing})
+		}
+	}
+
+	return conflicts
+}
+
+// withoutConflicts returns the records which are not in conflicts
+func withoutConflicts(records []Record, conflicts []Conflict) []Record {
+	if len(conflicts) == 0 {
+		return records
+	}
+
+	conflicting := make(map[string]bool, len(conflicts))
+	for _, c := range conflicts {
+		conflicting[c.TransactionID] = true
+	}
+
+	var rest []Record
+	for _, r := range records {
+		if !conflicting[r.TransactionID] {
+			rest = append(rest, r)
+		}
+	}
+	return rest
+}
+
+// add adds records which do not conflict. Transactions which are already
+// recorded are kept, unless they are recorded without users.
+func (m *Memory) add(records []Record) {
+	for _, r := range records {
+		if !m.isNew(r) {
+			continue
+		}
+
+		m.transactions[r.TransactionID] = r
+		if _, ok := m.owners[r.OriginalTransactionID]; !ok && r.OriginalTransactionID != "" && r.UserID != "" {
+			m.owners[r.OriginalTransactionID] = r.UserID
+		}
+
+		if e, ok := m.unownedElements[r.TransactionID]; ok {
+			m.unowned.Remove(e)
+			delete(m.unownedElements, r.TransactionID)
+		}
+		if r.UserID == "" {
+			m.unownedElements[r.TransactionID] = m.unowned.PushBack(r.TransactionID)
+		}
+	}
+
+	maxUnowned := m.MaxUnowned
+	if maxUnowned == 0 {
+		maxUnowned = DefaultMaxUnowned
+	}
+	for maxUnowned > 0 && m.unowned.Len() > maxUnowned {
+		transactionID := m.unowned.Remove(m.unowned.Front()).(string)
+		delete(m.unownedElements, transactionID)
+		delete(m.transactions, transactionID)
+	}
+}
+
+// records returns the recorded transactions to be loaded again by add: the
+// transactions of users by purchase date, and then the others from the oldest
+func (m *Memory) records() []Record {
+	records := make([]Record, 0, len(m.transactions))
+	for _, r := range m.transactions {
+		if r.UserID != "" {
+			records = append(records, r)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return less(records[i].PurchaseDate, records[i].TransactionID, records[j].PurchaseDate, records[j].TransactionID)
+	})
+
+	for e := m.unowned.Front(); e != nil; e = e.Next() {
+		records = append(records, m.transactions[e.Value.(string)])
+	}
+	return records
+}
+
+// isNew reports whether a record is not recorded yet, or is recorded without
+// a user and is now recorded for a user
+func (m *Memory) isNew(r Record) bool {
+	existing, ok := m.transactions[r.TransactionID]
+	return !ok || (existing.UserID == "" && r.UserID != "")
+}
@@ -0,0 +1,289 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T, s TransactionStore) {
+	ctx := context.Background()
+	now := time.Now()
+
+	alice := []Record{
+		{TransactionID: "1", OriginalTransactionID: "1", ProductID: "monthly", UserID: "alice", RecordedAt: now},
+		{TransactionID: "2", OriginalTransactionID: "1", ProductID: "monthly", UserID: "alice", RecordedAt: now},
+	}
+
+	conflicts, err := s.Record(ctx, alice)
+	if err != nil || len(conflicts) != 0 {
+		t.Fatalf("Wrong conflicts: %v, %v", conflicts, err)
+	}
+
+	// Recording the same transactions again is not a conflict
+	if conflicts, err := s.Record(ctx, alice); err != nil || len(conflicts) != 0 {
+		t.Fatalf("Wrong conflicts: %v, %v", conflicts, err)
+	}
+
+	bob := []Record{
+		{TransactionID: "9", OriginalTransactionID: "9", ProductID: "coins", UserID: "bob", RecordedAt: now},
+		{TransactionID: "3", OriginalTransactionID: "1", ProductID: "monthly", UserID: "bob", RecordedAt: now},
+	}
+
+	conflicts, err = s.Record(ctx, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || conflicts[0].TransactionID != "3" || conflicts[0].Existing.UserID != "alice" {
+		t.Fatalf("Wrong conflicts: %+v", conflicts)
+	}
+
+	// Transactions which do not conflict are recorded
+	if _, ok, _ := s.Get(ctx, "9"); !ok {
+		t.Fatal("Transactions without conflicts should be recorded")
+	}
+	if _, ok, _ := s.Get(ctx, "3"); ok {
+		t.Fatal("Conflicts should not be recorded")
+	}
+
+	if r, ok, err := s.Get(ctx, "2"); err != nil || !ok || r.UserID != "alice" {
+		t.Fatalf("Wrong record: %+v, %v", r, err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func TestFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "transactions.jsonl")
+
+	s, err := OpenFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+	s.Close()
+
+	// A partially written line is dropped on reopen
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"transaction_id":"4","orig`)
+	f.Close()
+
+	s, err = OpenFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if r, ok, err := s.Get(ctx, "1"); err != nil || !ok || r.UserID != "alice" {
+		t.Fatalf("Wrong record after reopen: %+v, %v", r, err)
+	}
+
+	conflicts, err := s.Record(ctx, []Record{{TransactionID: "5", OriginalTransactionID: "1", UserID: "bob"}})
+	if err != nil || len(conflicts) != 1 {
+		t.Fatalf("Owners should be kept after reopen: %v, %v", conflicts, err)
+	}
+
+	if _, err := s.Record(ctx, []Record{{TransactionID: "6", OriginalTransactionID: "6", UserID: "bob"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Close()
+
+	s, err = OpenFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	if _, ok, _ := s.Get(ctx, "6"); !ok {
+		t.Fatal("Records after a partial line should be loaded")
+	}
+}
+
+func TestFileCompaction(t *testing.T) {
+	ctx := context.Background()
+	name := filepath.Join(t.TempDir(), "transactions.jsonl")
+
+	s, err := OpenFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, userID := range []string{"", "alice"} {
+		if _, err := s.Record(ctx, []Record{{TransactionID: "1", OriginalTransactionID: "1", UserID: userID}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	// The record without the user is superseded, and dropped on reopen
+	s, err = OpenFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countLines(t, name); n != 1 {
+		t.Fatalf("Wrong number of lines after reopen: %d", n)
+	}
+	if r, ok, _ := s.Get(ctx, "1"); !ok || r.UserID != "alice" {
+		t.Fatalf("Wrong record after reopen: %+v", r)
+	}
+
+	// Forgotten transactions without users are dropped while recording
+	s.MaxUnowned = 1
+	n := compactionSlack + 10
+	for i := 0; i < n; i++ {
+		id := fmt.Sprint(i + 2)
+		if _, err := s.Record(ctx, []Record{{TransactionID: id, OriginalTransactionID: id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if lines := countLines(t, name); lines >= n {
+		t.Fatalf("File should be compacted: %d lines", lines)
+	}
+
+	s.Close()
+
+	s, err = OpenFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, ok, _ := s.Get(ctx, fmt.Sprint(n+1)); !ok {
+		t.Fatal("The latest transaction without users should be kept")
+	}
+
+	conflicts, err := s.Record(ctx, []Record{{TransactionID: "0", OriginalTransactionID: "1", UserID: "bob"}})
+	if err != nil || len(conflicts) != 1 || conflicts[0].Existing.UserID != "alice" {
+		t.Fatalf("Owners should be kept after compaction: %+v, %v", conflicts, err)
+	}
+}
+
+func countLines(t *testing.T, name string) int {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(b), "\n")
+}
+
+func TestWithoutUsers(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory()
+
+	if conflicts, err := s.Record(ctx, []Record{{TransactionID: "1", OriginalTransactionID: "1"}}); err != nil || len(conflicts) != 0 {
+		t.Fatalf("Wrong conflicts: %v, %v", conflicts, err)
+	}
+
+	for _, userID := range []string{"alice", ""} {
+		if conflicts, err := s.Record(ctx, []Record{{TransactionID: "1", OriginalTransactionID: "1", UserID: userID}}); err != nil || len(conflicts) != 0 {
+			t.Fatalf("Wrong conflicts for %q: %v, %v", userID, conflicts, err)
+		}
+	}
+
+	if r, _, _ := s.Get(ctx, "1"); r.UserID != "alice" {
+		t.Fatalf("Transaction should belong to the first user: %+v", r)
+	}
+
+	conflicts, err := s.Record(ctx, []Record{{TransactionID: "2", OriginalTransactionID: "1", UserID: "bob"}})
+	if err != nil || len(conflicts) != 1 || conflicts[0].Existing.UserID != "alice" {
+		t.Fatalf("Wrong conflicts: %+v, %v", conflicts, err)
+	}
+
+	// The oldest transactions without users are forgotten beyond MaxUnowned
+	s.MaxUnowned = 2
+	for _, id := range []string{"3", "4", "5"} {
+		if _, err := s.Record(ctx, []Record{{TransactionID: id, OriginalTransactionID: id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for id, recorded := range map[string]bool{"1": true, "3": false, "4": true, "5": true} {
+		if _, ok, _ := s.Get(ctx, id); ok != recorded {
+			t.Fatalf("Wrong record of %s: %v", id, ok)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var records []Record
+	for i := 0; i < 5; i++ {
+		records = append(records,
+			Record{TransactionID: fmt.Sprintf("a%d", i), OriginalTransactionID: "a0", ProductID: "monthly", BundleID: "com.example.app", PurchaseDate: start.AddDate(0, i, 0)},
+			Record{TransactionID: fmt.Sprintf("b%d", i), OriginalTransactionID: fmt.Sprintf("b%d", i), ProductID: "coins", BundleID: "com.example.game", PurchaseDate: start.AddDate(0, i, 0)},
+		)
+	}
+	if _, err := s.Record(ctx, records); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	query := Query{OriginalTransactionID: "a0", Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("Too many pages")
+		}
+
+		page, next, err := s.Query(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range page {
+			ids = append(ids, r.TransactionID)
+		}
+		if next == "" {
+			break
+		}
+		query.PageToken = next
+	}
+
+	if strings.Join(ids, ",") != "a0,a1,a2,a3,a4" {
+		t.Fatalf("Wrong records: %v", ids)
+	}
+
+	tests := []struct {
+		query    Query
+		expected string
+	}{
+		{Query{ProductID: "coins", From: start.AddDate(0, 1, 0), To: start.AddDate(0, 3, 0)}, "b1,b2"},
+		{Query{BundleID: "com.example.app", From: start.AddDate(0, 4, 0)}, "a4"},
+		{Query{TransactionID: "b3"}, "b3"},
+		{Query{TransactionID: "b3", ProductID: "monthly"}, ""},
+		{Query{Limit: 3}, "a0,b0,a1"},
+	}
+
+	for _, test := range tests {
+		page, _, err := s.Query(ctx, test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []string
+		for _, r := range page {
+			ids = append(ids, r.TransactionID)
+		}
+		if strings.Join(ids, ",") != test.expected {
+			t.Fatalf("Wrong records of %+v: %v", test.query, ids)
+		}
+	}
+
+	if _, _, err := s.Query(ctx, Query{PageToken: "!"}); err != ErrInvalidPageToken {
+		t.Fatalf("Wrong error of an invalid page token: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package timeline
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// textTimeFormat is the format of times in the text view
+const textTimeFormat = "2006-01-02 15:04:05"
+
+// WriteText writes a human-readable view of the timeline, one line per period
+// or gap, with times in UTC
+func (t *Timeline) WriteText(w io.Writer) error {
+	if len(t.Subscriptions) == 0 {
+		_, err := fmt.Fprintln(w, "No subscriptions")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	for n, s := range t.Subscriptions {
+		if n > 0 {
+			fmt.Fprintln(tw)
+		}
+
+		fmt.Fprintf(tw, "Subscription %s", s.OriginalTransactionID)
+		if s.SubscriptionGroup != "" {
+			fmt.Fprintf(tw, " (group %s)", s.SubscriptionGroup)
+		}
+		fmt.Fprintln(tw)
+
+		gaps := s.Gaps
+		for _, p := range s.Periods {
+			for len(gaps) > 0 && !gaps[0].End.After(p.Start) {
+				fmt.Fprintf(tw, "  %s\t%s\tgap\t%s\t\t\t\n", formatTime(gaps[0].Start), formatTime(gaps[0].End), formatGap(gaps[0]))
+				gaps = gaps[1:]
+			}
+
+			note := ""
+			switch {
+			case p.Refunded:
+				note = "refunded at " + formatTime(*p.CancellationDate)
+				if p.CancellationReason != "" {
+					note += " (reason " + p.CancellationReason + ")"
+				}
+			case p.Upgraded:
+				note = "replaced by upgrade"
+				if p.CancellationDate != nil {
+					note += " at " + formatTime(*p.CancellationDate)
+				}
+			}
+
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				formatTime(p.Start), formatTime(p.End), p.Event, p.Kind, p.ProductID, p.TransactionID, note)
+		}
+	}
+
+	return tw.Flush()
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(textTimeFormat)
+}
+
+func formatGap(g Gap) string {
+	d := g.End.Sub(g.Start)
+	if d >= 24*time.Hour {
+		return fmt.Sprintf("%d days", int(d.Hours()/24))
+	}
+	return d.Round(time.Minute).String()
+}
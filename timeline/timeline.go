@@ -0,0 +1,253 @@
+// Package timeline rebuilds the history of auto-renewable subscriptions from
+// in-app purchase receipts, to answer what happened with a subscription.
+package timeline
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aktsk/nolmandy/catalog"
+	"github.com/aktsk/nolmandy/receipt"
+	"github.com/guregu/null/v5"
+)
+
+// gapThreshold is the shortest gap between periods. Renewals may start a
+// little after the previous periods end.
+const gapThreshold = time.Minute
+
+// Kind is the kind of a subscription period
+type Kind string
+
+// Kinds of periods
+const (
+	Trial      Kind = "trial"
+	IntroOffer Kind = "intro_offer"
+	Paid       Kind = "paid"
+)
+
+// Event is how a period started
+type Event string
+
+// Events of periods. A period starts with EventResubscribe after a gap.
+// Product changes are EventUpgrade, EventDowngrade or EventCrossgrade by the
+// group levels of the catalog, and EventProductChange when the levels are
+// unknown.
+const (
+	EventPurchase      Event = "purchase"
+	EventRenewal       Event = "renewal"
+	EventResubscribe   Event = "resubscribe"
+	EventUpgrade       Event = "upgrade"
+	EventDowngrade     Event = "downgrade"
+	EventCrossgrade    Event = "crossgrade"
+	EventProductChange Event = "product_change"
+)
+
+// Period is a period of a subscription, which is a transaction
+type Period struct {
+	Kind               Kind      `json:"kind"`
+	Event              Event     `json:"event"`
+	ProductID          string    `json:"product_id"`
+	TransactionID      string    `json:"transaction_id"`
+	WebOrderLineItemID int64     `json:"web_order_line_item_id,omitempty"`
+	Start              time.Time `json:"start"`
+	End                time.Time `json:"end"`
+
+	// Upgraded is true when the period was replaced by an upgrade, at
+	// CancellationDate
+	Upgraded bool `json:"upgraded,omitempty"`
+
+	// Refunded is true when the period was refunded by Apple customer
+	// support, at CancellationDate for CancellationReason
+	Refunded           bool       `json:"refunded,omitempty"`
+	CancellationDate   *time.Time `json:"cancellation_date,omitempty"`
+	CancellationReason string     `json:"cancellation_reason,omitempty"`
+}
+
+// Gap is a time when a subscription was not active
+type Gap struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Subscription is the timeline of a subscription, which is the transactions
+// of the same original transaction ID
+type Subscription struct {
+	OriginalTransactionID string   `json:"original_transaction_id"`
+	SubscriptionGroup     string   `json:"subscription_group,omitempty"`
+	Periods               []Period `json:"periods"`
+	Gaps                  []Gap    `json:"gaps,omitempty"`
+}
+
+// Timeline is the timelines of the subscriptions in receipts
+type Timeline struct {
+	Subscriptions []Subscription `json:"subscriptions"`
+}
+
+// FromReceipt builds the timeline of the in-app purchases of a receipt
+func FromReceipt(rcpt *receipt.Receipt, c *catalog.Catalog) *Timeline {
+	var inApp []receipt.InApp
+	for _, i := range rcpt.InApp {
+		inApp = append(inApp, *i)
+	}
+	return Build(inApp, c)
+}
+
+// FromResult builds the timeline of a verifyReceipt result, from the latest
+// receipt info and the in-app purchases of the receipt
+func FromResult(result receipt.Result, c *catalog.Catalog) *Timeline {
+	inApp := append([]receipt.InApp{}, result.LatestReceiptInfo...)
+	if result.Receipt != nil {
+		for _, i := range result.Receipt.InApp {
+			inApp = append(inApp, *i)
+		}
+	}
+	return Build(inApp, c)
+}
+
+// Build builds the timeline of in-app purchases. Purchases without expires
+// dates are not subscriptions, and are ignored. Transactions are linked by
+// web order line item ID, so that a period is not repeated when it is in both
+// a receipt and the latest receipt info. The catalog may be nil.
+func Build(inApp []receipt.InApp, c *catalog.Catalog) *Timeline {
+	byOriginal := map[string][]receipt.InApp{}
+	var originals []string
+
+	for _, i := range inApp {
+		if !null.Time(i.ExpiresDate.Date).Valid {
+			continue
+		}
+
+		if _, ok := byOriginal[i.OriginalTransactionID]; !ok {
+			originals = append(originals, i.OriginalTransactionID)
+		}
+		byOriginal[i.OriginalTransactionID] = append(byOriginal[i.OriginalTransactionID], i)
+	}
+
+	t := &Timeline{Subscriptions: []Subscription{}}
+	for _, original := range originals {
+		t.Subscriptions = append(t.Subscriptions, subscription(original, byOriginal[original], c))
+	}
+
+	sort.SliceStable(t.Subscriptions, func(i, j int) bool {
+		return t.Subscriptions[i].Periods[0].Start.Before(t.Subscriptions[j].Periods[0].Start)
+	})
+
+	return t
+}
+
+func subscription(original string, inApp []receipt.InApp, c *catalog.Catalog) Subscription {
+	s := Subscription{OriginalTransactionID: original}
+
+	var periods []Period
+	index := map[int64]int{}
+
+	for _, i := range inApp {
+		p := period(i)
+
+		if p.WebOrderLineItemID != 0 {
+			if j, ok := index[p.WebOrderLineItemID]; ok {
+				// The same period, whose later copy may tell that it is
+				// refunded or upgraded
+				if p.CancellationDate != nil && periods[j].CancellationDate == nil {
+					periods[j] = p
+				}
+				continue
+			}
+			index[p.WebOrderLineItemID] = len(periods)
+		}
+
+		periods = append(periods, p)
+
+		if s.SubscriptionGroup == "" {
+			s.SubscriptionGroup = i.SubscriptionGroupIdentifier
+			if product := c.Product(i.ProductID); s.SubscriptionGroup == "" && product != nil {
+				s.SubscriptionGroup = product.SubscriptionGroup
+			}
+		}
+	}
+
+	sort.SliceStable(periods, func(i, j int) bool {
+		return periods[i].Start.Before(periods[j].Start)
+	})
+
+	var end time.Time
+	for i := range periods {
+		p := &periods[i]
+
+		switch {
+		case i == 0:
+			p.Event = EventPurchase
+		case p.ProductID != periods[i-1].ProductID:
+			p.Event = productChange(c, periods[i-1].ProductID, p.ProductID)
+		case p.Start.Sub(end) > gapThreshold:
+			p.Event = EventResubscribe
+		default:
+			p.Event = EventRenewal
+		}
+
+		if i > 0 && p.Start.Sub(end) > gapThreshold {
+			s.Gaps = append(s.Gaps, Gap{Start: end, End: p.Start})
+		}
+
+		if e := p.activeUntil(); e.After(end) {
+			end = e
+		}
+	}
+
+	s.Periods = periods
+
+	return s
+}
+
+func period(i receipt.InApp) Period {
+	p := Period{
+		Kind:               Paid,
+		ProductID:          i.ProductID,
+		TransactionID:      i.TransactionID,
+		WebOrderLineItemID: i.WebOrderLineItemID,
+		Start:              null.Time(i.PurchaseDate.Date).Time,
+		End:                null.Time(i.ExpiresDate.Date).Time,
+		Upgraded:           i.IsUpgraded,
+	}
+
+	switch {
+	case i.IsTrialPeriod == "true":
+		p.Kind = Trial
+	case i.IsInIntroPrice:
+		p.Kind = IntroOffer
+	}
+
+	if cancellation := null.Time(i.CancellationDate.Date); cancellation.Valid {
+		p.CancellationDate = &cancellation.Time
+		p.CancellationReason = i.CancellationReason
+		p.Refunded = !i.IsUpgraded
+	}
+
+	return p
+}
+
+// activeUntil returns when the period stopped being active
+func (p *Period) activeUntil() time.Time {
+	if p.CancellationDate != nil && p.CancellationDate.Before(p.End) {
+		return *p.CancellationDate
+	}
+	return p.End
+}
+
+// productChange returns the event of a change from a product to another
+func productChange(c *catalog.Catalog, from, to string) Event {
+	f, t := c.Product(from), c.Product(to)
+	if f == nil || t == nil || f.GroupLevel == 0 || t.GroupLevel == 0 {
+		return EventProductChange
+	}
+
+	switch {
+	case t.GroupLevel < f.GroupLevel:
+		// Level 1 is the highest level of service
+		return EventUpgrade
+	case t.GroupLevel > f.GroupLevel:
+		return EventDowngrade
+	default:
+		return EventCrossgrade
+	}
+}
@@ -0,0 +1,134 @@
+package timeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aktsk/nolmandy/catalog"
+	"github.com/aktsk/nolmandy/receipt"
+)
+
+const result = `{
+  "status": 0,
+  "receipt": {
+    "in_app": [
+      {"product_id": "monthly", "transaction_id": "1", "original_transaction_id": "1", "web_order_line_item_id": "100",
+       "purchase_date": "2024-01-01 00:00:00 Etc/GMT", "expires_date": "2024-01-08 00:00:00 Etc/GMT", "is_trial_period": "true"},
+      {"product_id": "coins", "transaction_id": "9", "original_transaction_id": "9", "purchase_date": "2024-01-02 00:00:00 Etc/GMT"}
+    ]
+  },
+  "latest_receipt_info": [
+    {"product_id": "yearly", "transaction_id": "5", "original_transaction_id": "1", "web_order_line_item_id": "104",
+     "purchase_date": "2024-04-10 00:00:00 Etc/GMT", "expires_date": "2025-04-10 00:00:00 Etc/GMT",
+     "cancellation_date": "2024-04-20 00:00:00 Etc/GMT", "cancellation_reason": "1"},
+    {"product_id": "monthly", "transaction_id": "4", "original_transaction_id": "1", "web_order_line_item_id": "103",
+     "purchase_date": "2024-04-01 00:00:00 Etc/GMT", "expires_date": "2024-05-01 00:00:00 Etc/GMT",
+     "is_upgraded": "true", "cancellation_date": "2024-04-10 00:00:00 Etc/GMT"},
+    {"product_id": "monthly", "transaction_id": "3", "original_transaction_id": "1", "web_order_line_item_id": "102",
+     "purchase_date": "2024-03-01 00:00:00 Etc/GMT", "expires_date": "2024-04-01 00:00:00 Etc/GMT"},
+    {"product_id": "monthly", "transaction_id": "2", "original_transaction_id": "1", "web_order_line_item_id": "101",
+     "purchase_date": "2024-01-08 00:00:10 Etc/GMT", "expires_date": "2024-02-08 00:00:00 Etc/GMT", "is_in_intro_offer_period": "true"},
+    {"product_id": "monthly", "transaction_id": "1", "original_transaction_id": "1", "web_order_line_item_id": "100",
+     "purchase_date": "2024-01-01 00:00:00 Etc/GMT", "expires_date": "2024-01-08 00:00:00 Etc/GMT", "is_trial_period": "true"},
+    {"product_id": "weekly", "transaction_id": "20", "original_transaction_id": "20", "web_order_line_item_id": "200",
+     "purchase_date": "2024-06-01 00:00:00 Etc/GMT", "expires_date": "2024-06-08 00:00:00 Etc/GMT"}
+  ]
+}`
+
+func TestFromResult(t *testing.T) {
+	var r receipt.Result
+	if err := json.Unmarshal([]byte(result), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	c := catalog.New(
+		&catalog.Product{ID: "yearly", Type: catalog.AutoRenewable, SubscriptionGroup: "21432517", GroupLevel: 1},
+		&catalog.Product{ID: "monthly", Type: catalog.AutoRenewable, SubscriptionGroup: "21432517", GroupLevel: 2},
+	)
+
+	tl := FromResult(r, c)
+
+	if len(tl.Subscriptions) != 2 {
+		t.Fatalf("Wrong subscriptions: %+v", tl.Subscriptions)
+	}
+
+	s := tl.Subscriptions[0]
+	if s.OriginalTransactionID != "1" || s.SubscriptionGroup != "21432517" {
+		t.Fatalf("Wrong subscription: %+v", s)
+	}
+
+	expected := []struct {
+		transactionID string
+		kind          Kind
+		event         Event
+	}{
+		{"1", Trial, EventPurchase},
+		{"2", IntroOffer, EventRenewal},
+		{"3", Paid, EventResubscribe},
+		{"4", Paid, EventRenewal},
+		{"5", Paid, EventUpgrade},
+	}
+
+	if len(s.Periods) != len(expected) {
+		t.Fatalf("Wrong periods: %+v", s.Periods)
+	}
+
+	for i, e := range expected {
+		p := s.Periods[i]
+		if p.TransactionID != e.transactionID || p.Kind != e.kind || p.Event != e.event {
+			t.Fatalf("Wrong period %d: %+v", i, p)
+		}
+	}
+
+	if p := s.Periods[3]; !p.Upgraded || p.Refunded {
+		t.Fatalf("Period 3 should be upgraded: %+v", p)
+	}
+
+	if p := s.Periods[4]; !p.Refunded || p.CancellationReason != "1" {
+		t.Fatalf("Period 4 should be refunded: %+v", p)
+	}
+
+	if len(s.Gaps) != 1 || s.Gaps[0].End != s.Periods[2].Start {
+		t.Fatalf("Wrong gaps: %+v", s.Gaps)
+	}
+
+	if s := tl.Subscriptions[1]; s.OriginalTransactionID != "20" || s.Periods[0].Event != EventPurchase {
+		t.Fatalf("Wrong subscription: %+v", s)
+	}
+
+	if p := FromResult(r, nil).Subscriptions[0].Periods[4]; p.Event != EventProductChange {
+		t.Fatalf("Product change should be unknown without a catalog: %s", p.Event)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	var r receipt.Result
+	if err := json.Unmarshal([]byte(result), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := FromResult(r, nil).WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		"Subscription 1\n",
+		"2024-01-01 00:00:00  2024-01-08 00:00:00  purchase",
+		"2024-02-08 00:00:00  2024-03-01 00:00:00  gap             22 days",
+		"replaced by upgrade at 2024-04-10 00:00:00",
+		"refunded at 2024-04-20 00:00:00 (reason 1)",
+		"Subscription 20\n",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("%q is not found in:\n%s", s, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := (&Timeline{}).WriteText(&buf); err != nil || buf.String() != "No subscriptions\n" {
+		t.Fatalf("Wrong text of empty timeline: %q", buf.String())
+	}
+}
@@ -0,0 +1,92 @@
+// Package tracing sets up OpenTelemetry tracing for nolmandy commands and
+// servers.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aktsk/nolmandy/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Options configures tracing
+type Options struct {
+	// Exporter is "otlp", "stdout" or "none". Spans are not exported when
+	// Exporter is empty or "none", but trace context is still propagated.
+	// The OTLP exporter is configured with OTEL_EXPORTER_OTLP_* environment
+	// variables.
+	Exporter string
+
+	// ServiceName is the service.name resource attribute
+	ServiceName string
+
+	// SampleRatio is the ratio of traces to sample when there is no
+	// sampled parent span. All traces are sampled when SampleRatio is zero.
+	SampleRatio float64
+
+	// Writer is the writer of the stdout exporter. os.Stdout is used when
+	// Writer is nil.
+	Writer io.Writer
+}
+
+// Setup sets the global tracer provider and the W3C trace context
+// propagator. The returned function flushes and stops exporting spans.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch opts.Exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		w := opts.Writer
+		if w == nil {
+			w = os.Stdout
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(w))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter: %s", opts.Exporter)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(opts.ServiceName),
+		semconv.ServiceVersion(version.Get()),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if opts.SampleRatio > 0 {
+		sampler = sdktrace.TraceIDRatioBased(opts.SampleRatio)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,35 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestStdoutExporter(t *testing.T) {
+	var buf bytes.Buffer
+	shutdown, err := Setup(context.Background(), Options{Exporter: "stdout", ServiceName: "test", Writer: &buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, span := otel.Tracer("test").Start(context.Background(), "test-span")
+	span.End()
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "test-span") {
+		t.Fatalf("Span is not exported: %s", buf.String())
+	}
+}
+
+func TestUnknownExporter(t *testing.T) {
+	if _, err := Setup(context.Background(), Options{Exporter: "zipkin"}); err == nil {
+		t.Fatal("Unknown exporter should be an error")
+	}
+}